@@ -0,0 +1,348 @@
+// Package backup dumps the users of a server.Store to a signed JSONL file,
+// restores them, and copies them between stores.
+//
+// A dump is a header line, one line per app and per user, and a signature
+// line:
+//
+//	{"type":"header","format":"plissken-backup","version":1,...}
+//	{"type":"app","apptoken":"my-app"}
+//	{"type":"user","apptoken":"my-app","username":"bob","envelope":{...}}
+//	{"type":"signature","signature":"<hex>"}
+//
+// The signature is ed25519 over the SHA-512 of every byte before the
+// signature line.
+//
+// Only apps and envelopes are dumped: app secrets come from the auth-server's
+// config, and pending registrations, auth nonces and session tokens are
+// short-lived (users just login again).
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/server"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+const (
+	Format = "plissken-backup"
+	// Version is incremented whenever a dump's content changes in a way older
+	// versions of Import can't read
+	Version = 1
+
+	recordHeader    = "header"
+	recordApp       = "app"
+	recordUser      = "user"
+	recordSignature = "signature"
+
+	// listPageSize is how many app tokens or usernames are listed at once
+	listPageSize = 500
+)
+
+// maxLineSize bounds a dump's lines: envelopes are a few hundred bytes
+const maxLineSize = 1 << 20
+
+var (
+	ErrBadSignature = errors.New("bad backup signature")
+	ErrUnsigned     = errors.New("backup isn't signed")
+)
+
+type record struct {
+	Type string `json:"type"`
+
+	// Header
+	Format    string `json:"format,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	CreatedAt int64  `json:"created_at,omitempty"`
+	PublicKey string `json:"public_key,omitempty"`
+
+	// App and user
+	AppToken string                       `json:"apptoken,omitempty"`
+	Username string                       `json:"username,omitempty"`
+	Envelope *plisskenserver.UserEnvelope `json:"envelope,omitempty"`
+
+	// Signature
+	Signature string `json:"signature,omitempty"`
+}
+
+// Stats counts what was exported, imported or copied
+type Stats struct {
+	Apps  int
+	Users int
+	// Skipped counts the users that already existed in the destination
+	Skipped int
+}
+
+// Export writes every app and user envelope of 'store' to 'w', signed with
+// 'key'
+func Export(
+	ctx context.Context,
+	store server.Store,
+	w io.Writer,
+	key ed25519.PrivateKey,
+) (Stats, error) {
+	var stats Stats
+	digest := sha512.New()
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(io.MultiWriter(bw, digest))
+
+	err := enc.Encode(&record{
+		Type:      recordHeader,
+		Format:    Format,
+		Version:   Version,
+		CreatedAt: time.Now().Unix(),
+		PublicKey: hex.EncodeToString(key.Public().(ed25519.PublicKey)),
+	})
+	if err != nil {
+		return stats, errors.Wrap(err, "")
+	}
+
+	err = forEachUser(ctx, store,
+		func(apptoken string) error {
+			stats.Apps++
+			return enc.Encode(&record{Type: recordApp, AppToken: apptoken})
+		},
+		func(apptoken, username string, env *plisskenserver.UserEnvelope) error {
+			stats.Users++
+			return enc.Encode(&record{
+				Type:     recordUser,
+				AppToken: apptoken,
+				Username: username,
+				Envelope: env,
+			})
+		})
+	if err != nil {
+		return stats, errors.Wrap(err, "")
+	}
+
+	sig := ed25519.Sign(key, digest.Sum(nil))
+	err = json.NewEncoder(bw).Encode(&record{
+		Type:      recordSignature,
+		Signature: hex.EncodeToString(sig),
+	})
+	if err != nil {
+		return stats, errors.Wrap(err, "")
+	}
+	return stats, errors.Wrap(bw.Flush(), "")
+}
+
+// Verify checks that the dump in 'r' is complete and was signed by 'pubKey'
+func Verify(r io.Reader, pubKey ed25519.PublicKey) error {
+	if len(pubKey) != ed25519.PublicKeySize {
+		return errors.Errorf("bad public key length %d", len(pubKey))
+	}
+	return errors.Wrap(readDump(r, pubKey, nil), "")
+}
+
+// Import verifies the dump in 'r' against 'pubKey' (unless it's nil), then
+// stores its users in 'store'. Users that already have an envelope are
+// skipped, unless 'overwrite' is set. Apps aren't stored: their secrets come
+// from the config.
+func Import(
+	ctx context.Context,
+	store server.Store,
+	r io.ReadSeeker,
+	pubKey ed25519.PublicKey,
+	overwrite bool,
+) (Stats, error) {
+	var stats Stats
+	// Verify everything before writing anything
+	if pubKey != nil {
+		err := Verify(r, pubKey)
+		if err != nil {
+			return stats, errors.Wrap(err, "")
+		}
+		_, err = r.Seek(0, io.SeekStart)
+		if err != nil {
+			return stats, errors.Wrap(err, "")
+		}
+	}
+
+	err := readDump(r, nil, func(rec *record) error {
+		switch rec.Type {
+		case recordApp:
+			stats.Apps++
+			return nil
+		case recordUser:
+			stored, err := storeUser(ctx, store,
+				rec.AppToken, rec.Username, rec.Envelope, overwrite)
+			if err != nil {
+				return errors.Wrap(err, "")
+			}
+			if stored {
+				stats.Users++
+			} else {
+				stats.Skipped++
+			}
+			return nil
+		default:
+			return errors.Errorf("unknown record type %q", rec.Type)
+		}
+	})
+	return stats, errors.Wrap(err, "")
+}
+
+// Copy stores every user of 'from' in 'to', like Import
+func Copy(ctx context.Context, from, to server.Store, overwrite bool) (Stats, error) {
+	var stats Stats
+	err := forEachUser(ctx, from,
+		func(apptoken string) error {
+			stats.Apps++
+			return nil
+		},
+		func(apptoken, username string, env *plisskenserver.UserEnvelope) error {
+			stored, err := storeUser(ctx, to, apptoken, username, env, overwrite)
+			if err != nil {
+				return errors.Wrap(err, "")
+			}
+			if stored {
+				stats.Users++
+			} else {
+				stats.Skipped++
+			}
+			return nil
+		})
+	return stats, errors.Wrap(err, "")
+}
+
+// readDump calls 'fn' with every app and user record of the dump in 'r'. If
+// 'pubKey' isn't nil, the signature is checked once everything was read.
+func readDump(r io.Reader, pubKey ed25519.PublicKey, fn func(rec *record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxLineSize)
+	digest := sha512.New()
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		var rec record
+		dec := json.NewDecoder(bytes.NewReader(line))
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&rec)
+		if err != nil {
+			return errors.Wrapf(err, "line %d", lineNo)
+		}
+
+		switch {
+		case lineNo == 1:
+			if rec.Type != recordHeader || rec.Format != Format {
+				return errors.Errorf("not a %s file", Format)
+			}
+			if rec.Version > Version {
+				return errors.Errorf(
+					"backup version %d is newer than the supported one (%d)",
+					rec.Version, Version)
+			}
+		case rec.Type == recordSignature:
+			if scanner.Scan() {
+				return errors.Errorf("line %d: data after the signature", lineNo+1)
+			}
+			if pubKey == nil {
+				return nil
+			}
+			sig, err := hex.DecodeString(rec.Signature)
+			if err != nil {
+				return errors.Wrapf(err, "line %d", lineNo)
+			}
+			if !ed25519.Verify(pubKey, digest.Sum(nil), sig) {
+				return errors.WithStack(ErrBadSignature)
+			}
+			return nil
+		case fn != nil:
+			err = fn(&rec)
+			if err != nil {
+				return errors.Wrapf(err, "line %d", lineNo)
+			}
+		}
+		digest.Write(line)
+		digest.Write([]byte{'\n'})
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if lineNo == 0 {
+		return errors.Errorf("not a %s file", Format)
+	}
+	// Truncated dumps lose their signature
+	return errors.WithStack(ErrUnsigned)
+}
+
+// forEachUser calls 'appFn' with every app token of 'store', then 'userFn'
+// with each of its users
+func forEachUser(
+	ctx context.Context,
+	store server.Store,
+	appFn func(apptoken string) error,
+	userFn func(apptoken, username string, env *plisskenserver.UserEnvelope) error,
+) error {
+	apptokens, err := server.ListAll(func(cursor string) ([]string, string, error) {
+		return store.ListAppTokens(ctx, cursor, listPageSize)
+	})
+	if err != nil {
+		return errors.Wrap(err, "while listing apps")
+	}
+	for _, apptoken := range apptokens {
+		err = appFn(apptoken)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		usernames, err := server.ListAll(func(cursor string) ([]string, string, error) {
+			return store.ListUsernames(ctx, apptoken, cursor, listPageSize)
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while listing users of %s", apptoken)
+		}
+		for _, username := range usernames {
+			env, err := store.LoadUserEnvelope(ctx, apptoken, username)
+			if errors.Is(err, plisskenserver.ErrUserNotFound) {
+				// Deleted while we were listing
+				continue
+			}
+			if err != nil {
+				return errors.Wrapf(err, "while loading %s of %s", username, apptoken)
+			}
+			err = userFn(apptoken, username, env)
+			if err != nil {
+				return errors.Wrap(err, "")
+			}
+		}
+	}
+	return nil
+}
+
+// storeUser stores 'env' unless the user already has an envelope and
+// 'overwrite' isn't set. It returns whether it was stored.
+func storeUser(
+	ctx context.Context,
+	store server.Store,
+	apptoken, username string,
+	env *plisskenserver.UserEnvelope,
+	overwrite bool,
+) (bool, error) {
+	if apptoken == "" || username == "" || env == nil {
+		return false, errors.New("incomplete user record")
+	}
+	if !overwrite {
+		_, err := store.LoadUserEnvelope(ctx, apptoken, username)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, plisskenserver.ErrUserNotFound) {
+			return false, errors.Wrap(err, "")
+		}
+	}
+	err := store.StoreUserEnvelope(ctx, apptoken, username, env)
+	if err != nil {
+		return false, errors.Wrapf(err, "while storing %s of %s", username, apptoken)
+	}
+	return true, nil
+}
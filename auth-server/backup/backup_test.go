@@ -0,0 +1,181 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	cryptoRand "crypto/rand"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/afjoseph/plissken-auth-server/memstore"
+	"github.com/afjoseph/plissken-auth-server/rediswrapper"
+	"github.com/afjoseph/plissken-auth-server/server"
+	"github.com/afjoseph/plissken-auth-server/sqlstore"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func testEnvelope(seed string) *plisskenserver.UserEnvelope {
+	return &plisskenserver.UserEnvelope{
+		PubU:                     []byte("pubu-" + seed),
+		EnvU:                     []byte("envu-" + seed),
+		EnvUNonce:                []byte("nonce-" + seed),
+		RwdUSalt:                 []byte("salt-" + seed),
+		SerializedOprvPrivateKey: []byte("ku-" + seed),
+		KeyID:                    "key-1",
+	}
+}
+
+// populate stores 2 apps with 3 users each
+func populate(t *testing.T, store server.Store) {
+	ctx := context.Background()
+	for _, apptoken := range []string{"app-1", "app:2"} {
+		require.NoError(t, store.StoreAppSecret(ctx, apptoken, "secret"))
+		for i := 0; i < 3; i++ {
+			username := fmt.Sprintf("user:%d", i)
+			require.NoError(t, store.StoreUserEnvelope(ctx, apptoken, username,
+				testEnvelope(apptoken+"/"+username)))
+		}
+	}
+}
+
+// requireSameUsers checks that 'store' has the users stored by populate
+func requireSameUsers(t *testing.T, store server.Store) {
+	ctx := context.Background()
+	for _, apptoken := range []string{"app-1", "app:2"} {
+		for i := 0; i < 3; i++ {
+			username := fmt.Sprintf("user:%d", i)
+			env, err := store.LoadUserEnvelope(ctx, apptoken, username)
+			require.NoError(t, err)
+			require.Equal(t, testEnvelope(apptoken+"/"+username), env)
+		}
+	}
+}
+
+func newKey(t *testing.T) ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(cryptoRand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+func TestExportImport(t *testing.T) {
+	ctx := context.Background()
+	key := newKey(t)
+	pubKey := key.Public().(ed25519.PublicKey)
+
+	from := memstore.New()
+	populate(t, from)
+	var dump bytes.Buffer
+	stats, err := Export(ctx, from, &dump, key)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Users: 6}, stats)
+	require.NoError(t, Verify(bytes.NewReader(dump.Bytes()), pubKey))
+
+	to, err := sqlstore.Open(ctx, "sqlite://"+filepath.Join(t.TempDir(), "db"))
+	require.NoError(t, err)
+	defer to.Close()
+	stats, err = Import(ctx, to, bytes.NewReader(dump.Bytes()), pubKey, false)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Users: 6}, stats)
+	requireSameUsers(t, to)
+
+	// Importing twice keeps existing users
+	stats, err = Import(ctx, to, bytes.NewReader(dump.Bytes()), pubKey, false)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Skipped: 6}, stats)
+	stats, err = Import(ctx, to, bytes.NewReader(dump.Bytes()), pubKey, true)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Users: 6}, stats)
+}
+
+func TestBadDumps(t *testing.T) {
+	ctx := context.Background()
+	key := newKey(t)
+	pubKey := key.Public().(ed25519.PublicKey)
+	from := memstore.New()
+	populate(t, from)
+	var dump bytes.Buffer
+	_, err := Export(ctx, from, &dump, key)
+	require.NoError(t, err)
+	lines := strings.SplitAfter(strings.TrimSuffix(dump.String(), "\n"), "\n")
+
+	for name, tc := range map[string]struct {
+		dump    string
+		pubKey  ed25519.PublicKey
+		wantErr error
+	}{
+		"tampered": {
+			dump:    strings.Replace(dump.String(), "user:1", "user:9", 1),
+			pubKey:  pubKey,
+			wantErr: ErrBadSignature,
+		},
+		"other key": {
+			dump:    dump.String(),
+			pubKey:  newKey(t).Public().(ed25519.PublicKey),
+			wantErr: ErrBadSignature,
+		},
+		"truncated": {
+			dump:    strings.Join(lines[:len(lines)-2], ""),
+			pubKey:  pubKey,
+			wantErr: ErrUnsigned,
+		},
+		"line dropped": {
+			dump:    strings.Join(append(lines[:2:2], lines[3:]...), ""),
+			pubKey:  pubKey,
+			wantErr: ErrBadSignature,
+		},
+		"not a dump": {
+			dump:   `{"type":"user"}` + "\n",
+			pubKey: pubKey,
+		},
+		"newer version": {
+			dump: strings.Replace(dump.String(),
+				fmt.Sprintf(`"version":%d`, Version), fmt.Sprintf(`"version":%d`, Version+1), 1),
+			pubKey: pubKey,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			to := memstore.New()
+			stats, err := Import(ctx, to, strings.NewReader(tc.dump), tc.pubKey, false)
+			require.Error(t, err)
+			if tc.wantErr != nil {
+				require.ErrorIs(t, err, tc.wantErr)
+			}
+			require.Equal(t, 0, stats.Users, "nothing is imported from bad dumps")
+			require.Empty(t, to.Usernames("app-1"))
+		})
+	}
+
+	t.Run("unverified imports still need the whole dump", func(t *testing.T) {
+		_, err := Import(ctx, memstore.New(),
+			strings.NewReader(strings.Join(lines[:len(lines)-1], "")), nil, false)
+		require.ErrorIs(t, err, ErrUnsigned)
+	})
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	from := rediswrapper.RedisWrapper{UniversalClient: client}
+	populate(t, from)
+
+	to := memstore.New()
+	require.NoError(t, to.StoreUserEnvelope(ctx, "app-1", "user:0", testEnvelope("existing")))
+	stats, err := Copy(ctx, from, to, false)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Users: 5, Skipped: 1}, stats)
+	env, err := to.LoadUserEnvelope(ctx, "app-1", "user:0")
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("existing"), env)
+
+	stats, err = Copy(ctx, from, to, true)
+	require.NoError(t, err)
+	require.Equal(t, Stats{Apps: 2, Users: 6}, stats)
+	requireSameUsers(t, to)
+}
@@ -0,0 +1,171 @@
+// Package cachestore caches app secrets and user envelopes in front of a
+// server.Store.
+//
+// Entries are dropped when they're written through the cache, and when
+// another replica announces it wrote them through an Invalidator. Entries
+// also expire after a short TTL: it bounds how stale they can be if an
+// invalidation is lost, or if there's no Invalidator.
+package cachestore
+
+import (
+	"context"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/logging"
+	"github.com/afjoseph/plissken-auth-server/server"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+// Invalidator tells the other replicas of the auth-server which entries
+// changed. It's implemented by rediswrapper.RedisWrapper with pub/sub.
+type Invalidator interface {
+	PublishInvalidation(ctx context.Context, key string) error
+	// SubscribeInvalidations calls 'fn' with every published key until the
+	// returned io.Closer is closed
+	SubscribeInvalidations(ctx context.Context, fn func(key string)) (io.Closer, error)
+}
+
+type Options struct {
+	// Size is the maximum number of cached entries
+	Size int
+	// TTL is how long an entry is cached
+	TTL time.Duration
+	// Invalidator is optional: without it, other replicas' writes are only
+	// seen once the entries expire
+	Invalidator Invalidator
+}
+
+// Store implements server.Store: lookups of app secrets and envelopes are
+// cached, everything else goes straight to the wrapped store
+type Store struct {
+	server.Store
+
+	cache        *lru
+	invalidator  Invalidator
+	subscription io.Closer
+}
+
+// New wraps 'store' and, if 'opts.Invalidator' is set, subscribes to
+// invalidations. Close the returned Store to unsubscribe.
+func New(ctx context.Context, store server.Store, opts Options) (*Store, error) {
+	if opts.Size <= 0 || opts.TTL <= 0 {
+		return nil, errors.Errorf("cache size and TTL must be positive")
+	}
+	s := &Store{
+		Store:       store,
+		cache:       newLRU(opts.Size, opts.TTL),
+		invalidator: opts.Invalidator,
+	}
+	if s.invalidator != nil {
+		sub, err := s.invalidator.SubscribeInvalidations(ctx, s.cache.remove)
+		if err != nil {
+			return nil, errors.Wrap(err, "while subscribing to cache invalidations")
+		}
+		s.subscription = sub
+	}
+	return s, nil
+}
+
+// Close unsubscribes from invalidations. It doesn't close the wrapped store.
+func (s *Store) Close() error {
+	if s.subscription == nil {
+		return nil
+	}
+	return errors.Wrap(s.subscription.Close(), "")
+}
+
+func appSecretKey(apptoken string) string {
+	return "app_secret\x00" + apptoken
+}
+
+func envelopeKey(apptoken, username string) string {
+	return strings.Join([]string{"envelope", apptoken, username}, "\x00")
+}
+
+func (s *Store) HasAppSecret(ctx context.Context, apptoken, appSecret string) (bool, error) {
+	key := appSecretKey(apptoken)
+	if cached, ok := s.cache.get(key); ok {
+		return cached.(string) == appSecret, nil
+	}
+	gen := s.cache.generation()
+	ok, err := s.Store.HasAppSecret(ctx, apptoken, appSecret)
+	if err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	// Only a match tells us what the secret is
+	if ok {
+		s.cache.addIfGen(gen, key, appSecret)
+	}
+	return ok, nil
+}
+
+func (s *Store) StoreAppSecret(ctx context.Context, apptoken, appSecret string) error {
+	err := s.Store.StoreAppSecret(ctx, apptoken, appSecret)
+	s.invalidate(ctx, appSecretKey(apptoken))
+	return errors.Wrap(err, "")
+}
+
+func (s *Store) LoadUserEnvelope(
+	ctx context.Context,
+	apptoken, username string) (*plisskenserver.UserEnvelope, error) {
+	key := envelopeKey(apptoken, username)
+	if cached, ok := s.cache.get(key); ok {
+		return copyUserEnvelope(cached.(*plisskenserver.UserEnvelope)), nil
+	}
+	gen := s.cache.generation()
+	env, err := s.Store.LoadUserEnvelope(ctx, apptoken, username)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	s.cache.addIfGen(gen, key, copyUserEnvelope(env))
+	return env, nil
+}
+
+func (s *Store) StoreUserEnvelope(
+	ctx context.Context,
+	apptoken, username string,
+	env *plisskenserver.UserEnvelope) error {
+	err := s.Store.StoreUserEnvelope(ctx, apptoken, username, env)
+	s.invalidate(ctx, envelopeKey(apptoken, username))
+	return errors.Wrap(err, "")
+}
+
+func (s *Store) CompleteRegistration(
+	ctx context.Context,
+	apptoken, username string,
+	requestID []byte,
+	build func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error),
+) error {
+	err := s.Store.CompleteRegistration(ctx, apptoken, username, requestID, build)
+	s.invalidate(ctx, envelopeKey(apptoken, username))
+	return errors.Wrap(err, "")
+}
+
+// invalidate drops 'key' here and on the other replicas. It's called even if
+// the write failed: it may have partially succeeded.
+func (s *Store) invalidate(ctx context.Context, key string) {
+	s.cache.remove(key)
+	if s.invalidator == nil {
+		return
+	}
+	err := s.invalidator.PublishInvalidation(ctx, key)
+	if err != nil {
+		// The entry expires on the other replicas anyway
+		logging.FromContext(ctx).WithError(err).
+			Warn("Failed to publish cache invalidation")
+	}
+}
+
+func copyUserEnvelope(env *plisskenserver.UserEnvelope) *plisskenserver.UserEnvelope {
+	return &plisskenserver.UserEnvelope{
+		PubU:                     append([]byte(nil), env.PubU...),
+		EnvU:                     append([]byte(nil), env.EnvU...),
+		EnvUNonce:                append([]byte(nil), env.EnvUNonce...),
+		RwdUSalt:                 append([]byte(nil), env.RwdUSalt...),
+		SerializedOprvPrivateKey: append([]byte(nil), env.SerializedOprvPrivateKey...),
+		KeyID:                    env.KeyID,
+	}
+}
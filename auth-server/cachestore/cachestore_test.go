@@ -0,0 +1,200 @@
+package cachestore
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/memstore"
+	"github.com/afjoseph/plissken-auth-server/rediswrapper"
+	"github.com/afjoseph/plissken-auth-server/server"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/afjoseph/plissken-protocol/server/storagetest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+// countingStore counts the lookups reaching the wrapped store
+type countingStore struct {
+	server.Store
+
+	mu                    sync.Mutex
+	appSecrets, envelopes int
+}
+
+func (s *countingStore) HasAppSecret(ctx context.Context, apptoken, appSecret string) (bool, error) {
+	s.mu.Lock()
+	s.appSecrets++
+	s.mu.Unlock()
+	return s.Store.HasAppSecret(ctx, apptoken, appSecret)
+}
+
+func (s *countingStore) LoadUserEnvelope(
+	ctx context.Context,
+	apptoken, username string) (*plisskenserver.UserEnvelope, error) {
+	s.mu.Lock()
+	s.envelopes++
+	s.mu.Unlock()
+	return s.Store.LoadUserEnvelope(ctx, apptoken, username)
+}
+
+// localInvalidator broadcasts invalidations to the stores of this process
+type localInvalidator struct {
+	mu   sync.Mutex
+	subs []func(key string)
+}
+
+func (i *localInvalidator) PublishInvalidation(ctx context.Context, key string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	for _, fn := range i.subs {
+		fn(key)
+	}
+	return nil
+}
+
+func (i *localInvalidator) SubscribeInvalidations(
+	ctx context.Context, fn func(key string)) (io.Closer, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.subs = append(i.subs, fn)
+	return io.NopCloser(nil), nil
+}
+
+func TestStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		s, err := New(context.Background(), memstore.New(), Options{Size: 100, TTL: time.Hour})
+		require.NoError(t, err)
+		return s
+	})
+}
+
+func TestCache(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStore{Store: memstore.New()}
+	s, err := New(ctx, backend, Options{Size: 100, TTL: time.Hour})
+	require.NoError(t, err)
+	defer s.Close()
+
+	// App secrets: only matches are cached
+	require.NoError(t, s.StoreAppSecret(ctx, "app", "secret"))
+	for i := 0; i < 3; i++ {
+		ok, err := s.HasAppSecret(ctx, "app", "secret")
+		require.NoError(t, err)
+		require.True(t, ok)
+		ok, err = s.HasAppSecret(ctx, "app", "wrong")
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+	require.Equal(t, 1, backend.appSecrets)
+	require.NoError(t, s.StoreAppSecret(ctx, "app", "new-secret"))
+	ok, err := s.HasAppSecret(ctx, "app", "secret")
+	require.NoError(t, err)
+	require.False(t, ok, "writes invalidate the cache")
+
+	// Envelopes: cached copies can't be modified by callers
+	require.NoError(t, s.StoreUserEnvelope(ctx, "app", "user",
+		&plisskenserver.UserEnvelope{PubU: []byte("a")}))
+	env, err := s.LoadUserEnvelope(ctx, "app", "user")
+	require.NoError(t, err)
+	env.PubU[0] = 'x'
+	env, err = s.LoadUserEnvelope(ctx, "app", "user")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(env.PubU))
+	require.Equal(t, 1, backend.envelopes)
+
+	build := func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error) {
+		return &plisskenserver.UserEnvelope{PubU: []byte("b")}, nil
+	}
+	req := &plisskenserver.UserRequest{ID: []byte("id")}
+	require.NoError(t, s.StoreUserRequest(ctx, "app", "user", req))
+	err = s.CompleteRegistration(ctx, "app", "user", req.ID, build)
+	require.ErrorIs(t, err, plisskenserver.ErrUserExists)
+	env, err = s.LoadUserEnvelope(ctx, "app", "user")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(env.PubU))
+
+	// Missing envelopes aren't cached
+	for i := 0; i < 2; i++ {
+		_, err = s.LoadUserEnvelope(ctx, "app", "nobody")
+		require.ErrorIs(t, err, plisskenserver.ErrUserNotFound)
+	}
+	require.Equal(t, 4, backend.envelopes)
+	require.NoError(t, s.StoreUserRequest(ctx, "app", "nobody", req))
+	require.NoError(t, s.CompleteRegistration(ctx, "app", "nobody", req.ID, build))
+	env, err = s.LoadUserEnvelope(ctx, "app", "nobody")
+	require.NoError(t, err)
+	require.Equal(t, "b", string(env.PubU))
+}
+
+func TestCacheExpires(t *testing.T) {
+	ctx := context.Background()
+	backend := &countingStore{Store: memstore.New()}
+	s, err := New(ctx, backend, Options{Size: 100, TTL: time.Minute})
+	require.NoError(t, err)
+	now := time.Now()
+	s.cache.now = func() time.Time { return now }
+
+	require.NoError(t, backend.StoreAppSecret(ctx, "app", "secret"))
+	for i := 0; i < 2; i++ {
+		_, err := s.HasAppSecret(ctx, "app", "secret")
+		require.NoError(t, err)
+	}
+	require.Equal(t, 1, backend.appSecrets)
+	now = now.Add(time.Minute)
+	_, err = s.HasAppSecret(ctx, "app", "secret")
+	require.NoError(t, err)
+	require.Equal(t, 2, backend.appSecrets)
+}
+
+func TestInvalidationAcrossReplicas(t *testing.T) {
+	ctx := context.Background()
+	backend := memstore.New()
+	invalidator := &localInvalidator{}
+	replica1, err := New(ctx, backend, Options{Size: 100, TTL: time.Hour, Invalidator: invalidator})
+	require.NoError(t, err)
+	replica2, err := New(ctx, backend, Options{Size: 100, TTL: time.Hour, Invalidator: invalidator})
+	require.NoError(t, err)
+
+	require.NoError(t, replica1.StoreAppSecret(ctx, "app", "secret"))
+	ok, err := replica2.HasAppSecret(ctx, "app", "secret")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, replica1.StoreAppSecret(ctx, "app", "new-secret"))
+	ok, err = replica2.HasAppSecret(ctx, "app", "secret")
+	require.NoError(t, err)
+	require.False(t, ok, "replica 2 must have dropped the old secret")
+}
+
+func TestRedisInvalidation(t *testing.T) {
+	ctx := context.Background()
+	addr := miniredis.RunT(t).Addr()
+	newReplica := func() *Store {
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		t.Cleanup(func() { client.Close() })
+		rdw := rediswrapper.RedisWrapper{UniversalClient: client}
+		s, err := New(ctx, rdw, Options{Size: 100, TTL: time.Hour, Invalidator: rdw})
+		require.NoError(t, err)
+		t.Cleanup(func() { s.Close() })
+		return s
+	}
+	replica1, replica2 := newReplica(), newReplica()
+
+	require.NoError(t, replica1.StoreUserEnvelope(ctx, "app", "user",
+		&plisskenserver.UserEnvelope{PubU: []byte("a")}))
+	env, err := replica2.LoadUserEnvelope(ctx, "app", "user")
+	require.NoError(t, err)
+	require.Equal(t, "a", string(env.PubU))
+
+	require.NoError(t, replica1.StoreUserEnvelope(ctx, "app", "user",
+		&plisskenserver.UserEnvelope{PubU: []byte("b")}))
+	// Invalidations are delivered asynchronously
+	require.Eventually(t, func() bool {
+		env, err := replica2.LoadUserEnvelope(ctx, "app", "user")
+		return err == nil && string(env.PubU) == "b"
+	}, 5*time.Second, 10*time.Millisecond)
+}
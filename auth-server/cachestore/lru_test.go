@@ -0,0 +1,57 @@
+package cachestore
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRU(t *testing.T) {
+	t.Run("least recently used entries are evicted", func(t *testing.T) {
+		c := newLRU(2, time.Hour)
+		c.addIfGen(c.generation(), "a", 1)
+		c.addIfGen(c.generation(), "b", 2)
+		_, ok := c.get("a")
+		require.True(t, ok)
+		c.addIfGen(c.generation(), "c", 3)
+
+		_, ok = c.get("b")
+		require.False(t, ok, "b was the least recently used")
+		v, ok := c.get("a")
+		require.True(t, ok)
+		require.Equal(t, 1, v)
+		require.Equal(t, 2, c.len())
+	})
+
+	t.Run("entries expire", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		c := newLRU(2, time.Minute)
+		c.now = func() time.Time { return now }
+		c.addIfGen(c.generation(), "a", 1)
+		now = now.Add(59 * time.Second)
+		_, ok := c.get("a")
+		require.True(t, ok)
+		now = now.Add(time.Second)
+		_, ok = c.get("a")
+		require.False(t, ok)
+		require.Equal(t, 0, c.len())
+	})
+
+	t.Run("values read before a removal aren't cached", func(t *testing.T) {
+		c := newLRU(2, time.Hour)
+		gen := c.generation()
+		c.remove("a")
+		c.addIfGen(gen, "a", "stale")
+		_, ok := c.get("a")
+		require.False(t, ok)
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		c := newLRU(2, time.Hour)
+		c.addIfGen(c.generation(), "a", 1)
+		c.purge()
+		_, ok := c.get("a")
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,277 @@
+// js-bindings is not really a binary: it's just the bindings between
+// `protocol-lib` (the protocol implementation, written in Go) and the JS code
+// that uses it in client apps. It's compiled to WebAssembly: see main_js.go
+// for the entrypoint.
+//
+// Generate the bindings with: `just generate-js-bindings`
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	plisskenclient "github.com/afjoseph/plissken-protocol/client"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/pkg/errors"
+)
+
+// Error codes the bindings return to JS. The JS SDK throws them as
+// BindingError.
+const (
+	// An argument is empty, isn't valid JSON or hex, or has a bad length
+	codeBadArgument = "bad_argument"
+	// The password can't open the user's envelope
+	codeWrongPassword = "wrong_password"
+	// The server uses a key that isn't pinned
+	codeUntrustedServerKey = "untrusted_server_key"
+	// The protocol failed for another reason, e.g. a bad server response
+	codeProtocolError = "protocol_error"
+	// A bug in the bindings
+	codeInternalError = "internal_error"
+)
+
+// bindingError is an error with one of the codes above
+type bindingError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *bindingError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func badArgument(format string, args ...interface{}) error {
+	return errors.WithStack(&bindingError{
+		Code:    codeBadArgument,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// toBindingError gives 'err' a code, if it doesn't have one already
+func toBindingError(err error) *bindingError {
+	var bErr *bindingError
+	if errors.As(err, &bErr) {
+		return bErr
+	}
+	var vErr *plisskencommon.ValidationError
+	if errors.As(err, &vErr) {
+		return &bindingError{Code: codeBadArgument, Message: vErr.Error()}
+	}
+	if errors.Is(err, plisskenclient.ErrWrongPassword) {
+		// The cause doesn't help: we can't tell a wrong password from a
+		// tampered envelope
+		return &bindingError{
+			Code:    codeWrongPassword,
+			Message: plisskenclient.ErrWrongPassword.Error(),
+		}
+	}
+	if errors.Is(err, plisskenclient.ErrUntrustedServerKey) {
+		return &bindingError{
+			Code:    codeUntrustedServerKey,
+			Message: strings.TrimLeft(err.Error(), ": "),
+		}
+	}
+	// errors.Wrap(err, "") leaves leading ": "s
+	return &bindingError{
+		Code:    codeProtocolError,
+		Message: strings.TrimLeft(err.Error(), ": "),
+	}
+}
+
+// decodePinnedServerPubKeys decodes the pinned static keys of the
+// auth-server: hex-encoded and comma-separated. Like
+// plisskenclient.HTTPClient.ServerPubKeys, the first one is used for
+// registrations if the server doesn't name its key.
+func decodePinnedServerPubKeys(hexEncodedServerPubKeys string) ([]x25519.Key, error) {
+	var keys []x25519.Key
+	for _, s := range strings.Split(hexEncodedServerPubKeys, ",") {
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, badArgument("server public key isn't hex: %v", err)
+		}
+		key, err := plisskencommon.ParseX25519Key("server public key", b)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func isPinned(pinned []x25519.Key, pubS x25519.Key) bool {
+	for _, k := range pinned {
+		if k == pubS {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeJSON decodes the JSON argument 'name' into 'v'
+func decodeJSON(name, jsonStr string, v interface{}) error {
+	err := json.Unmarshal([]byte(jsonStr), v)
+	if err != nil {
+		return badArgument("%s isn't valid: %v", name, err)
+	}
+	return nil
+}
+
+// encodeJSON is json.Marshal returning a string
+func encodeJSON(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return string(b), nil
+}
+
+// checkNotEmpty fails if any of 'args' (name, value pairs) is empty
+func checkNotEmpty(args ...string) error {
+	var empty []string
+	for i := 0; i+1 < len(args); i += 2 {
+		if args[i+1] == "" {
+			empty = append(empty, args[i])
+		}
+	}
+	if len(empty) != 0 {
+		return badArgument("empty %s", strings.Join(empty, ", "))
+	}
+	return nil
+}
+
+func makeOprfRequest(
+	apptoken, username, password string,
+	// Returns a JSON-Marshalled OprfRequestResults
+) (string, error) {
+	err := checkNotEmpty("apptoken", apptoken,
+		"username", username, "password", password)
+	if err != nil {
+		return "", err
+	}
+
+	inputs, finData, evalReq, err := plisskenclient.MakeOprfRequest(password)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return encodeJSON(&plisskencommon.OprfRequestResults{
+		Username: username,
+		AppToken: apptoken,
+		Inputs:   inputs,
+		FinData:  finData,
+		EvalReq:  evalReq})
+}
+
+func finalizePasswordRegistration(
+	apptoken,
+	username,
+	oprfReqJsonStr,
+	oprfServerEvalJsonStr,
+	hexEncodedServerPubKeys string,
+	// Returns a JSON-Marshalled PasswordRegistrationData
+) (string, error) {
+	err := checkNotEmpty("apptoken", apptoken, "username", username)
+	if err != nil {
+		return "", err
+	}
+	pinned, err := decodePinnedServerPubKeys(hexEncodedServerPubKeys)
+	if err != nil {
+		return "", err
+	}
+	oprfReq := &plisskencommon.OprfRequestResults{}
+	err = decodeJSON("oprf request", oprfReqJsonStr, oprfReq)
+	if err != nil {
+		return "", err
+	}
+	oprfServerEval := &plisskencommon.OprfServerEvaluation{}
+	err = decodeJSON("server evaluation", oprfServerEvalJsonStr, oprfServerEval)
+	if err != nil {
+		return "", err
+	}
+
+	// Servers that predate key rotation don't say which key they register
+	// users with
+	serverPubKey := pinned[0]
+	if oprfServerEval.PubS != nil {
+		// Validated by UnmarshalJSON
+		copy(serverPubKey[:], oprfServerEval.PubS)
+		if !isPinned(pinned, serverPubKey) {
+			return "", errors.Wrapf(plisskenclient.ErrUntrustedServerKey,
+				"server registers users with %s",
+				plisskenserver.KeyFingerprint(serverPubKey))
+		}
+	}
+
+	envU, envUNonce,
+		pubU, salt, err := plisskenclient.MakeEnvU(
+		oprfReq.FinData,
+		oprfServerEval.Eval,
+		serverPubKey)
+	if err != nil {
+		return "", errors.Wrap(err, "while making envu")
+	}
+	return encodeJSON(&plisskencommon.PasswordRegistrationData{
+		AppToken:  apptoken,
+		Username:  username,
+		EnvU:      envU,
+		EnvUNonce: envUNonce,
+		PubU:      pubU,
+		Salt:      salt,
+		PubS:      serverPubKey[:],
+		RequestID: oprfServerEval.RequestID,
+	})
+}
+
+// finalizedLogin is finalize_password_authentication's result. If the server
+// asked for a key rotation, it also has the user's envU re-sealed for the
+// server's newest static key, to send along with the session token.
+type finalizedLogin struct {
+	HexEncodedSessionToken string `json:"session_token"`
+	HexEncodedEnvU         string `json:"envu,omitempty"`
+	HexEncodedEnvUNonce    string `json:"envu_nonce,omitempty"`
+}
+
+// finalizePasswordAuthentication is plisskenclient.FinalizeLogin with the
+// bindings' arguments. Like the Go client, it fails with an
+// untrusted_server_key error if the user's envelope, or the key the server
+// asks to rotate to, isn't pinned.
+func finalizePasswordAuthentication(
+	username,
+	oprfReqJsonStr,
+	startPasswordAuthDataJsonStr,
+	hexEncodedServerPubKeys string,
+	// Returns a JSON-Marshalled finalizedLogin
+) (string, error) {
+	err := checkNotEmpty("username", username)
+	if err != nil {
+		return "", err
+	}
+	pinned, err := decodePinnedServerPubKeys(hexEncodedServerPubKeys)
+	if err != nil {
+		return "", err
+	}
+	oprfReq := &plisskencommon.OprfRequestResults{}
+	err = decodeJSON("oprf request", oprfReqJsonStr, oprfReq)
+	if err != nil {
+		return "", err
+	}
+	startPasswordAuthData := &plisskencommon.StartPasswordAuthServerResp{}
+	err = decodeJSON("start_password_authentication response",
+		startPasswordAuthDataJsonStr, startPasswordAuthData)
+	if err != nil {
+		return "", err
+	}
+	sessionToken, newEnvU, newEnvUNonce, err := plisskenclient.FinalizeLogin(
+		oprfReq.FinData, startPasswordAuthData, pinned)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	return encodeJSON(&finalizedLogin{
+		HexEncodedSessionToken: hex.EncodeToString(sessionToken),
+		HexEncodedEnvU:         hex.EncodeToString(newEnvU),
+		HexEncodedEnvUNonce:    hex.EncodeToString(newEnvUNonce),
+	})
+}
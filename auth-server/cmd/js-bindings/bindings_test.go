@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func requireCode(t *testing.T, code string, err error) {
+	t.Helper()
+	require.Error(t, err)
+	require.Equal(t, code, toBindingError(err).Code, err.Error())
+}
+
+func TestBindings(t *testing.T) {
+	ctx := context.Background()
+	keyring := plisskenserver.NewKeyring()
+	key, err := keyring.Add("", nil)
+	require.NoError(t, err)
+	srv, err := plisskenserver.NewServerWithKeyring(
+		plisskenserver.NewMemoryStorage(), keyring)
+	require.NoError(t, err)
+	hexPubS := hex.EncodeToString(key.Pub[:])
+
+	oprfReqFor := func(password string) (string, *plisskencommon.OprfRequestResults) {
+		oprfReqJSON, err := makeOprfRequest("app", "bob", password)
+		require.NoError(t, err)
+		oprfReq := &plisskencommon.OprfRequestResults{}
+		require.NoError(t, json.Unmarshal([]byte(oprfReqJSON), oprfReq))
+		return oprfReqJSON, oprfReq
+	}
+
+	// Register
+	oprfReqJSON, oprfReq := oprfReqFor("hunter2")
+	eval, requestID, err := srv.HandleNewUserRequest(ctx, "app", "bob", oprfReq.EvalReq)
+	require.NoError(t, err)
+	evalJSON, err := json.Marshal(&plisskencommon.OprfServerEvaluation{
+		Eval: eval, RequestID: requestID})
+	require.NoError(t, err)
+
+	_, err = finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, string(evalJSON), hexPubS[2:])
+	requireCode(t, codeBadArgument, err)
+	_, err = finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, string(evalJSON), hexPubS+"00")
+	requireCode(t, codeBadArgument, err)
+	_, err = finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, "{", hexPubS)
+	requireCode(t, codeBadArgument, err)
+
+	regJSON, err := finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, string(evalJSON), hexPubS)
+	require.NoError(t, err)
+	reg := &plisskencommon.PasswordRegistrationData{}
+	require.NoError(t, json.Unmarshal([]byte(regJSON), reg))
+	require.NoError(t, srv.StoreUserData(ctx, "app", "bob", reg.RequestID,
+		reg.PubU, reg.EnvU, reg.EnvUNonce, reg.Salt, reg.PubS))
+
+	startLogin := func(password string, rotationPubS []byte) (string, string) {
+		oprfReqJSON, oprfReq := oprfReqFor(password)
+		eval, envU, envUNonce, salt, authNonce, err := srv.HandleNewUserAuthentication(
+			ctx, "app", "bob", oprfReq.EvalReq)
+		require.NoError(t, err)
+		startJSON, err := json.Marshal(&plisskencommon.StartPasswordAuthServerResp{
+			Eval:         eval,
+			EnvU:         envU,
+			EnvUNonce:    envUNonce,
+			RwdUSalt:     salt,
+			AuthNonce:    authNonce,
+			RotationPubS: rotationPubS,
+		})
+		require.NoError(t, err)
+		return oprfReqJSON, string(startJSON)
+	}
+	finalize := func(oprfReqJSON, startJSON, pinned string) (*finalizedLogin, error) {
+		finalizedJSON, err := finalizePasswordAuthentication("bob", oprfReqJSON, startJSON, pinned)
+		if err != nil {
+			return nil, err
+		}
+		finalized := &finalizedLogin{}
+		require.NoError(t, json.Unmarshal([]byte(finalizedJSON), finalized))
+		return finalized, nil
+	}
+	login := func(password, pinned string) (*finalizedLogin, error) {
+		oprfReqJSON, startJSON := startLogin(password, nil)
+		return finalize(oprfReqJSON, startJSON, pinned)
+	}
+	finalized, err := login("hunter2", hexPubS)
+	require.NoError(t, err)
+	require.Len(t, finalized.HexEncodedSessionToken, 2*plisskenserver.DefaultSessionTokenLength)
+	require.Empty(t, finalized.HexEncodedEnvU, "the server didn't ask for a key rotation")
+	require.Empty(t, finalized.HexEncodedEnvUNonce)
+	_, err = login("hunter3", hexPubS)
+	requireCode(t, codeWrongPassword, err)
+	require.Equal(t, "wrong password", toBindingError(err).Message)
+
+	// The envelope must be sealed for a pinned key
+	otherKey, err := plisskenserver.NewKeyring().Add("", nil)
+	require.NoError(t, err)
+	hexOtherPubS := hex.EncodeToString(otherKey.Pub[:])
+	_, err = login("hunter2", hexOtherPubS)
+	requireCode(t, codeUntrustedServerKey, err)
+	_, err = login("hunter2", hexOtherPubS+","+hexPubS)
+	require.NoError(t, err)
+
+	// So must the key the server asks to rotate to. The envelope is
+	// re-sealed for it by the same call.
+	oprfReqJSON, startJSON := startLogin("hunter2", otherKey.Pub[:])
+	_, err = finalize(oprfReqJSON, startJSON, hexPubS)
+	requireCode(t, codeUntrustedServerKey, err)
+	finalized, err = finalize(oprfReqJSON, startJSON, hexPubS+","+hexOtherPubS)
+	require.NoError(t, err)
+	require.Len(t, finalized.HexEncodedSessionToken, 2*plisskenserver.DefaultSessionTokenLength)
+	require.Len(t, finalized.HexEncodedEnvU, 2*plisskencommon.EnvUSize)
+	require.Len(t, finalized.HexEncodedEnvUNonce, 2*plisskencommon.EnvUNonceSize)
+}
+
+func TestBindingsRegistrationKey(t *testing.T) {
+	ctx := context.Background()
+	keyring := plisskenserver.NewKeyring()
+	oldKey, err := keyring.Add("old", nil)
+	require.NoError(t, err)
+	newKey, err := keyring.Add("new", nil)
+	require.NoError(t, err)
+	srv, err := plisskenserver.NewServerWithKeyring(
+		plisskenserver.NewMemoryStorage(), keyring)
+	require.NoError(t, err)
+	hexOldPubS := hex.EncodeToString(oldKey.Pub[:])
+	hexNewPubS := hex.EncodeToString(newKey.Pub[:])
+
+	oprfReqJSON, err := makeOprfRequest("app", "bob", "hunter2")
+	require.NoError(t, err)
+	oprfReq := &plisskencommon.OprfRequestResults{}
+	require.NoError(t, json.Unmarshal([]byte(oprfReqJSON), oprfReq))
+	eval, requestID, err := srv.HandleNewUserRequest(ctx, "app", "bob", oprfReq.EvalReq)
+	require.NoError(t, err)
+	evalJSON, err := json.Marshal(&plisskencommon.OprfServerEvaluation{
+		Eval: eval, PubS: srv.PubS[:], KeyID: srv.KeyID, RequestID: requestID})
+	require.NoError(t, err)
+
+	// The server registers users with a key that isn't pinned
+	_, err = finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, string(evalJSON), hexOldPubS)
+	requireCode(t, codeUntrustedServerKey, err)
+
+	// Sealed for the server's key, not the first pinned one
+	regJSON, err := finalizePasswordRegistration("app", "bob",
+		oprfReqJSON, string(evalJSON), hexOldPubS+","+hexNewPubS)
+	require.NoError(t, err)
+	reg := &plisskencommon.PasswordRegistrationData{}
+	require.NoError(t, json.Unmarshal([]byte(regJSON), reg))
+	require.Equal(t, newKey.Pub[:], reg.PubS)
+	require.NoError(t, srv.StoreUserData(ctx, "app", "bob", reg.RequestID,
+		reg.PubU, reg.EnvU, reg.EnvUNonce, reg.Salt, reg.PubS))
+	rotation, err := srv.PendingKeyRotation(ctx, "app", "bob")
+	require.NoError(t, err)
+	require.Nil(t, rotation)
+}
+
+func TestBindingsBadArguments(t *testing.T) {
+	_, err := makeOprfRequest("app", "bob", "")
+	requireCode(t, codeBadArgument, err)
+	require.Equal(t, "empty password", toBindingError(err).Message)
+	_, err = makeOprfRequest("", "", "hunter2")
+	requireCode(t, codeBadArgument, err)
+	require.Equal(t, "empty apptoken, username", toBindingError(err).Message)
+
+	_, err = decodePinnedServerPubKeys("zz")
+	requireCode(t, codeBadArgument, err)
+	_, err = decodePinnedServerPubKeys("")
+	requireCode(t, codeBadArgument, err)
+	key := strings.Repeat("09", 32)
+	keys, err := decodePinnedServerPubKeys(key + "," + key)
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	_, err = decodePinnedServerPubKeys(key + ",")
+	requireCode(t, codeBadArgument, err)
+
+	oprfReqJSON, err := makeOprfRequest("app", "bob", "hunter2")
+	require.NoError(t, err)
+	_, err = finalizePasswordAuthentication("bob", oprfReqJSON, `{"elements": []}`, key)
+	requireCode(t, codeBadArgument, err)
+
+	requireCode(t, codeProtocolError, errors.Wrap(errors.New("boom"), ""))
+	require.Equal(t, "boom", toBindingError(errors.Wrap(errors.New("boom"), "")).Message)
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"syscall/js"
+)
+
+// bindingsGlobal is where main puts the bindings for the JS SDK to find them
+const bindingsGlobal = "__plissken_bindings"
+
+func main() {
+	js.Global().Set(bindingsGlobal, js.ValueOf(map[string]interface{}{
+		"make_oprf_request": export(3, func(args []string) (string, error) {
+			return makeOprfRequest(args[0], args[1], args[2])
+		}),
+		"finalize_password_registration": export(5, func(args []string) (string, error) {
+			return finalizePasswordRegistration(args[0], args[1], args[2], args[3], args[4])
+		}),
+		"finalize_password_authentication": export(4, func(args []string) (string, error) {
+			return finalizePasswordAuthentication(args[0], args[1], args[2], args[3])
+		}),
+	}))
+	// The bindings are called after main returns: keep the program alive
+	select {}
+}
+
+// export makes 'fn' callable from JS with 'nargs' string arguments. It
+// returns {result: string} on success and {error: {code, message}} on
+// failure. A panic would stop the Go program for good, so it's returned as an
+// internal_error instead.
+func export(nargs int, fn func(args []string) (string, error)) js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) (ret interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				ret = jsError(&bindingError{
+					Code:    codeInternalError,
+					Message: fmt.Sprint(r),
+				})
+			}
+		}()
+		if len(args) != nargs {
+			return jsError(toBindingError(badArgument(
+				"expected %d arguments, got %d", nargs, len(args))))
+		}
+		strs := make([]string, nargs)
+		for i, arg := range args {
+			if arg.Type() != js.TypeString {
+				return jsError(toBindingError(badArgument(
+					"argument %d is a %s, not a string", i, arg.Type())))
+			}
+			strs[i] = arg.String()
+		}
+		result, err := fn(strs)
+		if err != nil {
+			return jsError(toBindingError(err))
+		}
+		return map[string]interface{}{"result": result}
+	})
+}
+
+func jsError(err *bindingError) map[string]interface{} {
+	return map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    err.Code,
+			"message": err.Message,
+		},
+	}
+}
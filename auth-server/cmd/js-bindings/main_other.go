@@ -0,0 +1,13 @@
+//go:build !js
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, "js-bindings only runs as WebAssembly: build it with 'just generate-js-bindings'")
+	os.Exit(1)
+}
@@ -8,14 +8,18 @@ import (
 	"io"
 	"os"
 
+	"github.com/afjoseph/plissken-auth-server/keyfile"
 	"github.com/cloudflare/circl/dh/x25519"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 var (
-	keyPathFlag = flag.String("key-path", "", "")
-	cmdFlag     = flag.String("cmd", "keygen", "operations are either 'keygen' to make a new key or 'print-pubkey' to print the hex-encoded public key of a private key")
+	keyPathFlag        = flag.String("key-path", "", "")
+	cmdFlag            = flag.String("cmd", "keygen", "operations are either 'keygen' to make a new key, 'print-pubkey' to print the hex-encoded public key of a private key or 'verify' to check a private key against a public key")
+	formatFlag         = flag.String("format", keyfile.FormatRaw, "format of the generated key: 'raw', 'pem' (PKCS#8) or 'jwk'")
+	encryptFlag        = flag.Bool("encrypt", false, "encrypt the generated key with the passphrase in $"+keyfile.PassphraseEnvVar)
+	expectedPubKeyFlag = flag.String("expected-pubkey", "", "hex-encoded public key that 'verify' checks the private key against")
 )
 
 func main() {
@@ -28,46 +32,85 @@ func mainErr() error {
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, `
 Commmands:
-* -cmd=keygen -key-path=blah
-  
-    Generate a new private key and store it in the file 'blah'
+* -cmd=keygen -key-path=blah [-format=raw|pem|jwk] [-encrypt]
+
+    Generate a new private key and store it in the file 'blah'.
+    With -encrypt, the file is encrypted with the passphrase in $%[1]s
 
 * -cmd=print-pubkey -key-path=blah
-  
+
     Print the hex-encoded public key of the private key stored in the file 'blah'
-`)
+
+* -cmd=verify -key-path=blah -expected-pubkey=hex
+
+    Check that the private key stored in the file 'blah' matches the
+    hex-encoded public key 'hex'
+
+Encrypted key files are decrypted with the passphrase in $%[1]s
+`, keyfile.PassphraseEnvVar)
 		flag.PrintDefaults()
 	}
 	flag.Parse()
 	if *keyPathFlag == "" {
 		return errors.New("key-path is empty")
 	}
+	passphrase := os.Getenv(keyfile.PassphraseEnvVar)
 	switch *cmdFlag {
 	case "keygen":
-		var privKey, pubKey x25519.Key
+		var privKey x25519.Key
 		_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
 		if err != nil {
 			return errors.Wrap(err, "")
 		}
-		x25519.KeyGen(&pubKey, &privKey)
-		err = os.WriteFile(*keyPathFlag, privKey[:], 0o600)
+		b, err := keyfile.Encode(privKey, *formatFlag)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		if *encryptFlag {
+			b, err = keyfile.Encrypt(b, passphrase)
+			if err != nil {
+				return errors.Wrap(err, "")
+			}
+		}
+		err = os.WriteFile(*keyPathFlag, b, 0o600)
 		if err != nil {
 			return errors.Wrap(err, "")
 		}
 		logrus.Infof("Private key written in %s", *keyPathFlag)
-		logrus.Infof("Hex-encoded public key is %s", hex.EncodeToString(pubKey[:]))
+		printPubKey(privKey)
 	case "print-pubkey":
-		b, err := os.ReadFile(*keyPathFlag)
+		privKey, err := keyfile.Load(*keyPathFlag, passphrase)
 		if err != nil {
 			return errors.Wrap(err, "")
 		}
-		var privKey, pubKey x25519.Key
-		copy(privKey[:], b)
-		x25519.KeyGen(&pubKey, &privKey)
-		logrus.Infof("Hex-encoded public key is %s", hex.EncodeToString(pubKey[:]))
+		printPubKey(privKey)
+	case "verify":
+		if *expectedPubKeyFlag == "" {
+			return errors.New("expected-pubkey is empty")
+		}
+		expectedPubKey, err := hex.DecodeString(*expectedPubKeyFlag)
+		if err != nil {
+			return errors.Wrap(err, "while decoding expected-pubkey")
+		}
+		privKey, err := keyfile.Load(*keyPathFlag, passphrase)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		err = keyfile.Verify(privKey, expectedPubKey)
+		if err != nil {
+			return errors.Wrapf(err, "key in %s does not match", *keyPathFlag)
+		}
+		logrus.Infof("Key in %s matches public key %s (fingerprint %s)",
+			*keyPathFlag, *expectedPubKeyFlag, keyfile.Fingerprint(privKey))
 	default:
 		return errors.New("Unknown cmd")
 	}
 
 	return nil
 }
+
+func printPubKey(privKey x25519.Key) {
+	pubKey := keyfile.PublicKey(privKey)
+	logrus.Infof("Hex-encoded public key is %s", hex.EncodeToString(pubKey[:]))
+	logrus.Infof("Key fingerprint is %s", keyfile.Fingerprint(privKey))
+}
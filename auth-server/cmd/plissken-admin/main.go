@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	cryptoRand "crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/afjoseph/plissken-auth-server/backup"
+	"github.com/afjoseph/plissken-auth-server/rediswrapper"
+	"github.com/afjoseph/plissken-auth-server/server"
+	"github.com/afjoseph/plissken-auth-server/sqlstore"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const usage = `Usage: plissken-admin <command> [flags]
+
+Commands:
+* gen-signing-key -out=blah
+
+    Generate an ed25519 key to sign backups with, store it hex-encoded in the
+    file 'blah' and print its hex-encoded public key
+
+* export -from=<storage url> -signing-key=blah [-out=backup.jsonl]
+
+    Dump all apps and users of the storage, signed with the key in the file
+    'blah'. Writes to stdout without -out
+
+* verify -in=backup.jsonl -verify-key=hex
+
+    Check that a dump is complete and signed by the hex-encoded public key
+
+* import -to=<storage url> -in=backup.jsonl -verify-key=hex [-overwrite]
+
+    Verify a dump, then store its users. Existing users are kept, unless
+    -overwrite is set. -insecure-skip-verify imports unsigned dumps
+
+* migrate -from=<storage url> -to=<storage url> [-overwrite]
+
+    Copy all users from a storage to another
+
+Storage urls are either:
+* redis://[[user]:password@]host:port[/db], or rediss:// for TLS. Add
+  ?hash-tags=true if the auth-server uses redis.hash-tags
+* sqlite://path or postgres://...
+
+App secrets aren't copied: the auth-server stores the ones of its config when
+it starts. Nor are session tokens: users have to login again.
+`
+
+func main() {
+	if err := mainErr(os.Args[1:]); err != nil {
+		logrus.Fatalf(err.Error())
+	}
+}
+
+func mainErr(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return errors.New("no command")
+	}
+	ctx := context.Background()
+	cmd, args := args[0], args[1:]
+	switch cmd {
+	case "gen-signing-key":
+		return genSigningKey(args)
+	case "export":
+		return export(ctx, args)
+	case "verify":
+		return verify(args)
+	case "import":
+		return importCmd(ctx, args)
+	case "migrate":
+		return migrate(ctx, args)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stderr, usage)
+		return nil
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		return errors.Errorf("unknown command %q", cmd)
+	}
+}
+
+func newFlagSet(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func genSigningKey(args []string) error {
+	fs := newFlagSet("gen-signing-key")
+	outFlag := fs.String("out", "", "file to write the private key to")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "")
+	}
+	if *outFlag == "" {
+		return errors.New("-out is empty")
+	}
+	pubKey, privKey, err := ed25519.GenerateKey(cryptoRand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	// O_EXCL: never overwrite a key
+	f, err := os.OpenFile(*outFlag, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, hex.EncodeToString(privKey.Seed()))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	fmt.Println(hex.EncodeToString(pubKey))
+	return errors.Wrap(f.Close(), "")
+}
+
+func export(ctx context.Context, args []string) error {
+	fs := newFlagSet("export")
+	fromFlag := fs.String("from", "", "storage url to dump")
+	signingKeyFlag := fs.String("signing-key", "", "file of the key made by gen-signing-key")
+	outFlag := fs.String("out", "", "file to write the dump to, instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "")
+	}
+	key, err := loadSigningKey(*signingKeyFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	store, closeStore, err := openStore(ctx, *fromFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer closeStore()
+
+	var w io.Writer = os.Stdout
+	var f *os.File
+	if *outFlag != "" {
+		// Envelopes hold the users' OPRF keys: keep dumps private
+		f, err = os.OpenFile(*outFlag, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		defer f.Close()
+		w = f
+	}
+	stats, err := backup.Export(ctx, store, w, key)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	logrus.Infof("Exported %d users of %d apps", stats.Users, stats.Apps)
+	return nil
+}
+
+func verify(args []string) error {
+	fs := newFlagSet("verify")
+	inFlag := fs.String("in", "", "dump to verify")
+	verifyKeyFlag := fs.String("verify-key", "", "hex-encoded public key printed by gen-signing-key")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "")
+	}
+	pubKey, err := parsePublicKey(*verifyKeyFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	f, err := os.Open(*inFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer f.Close()
+	err = backup.Verify(f, pubKey)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	logrus.Infof("%s is valid", *inFlag)
+	return nil
+}
+
+func importCmd(ctx context.Context, args []string) error {
+	fs := newFlagSet("import")
+	toFlag := fs.String("to", "", "storage url to import into")
+	inFlag := fs.String("in", "", "dump to import")
+	verifyKeyFlag := fs.String("verify-key", "", "hex-encoded public key printed by gen-signing-key")
+	skipVerifyFlag := fs.Bool("insecure-skip-verify", false, "import without checking the signature")
+	overwriteFlag := fs.Bool("overwrite", false, "replace existing users")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "")
+	}
+	var pubKey ed25519.PublicKey
+	if !*skipVerifyFlag {
+		var err error
+		pubKey, err = parsePublicKey(*verifyKeyFlag)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	f, err := os.Open(*inFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer f.Close()
+	store, closeStore, err := openStore(ctx, *toFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer closeStore()
+
+	stats, err := backup.Import(ctx, store, f, pubKey, *overwriteFlag)
+	if err != nil {
+		return errors.Wrapf(err, "imported %d users before failing", stats.Users)
+	}
+	logrus.Infof("Imported %d users of %d apps, skipped %d existing users",
+		stats.Users, stats.Apps, stats.Skipped)
+	return nil
+}
+
+func migrate(ctx context.Context, args []string) error {
+	fs := newFlagSet("migrate")
+	fromFlag := fs.String("from", "", "storage url to copy from")
+	toFlag := fs.String("to", "", "storage url to copy to")
+	overwriteFlag := fs.Bool("overwrite", false, "replace existing users")
+	if err := fs.Parse(args); err != nil {
+		return errors.Wrap(err, "")
+	}
+	from, closeFrom, err := openStore(ctx, *fromFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer closeFrom()
+	to, closeTo, err := openStore(ctx, *toFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	defer closeTo()
+
+	stats, err := backup.Copy(ctx, from, to, *overwriteFlag)
+	if err != nil {
+		return errors.Wrapf(err, "copied %d users before failing", stats.Users)
+	}
+	logrus.Infof("Copied %d users of %d apps, skipped %d existing users",
+		stats.Users, stats.Apps, stats.Skipped)
+	return nil
+}
+
+// openStore connects to the storage at 'storageUrl'
+func openStore(ctx context.Context, storageUrl string) (server.Store, func(), error) {
+	switch {
+	case storageUrl == "":
+		return nil, nil, errors.New("storage url is empty")
+	case strings.HasPrefix(storageUrl, "redis://"),
+		strings.HasPrefix(storageUrl, "rediss://"):
+		u, err := url.Parse(storageUrl)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		query := u.Query()
+		hashTags := query.Get("hash-tags") == "true"
+		query.Del("hash-tags")
+		u.RawQuery = query.Encode()
+		opts, err := redis.ParseURL(u.String())
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		rdw := rediswrapper.RedisWrapper{
+			UniversalClient: redis.NewClient(opts),
+			HashTags:        hashTags,
+		}
+		err = rdw.BuildIndexes(ctx)
+		if err != nil {
+			rdw.Close()
+			return nil, nil, errors.Wrap(err, "")
+		}
+		return rdw, func() { rdw.Close() }, nil
+	case strings.HasPrefix(storageUrl, "sqlite:"),
+		strings.HasPrefix(storageUrl, "postgres://"),
+		strings.HasPrefix(storageUrl, "postgresql://"):
+		store, err := sqlstore.Open(ctx, storageUrl)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		return store, func() { store.Close() }, nil
+	default:
+		return nil, nil, errors.Errorf("unsupported storage url %q", storageUrl)
+	}
+}
+
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	if path == "" {
+		return nil, errors.New("-signing-key is empty")
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "while decoding %s", path)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("%s: bad signing key length %d", path, len(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func parsePublicKey(str string) (ed25519.PublicKey, error) {
+	if str == "" {
+		return nil, errors.New("-verify-key is empty")
+	}
+	b, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding -verify-key")
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("bad -verify-key length %d", len(b))
+	}
+	return ed25519.PublicKey(b), nil
+}
@@ -0,0 +1,431 @@
+// Package config loads and validates the auth-server's configuration.
+//
+// Configuration is read from a YAML file, then every field can be overridden
+// with a PLISSKEN_<FIELD> environment variable, where <FIELD> is the field's
+// YAML key upper-cased with dashes replaced by underscores (e.g.,
+// PLISSKEN_REDIS_URL for 'redis-url'). Non-string fields are parsed as YAML,
+// so PLISSKEN_VERBOSE=true and PLISSKEN_APP_SECRETS='{my-app: my-secret-name}'
+// both work.
+package config
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/logging"
+	"github.com/afjoseph/plissken-auth-server/secrets"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	StorageMemory = "memory"
+	StorageRedis  = "redis"
+	StorageSQL    = "sql"
+
+	ModeDevelopment = "development"
+	ModeProduction  = "production"
+)
+
+// EnvPrefix prefixes the environment variables that override config fields
+const EnvPrefix = "PLISSKEN_"
+
+type Config struct {
+	// REQUIRED: Address to listen on
+	Addr string `yaml:"addr"`
+
+	// OPTIONAL: Either 'development' (the default) or 'production'.
+	// Production refuses to start with in-memory storage.
+	Mode string `yaml:"mode"`
+
+	// REQUIRED: Where users, sessions and app secrets are stored: 'memory'
+	// (lost on restart, only for development), 'redis' or 'sql'
+	Storage string `yaml:"storage"`
+
+	// REQUIRED if storage is 'redis'.
+	// The password is set via REDIS_PASSWORD env var, or read from the
+	// 'redis-password-secret' secret.
+	RedisUrl            string `yaml:"redis-url"`
+	RedisPasswordSecret string `yaml:"redis-password-secret"`
+	RedisPassword       string `yaml:"-"`
+
+	// OPTIONAL: Sentinel, cluster, TLS, ACL, database and pool settings. See
+	// RedisConfig.
+	Redis *RedisConfig `yaml:"redis"`
+
+	// OPTIONAL: Caches app secrets and user envelopes in memory. With redis
+	// storage, replicas tell each other what to drop from their caches.
+	Cache *CacheConfig `yaml:"cache"`
+
+	// REQUIRED if storage is 'sql'. Either postgres://... or sqlite://<path>.
+	// Relative SQLite paths are relative to the config file.
+	SqlUrl string `yaml:"sql-url"`
+
+	// OPTIONAL: Where secrets referenced by the '*-secret' fields are read
+	// from. REQUIRED if any of those fields are set.
+	Secrets *secrets.Config `yaml:"secrets"`
+
+	// REQUIRED: Either a path to the private key, or the name of the secret
+	// holding it. The key can be in any format 'cmd/keygen' can write (or
+	// hex-encoded). This is the current key: new registrations are bound to
+	// it.
+	//
+	// Relative paths are relative to the config file.
+	KeyPath   string `yaml:"key-path"`
+	KeySecret string `yaml:"key-secret"`
+
+	// OPTIONAL: ID of the current key. Defaults to its fingerprint
+	KeyID string `yaml:"key-id"`
+
+	// OPTIONAL: Previous private keys, oldest first. Users bound to them can
+	// still login, and are migrated to the current key when they do.
+	RetiredKeys []RetiredKey `yaml:"retired-keys"`
+
+	// REQUIRED: Map of app tokens to either their app secrets
+	// (app-tokens-and-secrets), or the names of the secrets holding them
+	// (app-secrets). Prefer the latter in production.
+	AppTokensAndSecrets map[string]string `yaml:"app-tokens-and-secrets"`
+	AppSecretNames      map[string]string `yaml:"app-secrets"`
+
+	// OPTIONAL: Signs an access token on every login, that resource servers
+	// can check without calling the auth-server. See AccessTokenConfig.
+	AccessTokens *AccessTokenConfig `yaml:"access-tokens"`
+
+	// OPTIONAL: Origins browsers may call the auth-server from, e.g.
+	// 'https://app.example.com'. Defaults to all origins. REQUIRED with
+	// session-cookie: browsers only send cookies to listed origins.
+	CORSOrigins []string `yaml:"cors-origins"`
+
+	// OPTIONAL: Lets browser clients keep their session in an HttpOnly cookie
+	// instead of handling the session token. See SessionCookieConfig.
+	SessionCookie *SessionCookieConfig `yaml:"session-cookie"`
+
+	// OPTIONAL: Whether to log more information
+	Verbose bool `yaml:"verbose"`
+
+	// OPTIONAL: Either 'text' (the default) or 'json'
+	LogFormat string `yaml:"log-format"`
+
+	// OPTIONAL: Logged in the "version" field of the any endpoint
+	SdkVersion string `yaml:"sdk-version"`
+
+	// Set by Load if 'Secrets' is set
+	SecretProvider secrets.Provider `yaml:"-"`
+}
+
+type CacheConfig struct {
+	// REQUIRED: Maximum number of cached entries
+	Size int `yaml:"size"`
+	// REQUIRED: How long entries are cached, e.g. '30s'. This is also how
+	// long other replicas' writes can go unnoticed without redis.
+	TTL time.Duration `yaml:"ttl"`
+}
+
+type AccessTokenConfig struct {
+	// REQUIRED: Either a path to the signing key, or the name of the secret
+	// holding it. It's a hex-encoded ed25519 seed, as written by
+	// 'plissken-admin gen-signing-key'.
+	//
+	// Relative paths are relative to the config file.
+	KeyPath   string `yaml:"key-path"`
+	KeySecret string `yaml:"key-secret"`
+	// OPTIONAL: How long access tokens are valid. Defaults to 5m. They can't
+	// be revoked: keep it short.
+	TTL time.Duration `yaml:"ttl"`
+	// OPTIONAL: The tokens' "iss" claim
+	Issuer string `yaml:"issuer"`
+}
+
+type SessionCookieConfig struct {
+	// OPTIONAL: The cookies' Domain attribute. Set it to a domain shared with
+	// the resource servers (e.g. 'example.com'), else they won't get the
+	// cookie.
+	Domain string `yaml:"domain"`
+	// OPTIONAL: The cookies' Path attribute. Defaults to '/'
+	Path string `yaml:"path"`
+	// OPTIONAL: Either 'strict', 'lax' (the default) or 'none'
+	SameSite string `yaml:"same-site"`
+	// OPTIONAL: Drops the Secure attribute so that cookies work over plain
+	// HTTP. Only for local development.
+	Insecure bool `yaml:"insecure"`
+}
+
+const (
+	SameSiteStrict = "strict"
+	SameSiteLax    = "lax"
+	SameSiteNone   = "none"
+)
+
+// DefaultAccessTokenTTL is the TTL of access tokens if none is configured
+const DefaultAccessTokenTTL = 5 * time.Minute
+
+type RetiredKey struct {
+	// OPTIONAL: Defaults to the key's fingerprint
+	ID string `yaml:"id"`
+	// REQUIRED: Either one of them, like Config.KeyPath and Config.KeySecret
+	Path   string `yaml:"path"`
+	Secret string `yaml:"secret"`
+}
+
+// Load reads the config file at 'path', applies environment overrides and
+// validates the result. Unknown fields in the file are an error.
+func Load(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	config := &Config{}
+	err = yaml.UnmarshalStrict(b, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "while parsing %s", path)
+	}
+	err = applyEnvOverrides(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if config.Mode == "" {
+		config.Mode = ModeDevelopment
+	}
+	config.RedisPassword = os.Getenv("REDIS_PASSWORD")
+	if config.Redis != nil {
+		config.Redis.SentinelPassword = os.Getenv("REDIS_SENTINEL_PASSWORD")
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid config %s", path)
+	}
+
+	// Resolve relative paths
+	configDir := filepath.Dir(path)
+	config.KeyPath = resolvePath(configDir, config.KeyPath)
+	for i := range config.RetiredKeys {
+		config.RetiredKeys[i].Path = resolvePath(configDir, config.RetiredKeys[i].Path)
+	}
+	if config.AccessTokens != nil {
+		config.AccessTokens.KeyPath = resolvePath(configDir, config.AccessTokens.KeyPath)
+		if config.AccessTokens.TTL == 0 {
+			config.AccessTokens.TTL = DefaultAccessTokenTTL
+		}
+	}
+	if config.SessionCookie != nil {
+		if config.SessionCookie.Path == "" {
+			config.SessionCookie.Path = "/"
+		}
+		if config.SessionCookie.SameSite == "" {
+			config.SessionCookie.SameSite = SameSiteLax
+		}
+	}
+	if config.Redis != nil && config.Redis.TLS != nil {
+		tlsConfig := config.Redis.TLS
+		tlsConfig.CAPath = resolvePath(configDir, tlsConfig.CAPath)
+		tlsConfig.CertPath = resolvePath(configDir, tlsConfig.CertPath)
+		tlsConfig.KeyPath = resolvePath(configDir, tlsConfig.KeyPath)
+	}
+	if config.Secrets != nil {
+		config.Secrets.Dir = resolvePath(configDir, config.Secrets.Dir)
+	}
+	if strings.HasPrefix(config.SqlUrl, "sqlite://") {
+		config.SqlUrl = "sqlite://" +
+			resolvePath(configDir, strings.TrimPrefix(config.SqlUrl, "sqlite://"))
+	}
+
+	// Resolve secrets
+	if config.Secrets != nil {
+		config.SecretProvider, err = secrets.New(*config.Secrets)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	}
+	if config.RedisPasswordSecret != "" {
+		b, err := config.SecretProvider.GetSecret(
+			context.Background(), config.RedisPasswordSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading redis password")
+		}
+		config.RedisPassword = strings.TrimSpace(string(b))
+	}
+	if config.Redis != nil && config.Redis.SentinelPasswordSecret != "" {
+		b, err := config.SecretProvider.GetSecret(
+			context.Background(), config.Redis.SentinelPasswordSecret)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading redis sentinel password")
+		}
+		config.Redis.SentinelPassword = strings.TrimSpace(string(b))
+	}
+	return config, nil
+}
+
+// Validate checks that required fields are set and that fields agree with
+// each other. All problems are reported at once.
+func (c *Config) Validate() error {
+	var problems []string
+	addProblem := func(format string, args ...interface{}) {
+		problems = append(problems, errors.Errorf(format, args...).Error())
+	}
+
+	if c.Addr == "" {
+		addProblem("addr is required")
+	}
+
+	switch c.Mode {
+	case "", ModeDevelopment, ModeProduction:
+	default:
+		addProblem("mode must be '%s' or '%s', not '%s'",
+			ModeDevelopment, ModeProduction, c.Mode)
+	}
+
+	switch c.LogFormat {
+	case "", logging.FormatText, logging.FormatJSON:
+	default:
+		addProblem("log-format must be '%s' or '%s', not '%s'",
+			logging.FormatText, logging.FormatJSON, c.LogFormat)
+	}
+
+	switch c.Storage {
+	case "":
+		addProblem("storage is required: one of '%s', '%s' or '%s'",
+			StorageMemory, StorageRedis, StorageSQL)
+	case StorageMemory:
+		if c.Mode == ModeProduction {
+			addProblem("storage '%s' is not allowed in '%s' mode",
+				StorageMemory, ModeProduction)
+		}
+	case StorageRedis:
+		if c.RedisUrl == "" && (c.Redis == nil || len(c.Redis.Addrs) == 0) {
+			addProblem("redis-url is required with storage '%s'", StorageRedis)
+		}
+		if c.Redis != nil {
+			c.Redis.validate(addProblem)
+		}
+	case StorageSQL:
+		if c.SqlUrl == "" {
+			addProblem("sql-url is required with storage '%s'", StorageSQL)
+		} else if !strings.HasPrefix(c.SqlUrl, "postgres://") &&
+			!strings.HasPrefix(c.SqlUrl, "postgresql://") &&
+			!strings.HasPrefix(c.SqlUrl, "sqlite:") {
+			addProblem("sql-url must start with postgres:// or sqlite://")
+		}
+	default:
+		addProblem("unknown storage '%s'", c.Storage)
+	}
+
+	if c.Cache != nil && (c.Cache.Size <= 0 || c.Cache.TTL <= 0) {
+		addProblem("cache.size and cache.ttl must be positive")
+	}
+
+	if (c.KeyPath == "") == (c.KeySecret == "") {
+		addProblem("exactly one of key-path or key-secret must be set")
+	}
+	for i, rk := range c.RetiredKeys {
+		if (rk.Path == "") == (rk.Secret == "") {
+			addProblem("retired-keys[%d]: exactly one of path or secret must be set", i)
+		}
+	}
+
+	if c.AccessTokens != nil {
+		if (c.AccessTokens.KeyPath == "") == (c.AccessTokens.KeySecret == "") {
+			addProblem("exactly one of access-tokens.key-path or access-tokens.key-secret must be set")
+		}
+		if c.AccessTokens.TTL < 0 {
+			addProblem("access-tokens.ttl must be positive")
+		}
+	}
+
+	if sc := c.SessionCookie; sc != nil {
+		switch sc.SameSite {
+		case "", SameSiteStrict, SameSiteLax:
+		case SameSiteNone:
+			// Browsers drop SameSite=None cookies that aren't Secure
+			if sc.Insecure {
+				addProblem("session-cookie.same-site '%s' can't be insecure", SameSiteNone)
+			}
+		default:
+			addProblem("session-cookie.same-site must be '%s', '%s' or '%s', not '%s'",
+				SameSiteStrict, SameSiteLax, SameSiteNone, sc.SameSite)
+		}
+		if sc.Insecure && c.Mode == ModeProduction {
+			addProblem("session-cookie.insecure is not allowed in '%s' mode", ModeProduction)
+		}
+		if len(c.CORSOrigins) == 0 {
+			addProblem("cors-origins is required with session-cookie")
+		}
+	}
+	for _, origin := range c.CORSOrigins {
+		if origin == "*" {
+			addProblem("cors-origins: leave it empty to allow all origins")
+		}
+	}
+
+	if len(c.AppTokensAndSecrets) == 0 && len(c.AppSecretNames) == 0 {
+		addProblem("one of app-tokens-and-secrets or app-secrets is required")
+	}
+	for appToken, appSecret := range c.AppTokensAndSecrets {
+		if appToken == "" || appSecret == "" {
+			addProblem("app-tokens-and-secrets: empty app token or secret")
+		}
+	}
+
+	usesSecrets := c.KeySecret != "" ||
+		c.RedisPasswordSecret != "" ||
+		(c.Redis != nil && c.Redis.SentinelPasswordSecret != "") ||
+		(c.AccessTokens != nil && c.AccessTokens.KeySecret != "") ||
+		len(c.AppSecretNames) != 0
+	for _, rk := range c.RetiredKeys {
+		usesSecrets = usesSecrets || rk.Secret != ""
+	}
+	if usesSecrets && c.Secrets == nil {
+		addProblem("secrets are referenced but 'secrets' is not configured")
+	}
+
+	if len(problems) != 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// applyEnvOverrides sets every field that has a matching PLISSKEN_* env var
+func applyEnvOverrides(config *Config) error {
+	v := reflect.ValueOf(config).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+		key := EnvVarName(tag)
+		val, ok := os.LookupEnv(key)
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.Kind() == reflect.String {
+			field.SetString(val)
+			continue
+		}
+		ptr := reflect.New(field.Type())
+		err := yaml.UnmarshalStrict([]byte(val), ptr.Interface())
+		if err != nil {
+			return errors.Wrapf(err, "while parsing %s", key)
+		}
+		field.Set(ptr.Elem())
+	}
+	return nil
+}
+
+// EnvVarName returns the env var overriding the field with YAML key 'key'
+func EnvVarName(key string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+}
+
+// resolvePath makes relative paths relative to the config file's directory
+func resolvePath(configDir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(configDir, path)
+}
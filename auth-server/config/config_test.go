@@ -0,0 +1,140 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const validConfig = `
+addr: localhost:3223
+storage: memory
+key-path: ../testdata/test-privkey
+app-tokens-and-secrets:
+  my-app-token: aaaa
+`
+
+func writeConfig(t *testing.T, content string) string {
+	p := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(p, []byte(content), 0o600))
+	return p
+}
+
+func TestLoad(t *testing.T) {
+	t.Run("valid config with defaults", func(t *testing.T) {
+		p := writeConfig(t, validConfig)
+		cfg, err := Load(p)
+		require.NoError(t, err)
+		require.Equal(t, ModeDevelopment, cfg.Mode)
+		require.Equal(t, filepath.Join(filepath.Dir(p), "../testdata/test-privkey"), cfg.KeyPath)
+	})
+
+	t.Run("unknown fields are rejected", func(t *testing.T) {
+		_, err := Load(writeConfig(t, validConfig+"redis-ulr: localhost\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("missing fields are all reported", func(t *testing.T) {
+		_, err := Load(writeConfig(t, "verbose: true\n"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "addr is required")
+		require.Contains(t, err.Error(), "storage is required")
+		require.Contains(t, err.Error(), "key-path or key-secret")
+		require.Contains(t, err.Error(), "app-tokens-and-secrets or app-secrets")
+	})
+
+	t.Run("production refuses in-memory storage", func(t *testing.T) {
+		_, err := Load(writeConfig(t, validConfig+"mode: production\n"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "not allowed in 'production' mode")
+	})
+
+	t.Run("redis storage requires redis-url", func(t *testing.T) {
+		t.Setenv("PLISSKEN_STORAGE", StorageRedis)
+		_, err := Load(writeConfig(t, validConfig))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "redis-url is required")
+	})
+
+	t.Run("sqlite paths are relative to the config file", func(t *testing.T) {
+		t.Setenv("PLISSKEN_STORAGE", StorageSQL)
+		t.Setenv("PLISSKEN_SQL_URL", "sqlite://plissken.db")
+		p := writeConfig(t, validConfig)
+		cfg, err := Load(p)
+		require.NoError(t, err)
+		require.Equal(t, "sqlite://"+filepath.Join(filepath.Dir(p), "plissken.db"), cfg.SqlUrl)
+	})
+
+	t.Run("secrets dirs are relative to the config file", func(t *testing.T) {
+		p := writeConfig(t, validConfig+
+			"secrets: {provider: file, dir: secrets}\nredis-password-secret: redis-password\n")
+		dir := filepath.Join(filepath.Dir(p), "secrets")
+		require.NoError(t, os.Mkdir(dir, 0o700))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "redis-password"), []byte("hunter2\n"), 0o600))
+		cfg, err := Load(p)
+		require.NoError(t, err)
+		require.Equal(t, dir, cfg.Secrets.Dir)
+		require.Equal(t, "hunter2", cfg.RedisPassword)
+	})
+
+	t.Run("env vars override fields", func(t *testing.T) {
+		t.Setenv("PLISSKEN_ADDR", "0.0.0.0:1234")
+		t.Setenv("PLISSKEN_VERBOSE", "true")
+		t.Setenv("PLISSKEN_APP_TOKENS_AND_SECRETS", "{other-app-token: bbbb}")
+		cfg, err := Load(writeConfig(t, validConfig))
+		require.NoError(t, err)
+		require.Equal(t, "0.0.0.0:1234", cfg.Addr)
+		require.True(t, cfg.Verbose)
+		require.Equal(t, map[string]string{"other-app-token": "bbbb"}, cfg.AppTokensAndSecrets)
+	})
+
+	t.Run("cache", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, validConfig+"cache: {size: 1000, ttl: 30s}\n"))
+		require.NoError(t, err)
+		require.Equal(t, &CacheConfig{Size: 1000, TTL: 30 * time.Second}, cfg.Cache)
+
+		_, err = Load(writeConfig(t, validConfig+"cache: {size: 1000}\n"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "cache.size and cache.ttl must be positive")
+	})
+
+	t.Run("access tokens", func(t *testing.T) {
+		p := writeConfig(t, validConfig+"access-tokens: {key-path: signing-key}\n")
+		cfg, err := Load(p)
+		require.NoError(t, err)
+		require.Equal(t, &AccessTokenConfig{
+			KeyPath: filepath.Join(filepath.Dir(p), "signing-key"),
+			TTL:     DefaultAccessTokenTTL,
+		}, cfg.AccessTokens)
+
+		_, err = Load(writeConfig(t, validConfig+"access-tokens: {ttl: 1m}\n"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "access-tokens.key-path or access-tokens.key-secret")
+	})
+
+	t.Run("session cookie", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, validConfig+
+			"cors-origins: [https://app.example.com]\nsession-cookie: {domain: example.com}\n"))
+		require.NoError(t, err)
+		require.Equal(t, &SessionCookieConfig{
+			Domain:   "example.com",
+			Path:     "/",
+			SameSite: SameSiteLax,
+		}, cfg.SessionCookie)
+
+		_, err = Load(writeConfig(t, validConfig+"session-cookie: {same-site: none, insecure: true}\n"))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "can't be insecure")
+		require.Contains(t, err.Error(), "cors-origins is required")
+	})
+
+	t.Run("malformed env overrides are an error", func(t *testing.T) {
+		t.Setenv("PLISSKEN_VERBOSE", "very")
+		_, err := Load(writeConfig(t, validConfig))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "PLISSKEN_VERBOSE")
+	})
+}
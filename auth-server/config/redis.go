@@ -0,0 +1,193 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+)
+
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+)
+
+// RedisConfig holds the optional 'redis' section. Without it, the auth-server
+// connects to the single server at 'redis-url'.
+type RedisConfig struct {
+	// OPTIONAL: Either 'standalone' (the default), 'sentinel' or 'cluster'
+	Mode string `yaml:"mode"`
+
+	// OPTIONAL: The server's address if standalone, the sentinels' if
+	// sentinel, or some of the nodes' if cluster. Defaults to 'redis-url'.
+	Addrs []string `yaml:"addrs"`
+
+	// REQUIRED if mode is 'sentinel': Name of the master to failover
+	MasterName string `yaml:"master-name"`
+
+	// OPTIONAL: Password of the sentinels, if they have one. It's set via the
+	// REDIS_SENTINEL_PASSWORD env var, or read from this secret.
+	SentinelPasswordSecret string `yaml:"sentinel-password-secret"`
+	SentinelPassword       string `yaml:"-"`
+
+	// OPTIONAL: ACL username. The password is the top-level one.
+	Username string `yaml:"username"`
+
+	// OPTIONAL: Database to select. Not supported in 'cluster' mode.
+	DB int `yaml:"db"`
+
+	// OPTIONAL: Connects over TLS if set, even if empty
+	TLS *RedisTLSConfig `yaml:"tls"`
+
+	// OPTIONAL: Connection pool tuning. Zero values use go-redis' defaults.
+	PoolSize     int           `yaml:"pool-size"`
+	MinIdleConns int           `yaml:"min-idle-conns"`
+	MaxRetries   int           `yaml:"max-retries"`
+	DialTimeout  time.Duration `yaml:"dial-timeout"`
+	ReadTimeout  time.Duration `yaml:"read-timeout"`
+	WriteTimeout time.Duration `yaml:"write-timeout"`
+	PoolTimeout  time.Duration `yaml:"pool-timeout"`
+	IdleTimeout  time.Duration `yaml:"idle-timeout"`
+
+	// OPTIONAL: Wraps the app token and username of keys in a hash tag, so
+	// that all keys of a user are in the same cluster slot. REQUIRED in
+	// 'cluster' mode. Changing it on an existing database hides its data:
+	// keys are named differently.
+	HashTags bool `yaml:"hash-tags"`
+}
+
+type RedisTLSConfig struct {
+	// OPTIONAL: PEM file of the CAs to trust instead of the system's
+	CAPath string `yaml:"ca-path"`
+	// OPTIONAL: PEM files of the client certificate and its key, for mutual
+	// TLS
+	CertPath string `yaml:"cert-path"`
+	KeyPath  string `yaml:"key-path"`
+	// OPTIONAL: Defaults to the host of the address
+	ServerName string `yaml:"server-name"`
+	// OPTIONAL: Don't check the server's certificate. Only for development.
+	InsecureSkipVerify bool `yaml:"insecure-skip-verify"`
+}
+
+func (c *RedisConfig) validate(addProblem func(format string, args ...interface{})) {
+	switch c.Mode {
+	case "", RedisModeStandalone:
+		if len(c.Addrs) > 1 {
+			addProblem("redis.addrs must have a single address in '%s' mode",
+				RedisModeStandalone)
+		}
+	case RedisModeSentinel:
+		if c.MasterName == "" {
+			addProblem("redis.master-name is required in '%s' mode", RedisModeSentinel)
+		}
+	case RedisModeCluster:
+		if c.DB != 0 {
+			addProblem("redis.db is not supported in '%s' mode", RedisModeCluster)
+		}
+		if !c.HashTags {
+			addProblem("redis.hash-tags must be true in '%s' mode", RedisModeCluster)
+		}
+	default:
+		addProblem("redis.mode must be '%s', '%s' or '%s', not '%s'",
+			RedisModeStandalone, RedisModeSentinel, RedisModeCluster, c.Mode)
+	}
+	if c.DB < 0 {
+		addProblem("redis.db must be positive")
+	}
+	if c.TLS != nil && (c.TLS.CertPath == "") != (c.TLS.KeyPath == "") {
+		addProblem("redis.tls.cert-path and redis.tls.key-path must be set together")
+	}
+}
+
+// RedisOptions returns the options of the redis client described by the
+// config. TLS files are read now.
+func (c *Config) RedisOptions() (*redis.UniversalOptions, error) {
+	rc := c.Redis
+	if rc == nil {
+		rc = &RedisConfig{}
+	}
+	opts := &redis.UniversalOptions{
+		Addrs:            rc.Addrs,
+		MasterName:       rc.MasterName,
+		Username:         rc.Username,
+		Password:         c.RedisPassword,
+		SentinelPassword: rc.SentinelPassword,
+		DB:               rc.DB,
+		PoolSize:         rc.PoolSize,
+		MinIdleConns:     rc.MinIdleConns,
+		MaxRetries:       rc.MaxRetries,
+		DialTimeout:      rc.DialTimeout,
+		ReadTimeout:      rc.ReadTimeout,
+		WriteTimeout:     rc.WriteTimeout,
+		PoolTimeout:      rc.PoolTimeout,
+		IdleTimeout:      rc.IdleTimeout,
+	}
+	if len(opts.Addrs) == 0 {
+		opts.Addrs = []string{c.RedisUrl}
+	}
+	if rc.TLS != nil {
+		tlsConfig, err := rc.TLS.load()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		opts.TLSConfig = tlsConfig
+	}
+	return opts, nil
+}
+
+// NewRedisClient connects to the redis server, sentinels or cluster described
+// by the config
+func (c *Config) NewRedisClient() (redis.UniversalClient, error) {
+	opts, err := c.RedisOptions()
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	// Unlike redis.NewUniversalClient(), don't guess the mode from the
+	// number of addresses: a cluster can be reached through a single node
+	switch c.RedisMode() {
+	case RedisModeSentinel:
+		return redis.NewFailoverClient(opts.Failover()), nil
+	case RedisModeCluster:
+		return redis.NewClusterClient(opts.Cluster()), nil
+	default:
+		return redis.NewClient(opts.Simple()), nil
+	}
+}
+
+// RedisMode returns the mode of the 'redis' section, or 'standalone'
+func (c *Config) RedisMode() string {
+	if c.Redis == nil || c.Redis.Mode == "" {
+		return RedisModeStandalone
+	}
+	return c.Redis.Mode
+}
+
+func (c *RedisTLSConfig) load() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+	if c.CAPath != "" {
+		b, err := os.ReadFile(c.CAPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading redis CAs")
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(b) {
+			return nil, errors.Errorf("no PEM certificate in %s", c.CAPath)
+		}
+	}
+	if c.CertPath != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertPath, c.KeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "while reading redis client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
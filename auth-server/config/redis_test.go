@@ -0,0 +1,130 @@
+package config
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+const validRedisConfig = `
+addr: localhost:3223
+storage: redis
+redis-url: localhost:6379
+key-path: ../testdata/test-privkey
+app-tokens-and-secrets:
+  my-app-token: aaaa
+`
+
+func TestRedisConfig(t *testing.T) {
+	t.Run("redis-url alone is a standalone server", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, validRedisConfig))
+		require.NoError(t, err)
+		require.Equal(t, RedisModeStandalone, cfg.RedisMode())
+		opts, err := cfg.RedisOptions()
+		require.NoError(t, err)
+		require.Equal(t, []string{"localhost:6379"}, opts.Addrs)
+		client, err := cfg.NewRedisClient()
+		require.NoError(t, err)
+		defer client.Close()
+		require.IsType(t, &redis.Client{}, client)
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		t.Setenv("REDIS_PASSWORD", "password")
+		t.Setenv("REDIS_SENTINEL_PASSWORD", "sentinel-password")
+		cfg, err := Load(writeConfig(t, validRedisConfig+`
+redis:
+  mode: sentinel
+  addrs: [sentinel-1:26379, sentinel-2:26379]
+  master-name: mymaster
+  username: plissken
+  db: 3
+  pool-size: 20
+  read-timeout: 2s
+`))
+		require.NoError(t, err)
+		opts, err := cfg.RedisOptions()
+		require.NoError(t, err)
+		require.Equal(t, []string{"sentinel-1:26379", "sentinel-2:26379"}, opts.Addrs)
+		require.Equal(t, "mymaster", opts.MasterName)
+		require.Equal(t, "plissken", opts.Username)
+		require.Equal(t, "password", opts.Password)
+		require.Equal(t, "sentinel-password", opts.SentinelPassword)
+		require.Equal(t, 3, opts.DB)
+		require.Equal(t, 20, opts.PoolSize)
+		require.Equal(t, 2*time.Second, opts.ReadTimeout)
+		client, err := cfg.NewRedisClient()
+		require.NoError(t, err)
+		defer client.Close()
+		require.IsType(t, &redis.Client{}, client)
+	})
+
+	t.Run("a cluster can have a single seed node", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, validRedisConfig+`
+redis:
+  mode: cluster
+  hash-tags: true
+`))
+		require.NoError(t, err)
+		client, err := cfg.NewRedisClient()
+		require.NoError(t, err)
+		defer client.Close()
+		require.IsType(t, &redis.ClusterClient{}, client)
+	})
+
+	t.Run("invalid sections are reported", func(t *testing.T) {
+		_, err := Load(writeConfig(t, validRedisConfig+`
+redis:
+  mode: sentinel
+  tls:
+    cert-path: cert.pem
+`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "redis.master-name is required")
+		require.Contains(t, err.Error(), "must be set together")
+
+		_, err = Load(writeConfig(t, validRedisConfig+`
+redis:
+  mode: cluster
+  db: 1
+`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "redis.db is not supported")
+		require.Contains(t, err.Error(), "redis.hash-tags must be true")
+
+		_, err = Load(writeConfig(t, validRedisConfig+`
+redis:
+  mode: replicated
+`))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "redis.mode must be")
+	})
+
+	t.Run("tls paths are relative to the config file", func(t *testing.T) {
+		p := writeConfig(t, validRedisConfig+`
+redis:
+  tls:
+    ca-path: ca.pem
+`)
+		cfg, err := Load(p)
+		require.NoError(t, err)
+		require.Equal(t, filepath.Join(filepath.Dir(p), "ca.pem"), cfg.Redis.TLS.CAPath)
+		_, err = cfg.RedisOptions()
+		require.Error(t, err, "the CA file doesn't exist")
+	})
+
+	t.Run("empty tls section uses the system CAs", func(t *testing.T) {
+		cfg, err := Load(writeConfig(t, validRedisConfig+`
+redis:
+  tls: {}
+`))
+		require.NoError(t, err)
+		opts, err := cfg.RedisOptions()
+		require.NoError(t, err)
+		require.NotNil(t, opts.TLSConfig)
+		require.Nil(t, opts.TLSConfig.RootCAs)
+	})
+}
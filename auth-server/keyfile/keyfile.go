@@ -0,0 +1,322 @@
+// Package keyfile reads and writes the auth-server's x25519 private key files.
+//
+// Supported formats are:
+//   - raw: the 32 bytes of the private key, as written by older versions of
+//     'keygen'. Decode also accepts them hex-encoded.
+//   - pem: a PKCS#8 "PRIVATE KEY" PEM block
+//   - jwk: a JSON Web Key ({"kty": "OKP", "crv": "X25519", ...})
+//
+// Any of those can be encrypted with a passphrase, in which case the file is a
+// single "PLISSKEN ENCRYPTED KEY" PEM block wrapping the original file.
+package keyfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	cryptoRand "crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"os"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	FormatRaw = "raw"
+	FormatPEM = "pem"
+	FormatJWK = "jwk"
+)
+
+// PassphraseEnvVar is the environment variable holding the passphrase of
+// encrypted key files
+const PassphraseEnvVar = "PLISSKEN_KEY_PASSPHRASE"
+
+const (
+	pemTypePrivateKey   = "PRIVATE KEY"
+	pemTypeEncryptedKey = "PLISSKEN ENCRYPTED KEY"
+
+	// Argon2id parameters for deriving the encryption key from a passphrase
+	kdfTime    = 3
+	kdfMemory  = 64 * 1024
+	kdfThreads = 4
+	kdfSaltLen = 16
+
+	// Bounds on the Argon2id parameters of encrypted key files. They're read
+	// from unauthenticated headers: without bounds, a crafted file could make
+	// the server allocate any amount of memory before the passphrase is
+	// checked.
+	kdfMaxTime    = 16
+	kdfMaxMemory  = 1024 * 1024 // KiB
+	kdfMaxThreads = 16
+	kdfMinSaltLen = 8
+)
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Crv string `json:"crv"`
+	Kid string `json:"kid,omitempty"`
+	X   string `json:"x"`
+	D   string `json:"d,omitempty"`
+}
+
+// Fingerprint returns the short fingerprint of a private key's public key.
+// It's the same value the auth-server uses as the default key ID.
+func Fingerprint(privKey x25519.Key) string {
+	return plisskenserver.KeyFingerprint(PublicKey(privKey))
+}
+
+func PublicKey(privKey x25519.Key) x25519.Key {
+	var pubKey x25519.Key
+	x25519.KeyGen(&pubKey, &privKey)
+	return pubKey
+}
+
+// Encode serializes a private key in 'format'
+func Encode(privKey x25519.Key, format string) ([]byte, error) {
+	switch format {
+	case FormatRaw:
+		b := make([]byte, x25519.Size)
+		copy(b, privKey[:])
+		return b, nil
+	case FormatPEM:
+		k, err := ecdh.X25519().NewPrivateKey(privKey[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		return pem.EncodeToMemory(&pem.Block{Type: pemTypePrivateKey, Bytes: der}), nil
+	case FormatJWK:
+		pubKey := PublicKey(privKey)
+		b, err := json.MarshalIndent(&jwk{
+			Kty: "OKP",
+			Crv: "X25519",
+			Kid: plisskenserver.KeyFingerprint(pubKey),
+			X:   base64.RawURLEncoding.EncodeToString(pubKey[:]),
+			D:   base64.RawURLEncoding.EncodeToString(privKey[:]),
+		}, "", "  ")
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		return append(b, '\n'), nil
+	default:
+		return nil, errors.Errorf("unknown key format: %s", format)
+	}
+}
+
+// Encrypt wraps an encoded key file in an encrypted PEM block. The key is
+// derived from 'passphrase' with Argon2id and the file is sealed with
+// AES256-GCM.
+func Encrypt(b []byte, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.New("passphrase is empty")
+	}
+	salt := make([]byte, kdfSaltLen)
+	_, err := cryptoRand.Read(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	aesGcm, err := newCipher(passphrase, salt, kdfTime, kdfMemory, kdfThreads)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	nonce := make([]byte, aesGcm.NonceSize())
+	_, err = cryptoRand.Read(nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: pemTypeEncryptedKey,
+		Headers: map[string]string{
+			"KDF": fmt.Sprintf("argon2id,t=%d,m=%d,p=%d",
+				kdfTime, kdfMemory, kdfThreads),
+			"Salt":  hex.EncodeToString(salt),
+			"Nonce": hex.EncodeToString(nonce),
+		},
+		Bytes: aesGcm.Seal(nil, nonce, b, nil),
+	}), nil
+}
+
+// Decode parses a key file in any of the supported formats. 'passphrase' is
+// only used if the file is encrypted.
+func Decode(b []byte, passphrase string) (x25519.Key, error) {
+	var privKey x25519.Key
+
+	// Raw
+	if len(b) == x25519.Size {
+		copy(privKey[:], b)
+		return privKey, nil
+	}
+
+	// Hex-encoded raw, e.g. when read from an env var
+	trimmed := bytes.TrimSpace(b)
+	if len(trimmed) == hex.EncodedLen(x25519.Size) {
+		_, err := hex.Decode(privKey[:], trimmed)
+		if err == nil {
+			return privKey, nil
+		}
+	}
+
+	// JWK
+	if bytes.HasPrefix(trimmed, []byte("{")) {
+		var k jwk
+		err := json.Unmarshal(trimmed, &k)
+		if err != nil {
+			return privKey, errors.Wrap(err, "while decoding JWK")
+		}
+		if k.Kty != "OKP" || k.Crv != "X25519" {
+			return privKey, errors.Errorf(
+				"unsupported JWK: kty=%s crv=%s", k.Kty, k.Crv)
+		}
+		d, err := base64.RawURLEncoding.DecodeString(k.D)
+		if err != nil {
+			return privKey, errors.Wrap(err, "while decoding JWK private key")
+		}
+		if len(d) != x25519.Size {
+			return privKey, errors.Errorf("bad JWK private key length: %d", len(d))
+		}
+		copy(privKey[:], d)
+		// 'x' is required by RFC 8037: make sure it's the public key of 'd'
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return privKey, errors.Wrap(err, "while decoding JWK public key")
+		}
+		err = Verify(privKey, x)
+		if err != nil {
+			return privKey, errors.Wrap(err, "JWK's x doesn't match d")
+		}
+		return privKey, nil
+	}
+
+	// PEM
+	block, _ := pem.Decode(trimmed)
+	if block == nil {
+		return privKey, errors.New("unknown key file format")
+	}
+	switch block.Type {
+	case pemTypePrivateKey:
+		k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return privKey, errors.Wrap(err, "")
+		}
+		ecdhKey, ok := k.(*ecdh.PrivateKey)
+		if !ok || ecdhKey.Curve() != ecdh.X25519() {
+			return privKey, errors.New("PKCS#8 key is not an X25519 key")
+		}
+		copy(privKey[:], ecdhKey.Bytes())
+		return privKey, nil
+	case pemTypeEncryptedKey:
+		inner, err := decrypt(block, passphrase)
+		if err != nil {
+			return privKey, errors.Wrap(err, "")
+		}
+		return Decode(inner, "")
+	default:
+		return privKey, errors.Errorf("unsupported PEM block: %s", block.Type)
+	}
+}
+
+// Verify fails if 'expectedPubKey' isn't the public key of 'privKey'
+func Verify(privKey x25519.Key, expectedPubKey []byte) error {
+	pubKey := PublicKey(privKey)
+	if !bytes.Equal(pubKey[:], expectedPubKey) {
+		return errors.Errorf("public key is %s, not %s",
+			hex.EncodeToString(pubKey[:]), hex.EncodeToString(expectedPubKey))
+	}
+	return nil
+}
+
+// Load reads and decodes the key file at 'path'
+func Load(path, passphrase string) (x25519.Key, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return x25519.Key{}, errors.Wrap(err, "")
+	}
+	privKey, err := Decode(b, passphrase)
+	if err != nil {
+		return x25519.Key{}, errors.Wrapf(err, "while decoding %s", path)
+	}
+	return privKey, nil
+}
+
+func decrypt(block *pem.Block, passphrase string) ([]byte, error) {
+	if passphrase == "" {
+		return nil, errors.Errorf(
+			"key file is encrypted but no passphrase was given (set %s)",
+			PassphraseEnvVar)
+	}
+	t, m, p, err := parseKDFHeader(block.Headers["KDF"])
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	salt, err := hex.DecodeString(block.Headers["Salt"])
+	if err != nil {
+		return nil, errors.Wrap(err, "bad Salt header")
+	}
+	if len(salt) < kdfMinSaltLen {
+		return nil, errors.Errorf("bad salt length: %d", len(salt))
+	}
+	nonce, err := hex.DecodeString(block.Headers["Nonce"])
+	if err != nil {
+		return nil, errors.Wrap(err, "bad Nonce header")
+	}
+	aesGcm, err := newCipher(passphrase, salt, t, m, p)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	if len(nonce) != aesGcm.NonceSize() {
+		return nil, errors.Errorf("bad nonce length: %d", len(nonce))
+	}
+	b, err := aesGcm.Open(nil, nonce, block.Bytes, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "wrong passphrase or corrupted key file")
+	}
+	return b, nil
+}
+
+// parseKDFHeader parses the "KDF" header written by Encrypt, and checks that
+// its parameters are within bounds
+func parseKDFHeader(header string) (t, m uint32, p uint8, err error) {
+	var ut, um, up uint64
+	var rest string
+	n, _ := fmt.Sscanf(header, "argon2id,t=%d,m=%d,p=%d%s", &ut, &um, &up, &rest)
+	if n != 3 {
+		return 0, 0, 0, errors.Errorf("bad KDF header: %s", header)
+	}
+	if ut < 1 || ut > kdfMaxTime {
+		return 0, 0, 0, errors.Errorf("KDF time must be within [1, %d]: %d", kdfMaxTime, ut)
+	}
+	if up < 1 || up > kdfMaxThreads {
+		return 0, 0, 0, errors.Errorf("KDF threads must be within [1, %d]: %d", kdfMaxThreads, up)
+	}
+	// Argon2 needs 8KiB per thread
+	if um < 8*up || um > kdfMaxMemory {
+		return 0, 0, 0, errors.Errorf("KDF memory must be within [%d, %d] KiB: %d",
+			8*up, kdfMaxMemory, um)
+	}
+	return uint32(ut), uint32(um), uint8(up), nil
+}
+
+func newCipher(
+	passphrase string,
+	salt []byte,
+	t, m uint32, p uint8,
+) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, t, m, p, 32) // AES256-GCM
+	ciph, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return cipher.NewGCM(ciph)
+}
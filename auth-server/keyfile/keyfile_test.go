@@ -0,0 +1,135 @@
+package keyfile
+
+import (
+	cryptoRand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"testing"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRoundTrip(t *testing.T) {
+	var privKey x25519.Key
+	_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
+	require.NoError(t, err)
+
+	for _, format := range []string{FormatRaw, FormatPEM, FormatJWK} {
+		t.Run(format, func(t *testing.T) {
+			b, err := Encode(privKey, format)
+			require.NoError(t, err)
+			decoded, err := Decode(b, "")
+			require.NoError(t, err)
+			require.Equal(t, privKey, decoded)
+
+			encrypted, err := Encrypt(b, "bunnyfoofoo")
+			require.NoError(t, err)
+			decoded, err = Decode(encrypted, "bunnyfoofoo")
+			require.NoError(t, err)
+			require.Equal(t, privKey, decoded)
+
+			_, err = Decode(encrypted, "notbunnyfoofoo")
+			require.Error(t, err)
+			_, err = Decode(encrypted, "")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeJWK(t *testing.T) {
+	var privKey, otherKey x25519.Key
+	_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
+	require.NoError(t, err)
+	_, err = io.ReadFull(cryptoRand.Reader, otherKey[:])
+	require.NoError(t, err)
+	otherPubKey := PublicKey(otherKey)
+
+	b, err := Encode(privKey, FormatJWK)
+	require.NoError(t, err)
+	var k jwk
+	require.NoError(t, json.Unmarshal(b, &k))
+
+	for name, mutate := range map[string]func(k *jwk){
+		"x of another key": func(k *jwk) {
+			k.X = base64.RawURLEncoding.EncodeToString(otherPubKey[:])
+		},
+		"no x":         func(k *jwk) { k.X = "" },
+		"x isn't b64":  func(k *jwk) { k.X = "!" },
+		"no d":         func(k *jwk) { k.D = "" },
+		"short d":      func(k *jwk) { k.D = k.D[:10] },
+		"wrong curve":  func(k *jwk) { k.Crv = "Ed25519" },
+		"wrong key ty": func(k *jwk) { k.Kty = "EC" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			bad := k
+			mutate(&bad)
+			b, err := json.Marshal(&bad)
+			require.NoError(t, err)
+			_, err = Decode(b, "")
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestDecodeEncryptedBadParameters(t *testing.T) {
+	var privKey x25519.Key
+	_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
+	require.NoError(t, err)
+	b, err := Encode(privKey, FormatRaw)
+	require.NoError(t, err)
+	encrypted, err := Encrypt(b, "bunnyfoofoo")
+	require.NoError(t, err)
+	block, _ := pem.Decode(encrypted)
+	require.NotNil(t, block)
+
+	for _, headers := range []map[string]string{
+		{"KDF": "argon2id,t=0,m=65536,p=4"},
+		{"KDF": "argon2id,t=1000000,m=65536,p=4"},
+		{"KDF": "argon2id,t=3,m=4294967295,p=4"},
+		{"KDF": "argon2id,t=3,m=16,p=4"},
+		{"KDF": "argon2id,t=3,m=65536,p=0"},
+		{"KDF": "argon2id,t=3,m=65536,p=255"},
+		{"KDF": "argon2id,t=3,m=65536,p=4,extra"},
+		{"KDF": "argon2id,t=-1,m=65536,p=4"},
+		{"KDF": "scrypt,N=32768"},
+		{"KDF": ""},
+		{"Salt": "00"},
+		{"Salt": "zz"},
+		{"Nonce": "00"},
+	} {
+		bad := &pem.Block{Type: block.Type, Headers: map[string]string{}, Bytes: block.Bytes}
+		for k, v := range block.Headers {
+			bad.Headers[k] = v
+		}
+		for k, v := range headers {
+			bad.Headers[k] = v
+		}
+		_, err := Decode(pem.EncodeToMemory(bad), "bunnyfoofoo")
+		require.Error(t, err, "%v", headers)
+	}
+
+	// Parameters other than ours, but within bounds, are fine
+	time, memory, threads, err := parseKDFHeader("argon2id,t=1,m=64,p=8")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, time)
+	require.EqualValues(t, 64, memory)
+	require.EqualValues(t, 8, threads)
+}
+
+func TestVerify(t *testing.T) {
+	var privKey, otherKey x25519.Key
+	_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
+	require.NoError(t, err)
+	_, err = io.ReadFull(cryptoRand.Reader, otherKey[:])
+	require.NoError(t, err)
+	pubKey := PublicKey(privKey)
+	otherPubKey := PublicKey(otherKey)
+
+	require.NoError(t, Verify(privKey, pubKey[:]))
+	require.Error(t, Verify(privKey, otherPubKey[:]))
+	require.Error(t, Verify(privKey, pubKey[:16]))
+	require.Error(t, Verify(privKey, nil))
+}
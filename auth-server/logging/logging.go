@@ -0,0 +1,115 @@
+// Package logging sets up the auth-server's logrus logger so that it never
+// prints secrets, and ties every log line of a request to a request ID.
+//
+// Handlers should log with FromContext(ctx), and pass identifiers as fields
+// (logger.WithField("username", ...)) rather than formatting them into the
+// message: fields listed in RedactedFields are masked before being written.
+package logging
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const redactedValue = "[REDACTED]"
+
+// RedactedFields are the (lower-cased) field names whose values are never
+// logged
+var RedactedFields = map[string]bool{
+	"appsecret":      true,
+	"app_secret":     true,
+	"password":       true,
+	"redis_password": true,
+	"session_token":  true,
+	"sessiontoken":   true,
+	"token":          true,
+	"authorization":  true,
+	"cookie":         true,
+	"set-cookie":     true,
+	"envu":           true,
+	"envu_nonce":     true,
+	"auth_nonce":     true,
+	"rwdu_salt":      true,
+	"salt":           true,
+	"oprf_priv_key":  true,
+	"private_key":    true,
+	"passphrase":     true,
+}
+
+// Setup configures the global logrus logger. 'format' is either 'text' or
+// 'json'.
+func Setup(format string, verbose bool) error {
+	var inner logrus.Formatter
+	switch format {
+	case "", FormatText:
+		inner = &logrus.TextFormatter{}
+	case FormatJSON:
+		inner = &logrus.JSONFormatter{}
+	default:
+		return errors.Errorf("unknown log format: %s", format)
+	}
+	logrus.SetFormatter(&RedactingFormatter{Inner: inner})
+	logrus.SetReportCaller(true)
+	if verbose {
+		logrus.SetLevel(logrus.TraceLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+	return nil
+}
+
+// RedactingFormatter masks the values of RedactedFields, then hands the entry
+// to Inner
+type RedactingFormatter struct {
+	Inner logrus.Formatter
+}
+
+func (f *RedactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	needsRedaction := false
+	for k := range entry.Data {
+		if RedactedFields[strings.ToLower(k)] {
+			needsRedaction = true
+			break
+		}
+	}
+	if !needsRedaction {
+		return f.Inner.Format(entry)
+	}
+
+	// Don't modify the entry in-place: its data could be shared
+	redacted := *entry
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+	for k, v := range entry.Data {
+		if RedactedFields[strings.ToLower(k)] {
+			v = redactedValue
+		}
+		redacted.Data[k] = v
+	}
+	return f.Inner.Format(&redacted)
+}
+
+type contextKey struct{}
+
+// WithLogger returns a copy of 'ctx' carrying 'logger'
+func WithLogger(ctx context.Context, logger *logrus.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// FromContext returns the logger attached to 'ctx' by the request middleware,
+// or the global logger if there's none
+func FromContext(ctx context.Context) *logrus.Entry {
+	if ctx != nil {
+		if logger, ok := ctx.Value(contextKey{}).(*logrus.Entry); ok {
+			return logger
+		}
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
@@ -0,0 +1,35 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactingFormatter(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&buf)
+	logger.SetFormatter(&RedactingFormatter{Inner: &logrus.JSONFormatter{}})
+
+	entry := logger.WithFields(logrus.Fields{
+		"username":      "truebeef",
+		"session_token": "deadbeef",
+		"AppSecret":     "bunnyfoofoo",
+	})
+	entry.Info("hello")
+
+	out := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Equal(t, "truebeef", out["username"])
+	require.Equal(t, redactedValue, out["session_token"])
+	require.Equal(t, redactedValue, out["AppSecret"])
+	require.NotContains(t, buf.String(), "deadbeef")
+	require.NotContains(t, buf.String(), "bunnyfoofoo")
+
+	// The original entry is untouched
+	require.Equal(t, "deadbeef", entry.Data["session_token"])
+}
@@ -2,54 +2,35 @@ package main
 
 import (
 	"context"
+	"crypto/ed25519"
+	"encoding/hex"
 	"flag"
-	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
-	"path/filepath"
 	"strings"
 	"time"
 
-	"github.com/afjoseph/plissken-auth-server/projectpath"
+	"github.com/afjoseph/plissken-auth-server/cachestore"
+	"github.com/afjoseph/plissken-auth-server/config"
+	"github.com/afjoseph/plissken-auth-server/keyfile"
+	"github.com/afjoseph/plissken-auth-server/logging"
+	"github.com/afjoseph/plissken-auth-server/memstore"
 	"github.com/afjoseph/plissken-auth-server/rediswrapper"
 	"github.com/afjoseph/plissken-auth-server/server"
-	"github.com/alicebob/miniredis/v2"
-	"github.com/go-redis/redis/v8"
+	"github.com/afjoseph/plissken-auth-server/sqlstore"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 var (
-	gitCommitHash  = "local"
-	configPathFlag = flag.String("config-path", "", "REQUIRED")
+	gitCommitHash   = "local"
+	configPathFlag  = flag.String("config-path", "", "REQUIRED")
+	checkConfigFlag = flag.Bool("check-config", false, "validate the config, load its keys and secrets, then exit")
 )
 
-type Config struct {
-	// REQUIRED: Address to listen on
-	Addr string `yaml:"addr"`
-
-	// Redis credentials are REQUIRED for production
-	// RedisPassword is set via REDIS_PASSWORD env var
-	// while RedisUrl is expected in the config file.
-	//
-	// If RedisUrl || RedisPassword are empty, miniredis will be used.
-	RedisUrl      string `yaml:"redis-url"`
-	redisPassword string
-
-	// REQUIRED: Path to private key
-	KeyPath string `yaml:"key-path"`
-
-	// REQUIRED: Map of app tokens to app secrets
-	AppTokensAndSecrets map[string]string `yaml:"app-tokens-and-secrets"`
-
-	// OPTIONAL: Whether to log more information
-	Verbose bool `yaml:"verbose"`
-
-	// OPTIONAL: Logged in the "version" field of the any endpoint
-	SdkVersion string `yaml:"sdk-version"`
-}
-
 func main() {
 	logrus.SetReportCaller(true)
 	if err := mainErr(); err != nil {
@@ -57,47 +38,89 @@ func main() {
 	}
 }
 
-func initAndParseConfig() (config *Config, onExit func(), err error) {
-	flag.Parse()
+// initStorage connects to the storage chosen in the config
+func initStorage(cfg *config.Config) (store server.Store, onExit func(), err error) {
+	switch cfg.Storage {
+	case config.StorageMemory:
+		logrus.Warnf("Using in-memory storage: all data is lost on exit")
+		return memstore.New(), nil, nil
+	case config.StorageRedis:
+		client, err := cfg.NewRedisClient()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		logrus.Infof("Using redis storage in %s mode", cfg.RedisMode())
+		rdw := &rediswrapper.RedisWrapper{
+			UniversalClient: client,
+			HashTags:        cfg.Redis != nil && cfg.Redis.HashTags,
+		}
+		err = rdw.BuildIndexes(context.Background())
+		if err != nil {
+			rdw.Close()
+			return nil, nil, errors.Wrap(err, "")
+		}
+		return rdw, func() { rdw.Close() }, nil
+	case config.StorageSQL:
+		sqlStore, err := sqlstore.Open(context.Background(), cfg.SqlUrl)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "")
+		}
+		logrus.Infof("Using SQL storage")
+		return sqlStore, func() { sqlStore.Close() }, nil
+	default:
+		return nil, nil, errors.Errorf("unknown storage: %s", cfg.Storage)
+	}
+}
 
-	b, err := os.ReadFile(*configPathFlag)
-	if err != nil {
-		return nil, nil, errors.Wrap(err, "")
+// initCache puts a cache in front of 'store'. Redis storage also invalidates
+// the caches of other replicas.
+func initCache(cfg *config.Config, store server.Store) (*cachestore.Store, error) {
+	opts := cachestore.Options{Size: cfg.Cache.Size, TTL: cfg.Cache.TTL}
+	if invalidator, ok := store.(cachestore.Invalidator); ok {
+		opts.Invalidator = invalidator
 	}
-	err = yaml.Unmarshal(b, &config)
+	logrus.Infof("Caching up to %d entries for %s (invalidations shared: %v)",
+		cfg.Cache.Size, cfg.Cache.TTL, opts.Invalidator != nil)
+	cachedStore, err := cachestore.New(context.Background(), store, opts)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "")
+		return nil, errors.Wrap(err, "")
 	}
+	return cachedStore, nil
+}
 
-	if config.KeyPath == "" {
-		return nil, nil, errors.New("key-path is empty")
+func mainErr() error {
+	// Init config
+	flag.Parse()
+	cfg, err := config.Load(*configPathFlag)
+	if err != nil {
+		return errors.Wrap(err, "")
 	}
-	if strings.HasPrefix(config.KeyPath, "./") {
-		config.KeyPath = filepath.Join(projectpath.Root, config.KeyPath)
+	err = logging.Setup(cfg.LogFormat, cfg.Verbose)
+	if err != nil {
+		return errors.Wrap(err, "")
 	}
 
-	config.redisPassword = os.Getenv("REDIS_PASSWORD")
-	if config.RedisUrl == "" || config.redisPassword == "" {
-		logrus.Infof(
-			"redis-url or REDIS_PASSWORD flags are empty. Using miniredis...")
-		config.redisPassword = ""
-		m, err := miniredis.Run()
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "")
-		}
-		config.RedisUrl = m.Addr()
-		onExit = func() {
-			if m != nil {
-				m.Close()
-			}
-		}
+	// Load secrets early: a config is only valid if they can be loaded
+	appSecrets, err := loadAppSecrets(cfg)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	keyring, err := loadKeyring(cfg)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	accessTokens, err := loadAccessTokenIssuer(cfg)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if *checkConfigFlag {
+		logrus.Infof("Config %s is valid (mode: %s, storage: %s)",
+			*configPathFlag, cfg.Mode, cfg.Storage)
+		return nil
 	}
-	return config, onExit, nil
-}
 
-func mainErr() error {
-	// Init config
-	config, onExit, err := initAndParseConfig()
+	// Init storage
+	store, onExit, err := initStorage(cfg)
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
@@ -106,45 +129,34 @@ func mainErr() error {
 			onExit()
 		}
 	}()
-	if config.Verbose {
-		logrus.SetLevel(logrus.TraceLevel)
-	} else {
-		logrus.SetLevel(logrus.InfoLevel)
-	}
-
-	// Init RedisWrapper
-	fmt.Printf("redis-url: %s\n", config.RedisUrl)
-	fmt.Printf("redis-password: %s\n", config.redisPassword)
-	rdw := &rediswrapper.RedisWrapper{
-		Client: redis.NewClient(&redis.Options{
-			Addr:     config.RedisUrl,
-			Password: config.redisPassword,
-			DB:       0,
-		})}
-
-	// Add all app tokens and secrets to redis
-	for appToken, appSecret := range config.AppTokensAndSecrets {
-		err = rdw.StoreAppSecret(context.Background(), appToken, appSecret)
+	if cfg.Cache != nil {
+		cachedStore, err := initCache(cfg, store)
 		if err != nil {
 			return errors.Wrap(err, "")
 		}
+		defer cachedStore.Close()
+		store = cachedStore
 	}
 
-	// Read key from file
-	serverPrivateKey, err := os.ReadFile(config.KeyPath)
-	if err != nil {
-		return errors.Wrap(err, "")
+	// Add all app tokens and secrets to the storage
+	for appToken, appSecret := range appSecrets {
+		err = store.StoreAppSecret(context.Background(), appToken, appSecret)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
 	}
+
 	errChan := make(chan error)
 	srv, err := server.Host(
-		serverPrivateKey,
-		// TODO <27-02-22, afjoseph> Definitely fix the corsOriginWhileList
-		nil,
-		config.Addr,
-		config.Verbose,
-		config.SdkVersion,
+		keyring,
+		cfg.CORSOrigins,
+		cfg.Addr,
+		cfg.Verbose,
+		cfg.SdkVersion,
 		gitCommitHash,
-		rdw,
+		store,
+		accessTokens,
+		sessionCookie(cfg),
 		errChan)
 	if err != nil {
 		return errors.Wrap(err, "")
@@ -172,3 +184,119 @@ func mainErr() error {
 	}
 	return nil
 }
+
+// loadAppSecrets merges the plaintext app secrets from the config with the
+// ones read from the secrets provider
+func loadAppSecrets(cfg *config.Config) (map[string]string, error) {
+	appSecrets := map[string]string{}
+	for appToken, appSecret := range cfg.AppTokensAndSecrets {
+		appSecrets[appToken] = appSecret
+	}
+	for appToken, name := range cfg.AppSecretNames {
+		b, err := cfg.SecretProvider.GetSecret(context.Background(), name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "while reading app secret of %s", appToken)
+		}
+		appSecrets[appToken] = strings.TrimSpace(string(b))
+	}
+	return appSecrets, nil
+}
+
+// loadKeyring reads all retired keys, then the current key, into a keyring.
+// Encrypted keys are decrypted with the passphrase in
+// $PLISSKEN_KEY_PASSPHRASE.
+func loadKeyring(cfg *config.Config) (*plisskenserver.Keyring, error) {
+	keyring := plisskenserver.NewKeyring()
+	for _, rk := range cfg.RetiredKeys {
+		privKey, err := loadKey(cfg, rk.Path, rk.Secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		key, err := keyring.Add(rk.ID, privKey[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "while adding retired key")
+		}
+		logrus.Infof("Loaded retired server key %s", key.ID)
+	}
+
+	privKey, err := loadKey(cfg, cfg.KeyPath, cfg.KeySecret)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	key, err := keyring.Add(cfg.KeyID, privKey[:])
+	if err != nil {
+		return nil, errors.Wrap(err, "while adding current key")
+	}
+	logrus.Infof("Loaded current server key %s", key.ID)
+	return keyring, nil
+}
+
+// loadAccessTokenIssuer reads the access token signing key, if access tokens
+// are enabled
+func loadAccessTokenIssuer(cfg *config.Config) (*server.AccessTokenIssuer, error) {
+	atc := cfg.AccessTokens
+	if atc == nil {
+		return nil, nil
+	}
+	var b []byte
+	var err error
+	if atc.KeyPath != "" {
+		b, err = os.ReadFile(atc.KeyPath)
+	} else {
+		b, err = cfg.SecretProvider.GetSecret(context.Background(), atc.KeySecret)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "while reading access token signing key")
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(b)))
+	if err != nil {
+		return nil, errors.Wrap(err, "while decoding access token signing key")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("bad access token signing key length %d", len(seed))
+	}
+	key := ed25519.NewKeyFromSeed(seed)
+	// Resource servers need it to check access tokens
+	logrus.Infof("Signing access tokens for %s with public key %s",
+		atc.TTL, hex.EncodeToString(key.Public().(ed25519.PublicKey)))
+	return &server.AccessTokenIssuer{Key: key, TTL: atc.TTL, Issuer: atc.Issuer}, nil
+}
+
+// sessionCookie returns the server's session cookie settings, if session
+// cookies are enabled
+func sessionCookie(cfg *config.Config) *server.SessionCookie {
+	scc := cfg.SessionCookie
+	if scc == nil {
+		return nil
+	}
+	sameSite := http.SameSiteLaxMode
+	switch scc.SameSite {
+	case config.SameSiteStrict:
+		sameSite = http.SameSiteStrictMode
+	case config.SameSiteNone:
+		sameSite = http.SameSiteNoneMode
+	}
+	return &server.SessionCookie{
+		Domain:   scc.Domain,
+		Path:     scc.Path,
+		SameSite: sameSite,
+		Insecure: scc.Insecure,
+	}
+}
+
+// loadKey reads a private key either from 'path' or from the secret 'secret'
+func loadKey(cfg *config.Config, path, secret string) (x25519.Key, error) {
+	passphrase := os.Getenv(keyfile.PassphraseEnvVar)
+	if path != "" {
+		return keyfile.Load(path, passphrase)
+	}
+	b, err := cfg.SecretProvider.GetSecret(context.Background(), secret)
+	if err != nil {
+		return x25519.Key{}, errors.Wrapf(err, "while reading key secret %s", secret)
+	}
+	privKey, err := keyfile.Decode(b, passphrase)
+	if err != nil {
+		return x25519.Key{}, errors.Wrapf(err, "while decoding key secret %s", secret)
+	}
+	return privKey, nil
+}
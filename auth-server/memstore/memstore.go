@@ -0,0 +1,178 @@
+// Package memstore keeps the auth-server's data in memory, on top of
+// plisskenserver.MemoryStorage. Everything is lost on exit: it's only meant for
+// development and tests.
+package memstore
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+// Store implements server.Store
+type Store struct {
+	*plisskenserver.MemoryStorage
+
+	mu sync.Mutex
+	// The expiry of every session token of a user, zero if it never expires
+	sessionTokens map[sessionKey]map[string]time.Time
+	appSecrets    map[string]string
+	now           func() time.Time
+}
+
+type sessionKey struct {
+	apptoken, username string
+}
+
+func New() *Store {
+	return &Store{
+		MemoryStorage: plisskenserver.NewMemoryStorage(),
+		sessionTokens: map[sessionKey]map[string]time.Time{},
+		appSecrets:    map[string]string{},
+		now:           time.Now,
+	}
+}
+
+// StoreSessionToken starts a session: the user's other sessions go on. Like
+// Redis' SET, an 'expiresAt' of 0 means the session never expires.
+func (s *Store) StoreSessionToken(
+	ctx context.Context,
+	apptoken, username, token string,
+	expiresAt time.Duration,
+) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	var expiry time.Time
+	if expiresAt > 0 {
+		expiry = s.now().Add(expiresAt)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sessionKey{apptoken, username}
+	tokens := s.sessionTokens[key]
+	if tokens == nil {
+		tokens = map[string]time.Time{}
+		s.sessionTokens[key] = tokens
+	}
+	// Drop the expired sessions
+	for t, tExpiry := range tokens {
+		if s.expired(tExpiry) {
+			delete(tokens, t)
+		}
+	}
+	tokens[token] = expiry
+	return nil
+}
+
+func (s *Store) HasSessionToken(
+	ctx context.Context,
+	apptoken, username, token string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expiry, ok := s.sessionTokens[sessionKey{apptoken, username}][token]
+	return ok && !s.expired(expiry), nil
+}
+
+// DeleteSessionToken ends the session of 'token'. The user's other sessions
+// go on.
+func (s *Store) DeleteSessionToken(
+	ctx context.Context,
+	apptoken, username, token string) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sessionKey{apptoken, username}
+	delete(s.sessionTokens[key], token)
+	if len(s.sessionTokens[key]) == 0 {
+		delete(s.sessionTokens, key)
+	}
+	return nil
+}
+
+func (s *Store) DeleteSessionTokens(
+	ctx context.Context,
+	apptoken, username string) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessionTokens, sessionKey{apptoken, username})
+	return nil
+}
+
+func (s *Store) expired(expiry time.Time) bool {
+	return !expiry.IsZero() && !s.now().Before(expiry)
+}
+
+func (s *Store) StoreAppSecret(ctx context.Context, apptoken, appSecret string) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appSecrets[apptoken] = appSecret
+	return nil
+}
+
+func (s *Store) HasAppSecret(ctx context.Context, apptoken, appSecret string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	secret, ok := s.appSecrets[apptoken]
+	return ok && secret == appSecret, nil
+}
+
+// ListAppTokens pages by app token: a cursor is the last one of its page
+func (s *Store) ListAppTokens(
+	ctx context.Context,
+	cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	var tokens []string
+	for apptoken := range s.appSecrets {
+		tokens = append(tokens, apptoken)
+	}
+	s.mu.Unlock()
+	sort.Strings(tokens)
+	page, next := paginate(tokens, cursor, count)
+	return page, next, nil
+}
+
+// ListUsernames pages by username: a cursor is the last one of its page
+func (s *Store) ListUsernames(
+	ctx context.Context,
+	apptoken, cursor string, count int) ([]string, string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, "", errors.Wrap(err, "")
+	}
+	page, next := paginate(s.Usernames(apptoken), cursor, count)
+	return page, next, nil
+}
+
+// paginate returns the first 'count' elements of 'sorted' after 'cursor'
+func paginate(sorted []string, cursor string, count int) ([]string, string) {
+	i := sort.SearchStrings(sorted, cursor)
+	if i < len(sorted) && sorted[i] == cursor {
+		i++
+	}
+	if count <= 0 || len(sorted)-i <= count {
+		return sorted[i:], ""
+	}
+	page := sorted[i : i+count]
+	return page, page[len(page)-1]
+}
@@ -0,0 +1,96 @@
+package memstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/afjoseph/plissken-protocol/server/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		return New()
+	})
+}
+
+func TestSessionTokens(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	now := time.Unix(1650000000, 0)
+	s.now = func() time.Time { return now }
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "other", 2*time.Hour))
+	ok, err := s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	now = now.Add(time.Hour)
+	ok, err = s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasSessionToken(ctx, "app", "user", "other")
+	require.NoError(t, err)
+	require.True(t, ok, "logging in again doesn't end the user's other sessions")
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "new", time.Hour))
+	require.Len(t, s.sessionTokens[sessionKey{"app", "user"}], 2,
+		"expired sessions are dropped")
+}
+
+func TestDeleteSessionTokens(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "other", time.Hour))
+	// Stale tokens don't end any session
+	require.NoError(t, s.DeleteSessionToken(ctx, "app", "user", "old"))
+	ok, err := s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+	// Ending a session doesn't end the user's others
+	require.NoError(t, s.DeleteSessionToken(ctx, "app", "user", "token"))
+	ok, err = s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasSessionToken(ctx, "app", "user", "other")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.DeleteSessionTokens(ctx, "app", "user"))
+	for _, token := range []string{"token", "other"} {
+		ok, err = s.HasSessionToken(ctx, "app", "user", token)
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+}
+
+func TestListing(t *testing.T) {
+	ctx := context.Background()
+	s := New()
+	for _, username := range []string{"e", "c", "a", "d", "b"} {
+		require.NoError(t, s.StoreUserEnvelope(ctx, "app", username,
+			&plisskenserver.UserEnvelope{}))
+	}
+
+	var pages [][]string
+	cursor := ""
+	for {
+		usernames, next, err := s.ListUsernames(ctx, "app", cursor, 2)
+		require.NoError(t, err)
+		pages = append(pages, usernames)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	require.Equal(t, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}, pages)
+
+	require.NoError(t, s.StoreAppSecret(ctx, "app", "secret"))
+	tokens, next, err := s.ListAppTokens(ctx, "", 2)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, tokens)
+	require.Empty(t, next)
+}
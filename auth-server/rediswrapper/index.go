@@ -0,0 +1,151 @@
+package rediswrapper
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// redisKey_IndexesBuilt is set once BuildIndexes indexed the existing keys
+const redisKey_IndexesBuilt = "index:built"
+
+func (s RedisWrapper) ListAppTokens(
+	ctx context.Context,
+	cursor string, count int) ([]string, string, error) {
+	return s.sscan(ctx, s.redisKey_AppsIndex(), cursor, count)
+}
+
+func (s RedisWrapper) ListUsernames(
+	ctx context.Context,
+	apptoken, cursor string, count int) ([]string, string, error) {
+	return s.sscan(ctx, s.redisKey_UsersIndex(apptoken), cursor, count)
+}
+
+// sscan returns a page of the members of the set 'key'. Cursors are SSCAN's,
+// except for the first and the end ones which are "" instead of "0".
+func (s RedisWrapper) sscan(
+	ctx context.Context,
+	key, cursor string, count int) ([]string, string, error) {
+	var redisCursor uint64
+	if cursor != "" {
+		var err error
+		redisCursor, err = strconv.ParseUint(cursor, 10, 64)
+		if err != nil {
+			return nil, "", errors.Wrapf(err, "bad cursor %q", cursor)
+		}
+	}
+	members, next, err := s.SScan(ctx, key, redisCursor, "", int64(count)).Result()
+	if err != nil {
+		return nil, "", errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	if next == 0 {
+		return members, "", nil
+	}
+	return members, strconv.FormatUint(next, 10), nil
+}
+
+// BuildIndexes adds the app secrets and envelopes stored before the indexes
+// existed to them. It SCANs the whole keyspace the first time it's called,
+// and does nothing afterwards. Keys written before key components were
+// escaped are migrated first: see MigrateKeys.
+func (s RedisWrapper) BuildIndexes(ctx context.Context) error {
+	err := s.MigrateKeys(ctx)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	n, err := s.Exists(ctx, redisKey_IndexesBuilt).Result()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	if n != 0 {
+		return nil
+	}
+
+	logrus.Infof("Indexing existing redis keys")
+	err = s.scanKeyComponents(ctx, "app_secrets:*:secret", func(components []string) error {
+		return s.SAdd(ctx, s.redisKey_AppsIndex(), components[0]).Err()
+	})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	err = s.scanKeyComponents(ctx, "reg:*:*:envelope", func(components []string) error {
+		return s.SAdd(ctx, s.redisKey_UsersIndex(components[0]), components[1]).Err()
+	})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	err = s.Set(ctx, redisKey_IndexesBuilt, "1", 0).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
+// scanKeyComponents calls 'fn' with the unescaped '*' components of every key
+// matching 'pattern'. Keys with a different number of components are
+// skipped. Errors of 'fn' are storage errors.
+func (s RedisWrapper) scanKeyComponents(
+	ctx context.Context,
+	pattern string,
+	fn func(components []string) error) error {
+	patternParts := strings.Split(pattern, ":")
+	return s.scanKeys(ctx, pattern, func(key string) error {
+		parts := strings.Split(key, ":")
+		if len(parts) != len(patternParts) {
+			logrus.Warnf("Can't index redis key %q: skipping it", key)
+			return nil
+		}
+		var components []string
+		for i, part := range patternParts {
+			if part == "*" {
+				// Real braces are escaped: these are hash tags
+				components = append(components,
+					unescapeKeyComponent(strings.Trim(parts[i], "{}")))
+			}
+		}
+		err := fn(components)
+		if err != nil {
+			return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+		}
+		return nil
+	})
+}
+
+// scanKeys calls 'fn' with every key matching 'pattern', on every master of a
+// cluster
+func (s RedisWrapper) scanKeys(
+	ctx context.Context,
+	pattern string,
+	fn func(key string) error) error {
+	cluster, ok := s.UniversalClient.(*redis.ClusterClient)
+	if !ok {
+		return s.scanNodeKeys(ctx, s.UniversalClient, pattern, fn)
+	}
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		return s.scanNodeKeys(ctx, node, pattern, fn)
+	})
+}
+
+func (s RedisWrapper) scanNodeKeys(
+	ctx context.Context,
+	node redis.Cmdable,
+	pattern string,
+	fn func(key string) error) error {
+	iter := node.Scan(ctx, 0, pattern, 100).Iterator()
+	for iter.Next(ctx) {
+		err := fn(iter.Val())
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+	if err := iter.Err(); err != nil && err != redis.Nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
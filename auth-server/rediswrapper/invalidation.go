@@ -0,0 +1,41 @@
+package rediswrapper
+
+import (
+	"context"
+	"io"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+// redisChannel_Invalidations carries the keys of cache entries to drop, see
+// cachestore.Invalidator
+const redisChannel_Invalidations = "plissken:cache-invalidations"
+
+func (s RedisWrapper) PublishInvalidation(ctx context.Context, key string) error {
+	err := s.Publish(ctx, redisChannel_Invalidations, key).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
+// SubscribeInvalidations returns once subscribed. go-redis resubscribes after
+// reconnecting, but invalidations published in between are lost.
+func (s RedisWrapper) SubscribeInvalidations(
+	ctx context.Context,
+	fn func(key string)) (io.Closer, error) {
+	pubsub := s.Subscribe(ctx, redisChannel_Invalidations)
+	_, err := pubsub.Receive(ctx)
+	if err != nil {
+		pubsub.Close()
+		return nil, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	ch := pubsub.Channel()
+	go func() {
+		for msg := range ch {
+			fn(msg.Payload)
+		}
+	}()
+	return pubsub, nil
+}
@@ -0,0 +1,227 @@
+package rediswrapper
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/go-redis/redis/v8"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// redisKey_KeysMigrated is set once MigrateKeys renamed the keys written
+// before key components were escaped
+const redisKey_KeysMigrated = "migrated:escaped-keys"
+
+// legacyKey describes the keys of a kind as they were named before escaping:
+// "<prefix><apptoken>:<username><suffix>", or "<prefix><apptoken><suffix>"
+// for app keys
+type legacyKey struct {
+	prefix, suffix string
+	// newKey names the key now. It's nil for app keys.
+	newKey func(s RedisWrapper, apptoken, username string) string
+	// move moves a key whose name changed
+	move func(s RedisWrapper, ctx context.Context, from, to string) error
+	// Ephemeral keys are deleted when their user can't be told apart
+	ephemeral bool
+}
+
+var legacyUserKeys = []legacyKey{
+	{prefix: "reg:", suffix: ":envelope",
+		newKey: RedisWrapper.redisKey_UserEnvelope, move: RedisWrapper.moveKey},
+	// Pending registrations and nonces are started again
+	{prefix: "reg:", suffix: ":request",
+		newKey: RedisWrapper.redisKey_UserRequest, move: RedisWrapper.deleteKey, ephemeral: true},
+	{prefix: "auth:", suffix: ":requests",
+		newKey: RedisWrapper.redisKey_AuthNonces, move: RedisWrapper.deleteKey, ephemeral: true},
+	// Users had a single session token, instead of a set of them
+	{prefix: "tokens:", suffix: ":token",
+		newKey: RedisWrapper.redisKey_SessionTokens, move: RedisWrapper.moveSessionToken, ephemeral: true},
+}
+
+var legacyAppSecretKey = legacyKey{prefix: "app_secrets:", suffix: ":secret",
+	move: RedisWrapper.moveKey}
+
+type keyMove struct {
+	from, to string
+	move     func(s RedisWrapper, ctx context.Context, from, to string) error
+}
+
+// MigrateKeys renames the keys written before key components were escaped
+// (and before hash tags, if HashTags is set), so that users whose app token
+// or username has a '%', ':', '{' or '}' keep their envelope, and moves the
+// single session token users had to their set of sessions. It runs once:
+// every key is assumed to be unescaped the first time it's called, so call it
+// before serving requests. BuildIndexes does.
+//
+// It fails, without renaming anything, if an envelope's key has several ':'
+// and the app secrets don't tell which of them ends the app token: such keys
+// have to be renamed by hand.
+func (s RedisWrapper) MigrateKeys(ctx context.Context) error {
+	n, err := s.Exists(ctx, redisKey_KeysMigrated).Result()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	if n != 0 {
+		return nil
+	}
+
+	apptokens := map[string]bool{}
+	var moves []keyMove
+	err = s.scanKeys(ctx, legacyAppSecretKey.pattern(), func(key string) error {
+		apptoken := legacyAppSecretKey.trim(key)
+		apptokens[apptoken] = true
+		if newKey := s.redisKey_AppSecret(apptoken); newKey != key {
+			moves = append(moves, keyMove{key, newKey, legacyAppSecretKey.move})
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	for _, kind := range legacyUserKeys {
+		kind := kind
+		err = s.scanKeys(ctx, kind.pattern(), func(key string) error {
+			apptoken, username, ok := splitLegacyUserKeyPart(kind.trim(key), apptokens)
+			if !ok && !kind.ephemeral {
+				return errors.Errorf(
+					"can't tell the app token from the username in redis key %q: rename it by hand",
+					key)
+			}
+			if !ok {
+				moves = append(moves, keyMove{key, "", RedisWrapper.deleteKey})
+				return nil
+			}
+			if newKey := kind.newKey(s, apptoken, username); newKey != key {
+				moves = append(moves, keyMove{key, newKey, kind.move})
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+
+	if len(moves) > 0 {
+		logrus.Infof("Migrating %d redis keys written before key components were escaped",
+			len(moves))
+	}
+	// A key's new name may be another key's old name, which is shorter than
+	// its own new name: rename the longest names first
+	sort.SliceStable(moves, func(i, j int) bool {
+		return len(moves[i].from) > len(moves[j].from)
+	})
+	for _, move := range moves {
+		err = move.move(s, ctx, move.from, move.to)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+	}
+
+	err = s.Set(ctx, redisKey_KeysMigrated, "1", 0).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
+func (k legacyKey) pattern() string {
+	return k.prefix + "*" + k.suffix
+}
+
+func (k legacyKey) trim(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, k.prefix), k.suffix)
+}
+
+// splitLegacyUserKeyPart splits "<apptoken>:<username>". If there are
+// several ':', the app token must be one of 'apptokens', and only one of them
+// may match.
+func splitLegacyUserKeyPart(
+	part string,
+	apptokens map[string]bool) (apptoken, username string, ok bool) {
+	components := strings.Split(part, ":")
+	if len(components) < 2 {
+		return "", "", false
+	}
+	if len(components) == 2 {
+		return components[0], components[1], true
+	}
+	for i := 1; i < len(components); i++ {
+		candidate := strings.Join(components[:i], ":")
+		if !apptokens[candidate] {
+			continue
+		}
+		if ok {
+			return "", "", false
+		}
+		apptoken, username, ok = candidate, strings.Join(components[i:], ":"), true
+	}
+	return apptoken, username, ok
+}
+
+// moveKey renames the string key 'from' to 'to'. It copies the value instead
+// of using RENAME: in a cluster, both keys are usually in different slots.
+func (s RedisWrapper) moveKey(ctx context.Context, from, to string) error {
+	val, err := s.Get(ctx, from).Result()
+	if err == redis.Nil {
+		// Another replica moved it already
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	ok, err := s.SetNX(ctx, to, val, 0).Result()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	if !ok {
+		existing, err := s.Get(ctx, to).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+		}
+		if existing != val {
+			return errors.Errorf("can't rename redis key %q to %q: it exists", from, to)
+		}
+	}
+	return s.deleteKey(ctx, from, "")
+}
+
+// moveSessionToken adds the session token of the string key 'from' to the
+// set of session tokens 'to', with the same expiry
+func (s RedisWrapper) moveSessionToken(ctx context.Context, from, to string) error {
+	token, err := s.Get(ctx, from).Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	ttl, err := s.PTTL(ctx, from).Result()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	var expiry time.Time
+	switch {
+	case ttl == -2:
+		// Expired in between
+		return nil
+	case ttl != -1:
+		expiry = s.clock().Add(ttl)
+	}
+	err = s.addSessionToken(ctx, to, token, expiry)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return s.deleteKey(ctx, from, "")
+}
+
+func (s RedisWrapper) deleteKey(ctx context.Context, key, _ string) error {
+	err := s.Del(ctx, key).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
@@ -6,7 +6,8 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	mathRand "math/rand"
+	"math"
+	"strconv"
 	"strings"
 	"time"
 
@@ -16,31 +17,92 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-const authNoncesMaxCount = 20
-
-// RedisWrapper implements the plisskenserver.Storage interface
+// RedisWrapper implements the plisskenserver.Storage interface on a redis
+// server, a sentinel-managed one or a cluster
 type RedisWrapper struct {
-	*redis.Client
+	redis.UniversalClient
+
+	// HashTags wraps the app token and username of keys in a hash tag, so
+	// that a cluster puts all the keys of a user (or of an app) in the same
+	// slot. Keys are named differently with and without it.
+	HashTags bool
+
+	// now is time.Now if nil
+	now func() time.Time
+}
+
+func (s RedisWrapper) clock() time.Time {
+	if s.now == nil {
+		return time.Now()
+	}
+	return s.now()
+}
+
+// keyEscaper escapes the characters with a meaning in our keys: ':' separates
+// components and '{}' delimit cluster hash tags. Components without them keep
+// the keys they had before escaping was introduced: MigrateKeys renames the
+// others.
+var keyEscaper = strings.NewReplacer("%", "%25", ":", "%3A", "{", "%7B", "}", "%7D")
+
+var keyUnescaper = strings.NewReplacer("%25", "%", "%3A", ":", "%7B", "{", "%7D", "}")
+
+func escapeKeyComponent(str string) string {
+	return keyEscaper.Replace(str)
 }
 
-func redisKey_UserEnvelope(apptoken, username string) string {
-	return fmt.Sprintf("reg:%s:%s:envelope", apptoken, username)
+func unescapeKeyComponent(str string) string {
+	return keyUnescaper.Replace(str)
 }
 
-func redisKey_UserRequest(apptoken, username string) string {
-	return fmt.Sprintf("reg:%s:%s:request", apptoken, username)
+// userKeyPart identifies a user in its keys: "<apptoken>:<username>", or
+// "{<apptoken>:<username>}" with hash tags
+func (s RedisWrapper) userKeyPart(apptoken, username string) string {
+	part := escapeKeyComponent(apptoken) + ":" + escapeKeyComponent(username)
+	if s.HashTags {
+		return "{" + part + "}"
+	}
+	return part
+}
+
+// appKeyPart identifies an app in its keys, like userKeyPart
+func (s RedisWrapper) appKeyPart(apptoken string) string {
+	if s.HashTags {
+		return "{" + escapeKeyComponent(apptoken) + "}"
+	}
+	return escapeKeyComponent(apptoken)
 }
 
-func redisKey_AuthNonces(apptoken, username string) string {
-	return fmt.Sprintf("auth:%s:%s:requests", apptoken, username)
+func (s RedisWrapper) redisKey_UserEnvelope(apptoken, username string) string {
+	return fmt.Sprintf("reg:%s:envelope", s.userKeyPart(apptoken, username))
 }
 
-func redisKey_SessionToken(apptoken, username string) string {
-	return fmt.Sprintf("tokens:%s:%s:token", apptoken, username)
+func (s RedisWrapper) redisKey_UserRequest(apptoken, username string) string {
+	return fmt.Sprintf("reg:%s:request", s.userKeyPart(apptoken, username))
 }
 
-func redisKey_AppSecret(apptoken string) string {
-	return fmt.Sprintf("app_secrets:%s:secret", apptoken)
+func (s RedisWrapper) redisKey_AuthNonces(apptoken, username string) string {
+	return fmt.Sprintf("auth:%s:requests", s.userKeyPart(apptoken, username))
+}
+
+// redisKey_SessionTokens is a sorted set of the user's session tokens, scored
+// by when they expire
+func (s RedisWrapper) redisKey_SessionTokens(apptoken, username string) string {
+	return fmt.Sprintf("tokens:%s:tokens", s.userKeyPart(apptoken, username))
+}
+
+func (s RedisWrapper) redisKey_AppSecret(apptoken string) string {
+	return fmt.Sprintf("app_secrets:%s:secret", s.appKeyPart(apptoken))
+}
+
+// redisKey_AppsIndex is a set of the app tokens having an app secret
+func (s RedisWrapper) redisKey_AppsIndex() string {
+	return "index:apps"
+}
+
+// redisKey_UsersIndex is a set of the usernames of 'apptoken' having an
+// envelope
+func (s RedisWrapper) redisKey_UsersIndex(apptoken string) string {
+	return fmt.Sprintf("index:%s:users", s.appKeyPart(apptoken))
 }
 
 func (s RedisWrapper) StoreUserRequest(
@@ -51,9 +113,9 @@ func (s RedisWrapper) StoreUserRequest(
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
-	err = s.Set(ctx, redisKey_UserRequest(apptoken, username), string(b), 0).Err()
+	err = s.Set(ctx, s.redisKey_UserRequest(apptoken, username), string(b), 0).Err()
 	if err != nil {
-		return errors.Wrap(err, "")
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	return nil
 }
@@ -61,9 +123,12 @@ func (s RedisWrapper) StoreUserRequest(
 func (s RedisWrapper) LoadUserRequest(ctx context.Context, apptoken, username string) (
 	*plisskenserver.UserRequest, error) {
 	var req plisskenserver.UserRequest
-	str, err := s.Get(ctx, redisKey_UserRequest(apptoken, username)).Result()
+	str, err := s.Get(ctx, s.redisKey_UserRequest(apptoken, username)).Result()
+	if err == redis.Nil {
+		return nil, errors.Wrap(plisskenserver.ErrUserNotFound, "no pending registration")
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	if str == "" {
 		return nil, errors.New("saved data is nil")
@@ -76,9 +141,9 @@ func (s RedisWrapper) LoadUserRequest(ctx context.Context, apptoken, username st
 }
 
 func (s RedisWrapper) HasUserRequest(ctx context.Context, apptoken, username string) (bool, error) {
-	n, err := s.Exists(ctx, redisKey_UserRequest(apptoken, username)).Result()
+	n, err := s.Exists(ctx, s.redisKey_UserRequest(apptoken, username)).Result()
 	if err != nil {
-		return false, errors.Wrap(err, "")
+		return false, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	return n != 0, nil
 }
@@ -91,9 +156,15 @@ func (s RedisWrapper) StoreUserEnvelope(
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
-	err = s.Set(ctx, redisKey_UserEnvelope(apptoken, username), string(b), 0).Err()
+	err = s.Set(ctx, s.redisKey_UserEnvelope(apptoken, username), string(b), 0).Err()
 	if err != nil {
-		return errors.Wrap(err, "")
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	// The index is outside of a transaction with the envelope: in a cluster,
+	// it's in another slot. Retrying a failed call adds it.
+	err = s.SAdd(ctx, s.redisKey_UsersIndex(apptoken), username).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	return nil
 }
@@ -102,9 +173,12 @@ func (s RedisWrapper) LoadUserEnvelope(
 	ctx context.Context,
 	apptoken, username string) (*plisskenserver.UserEnvelope, error) {
 	var req plisskenserver.UserEnvelope
-	str, err := s.Get(ctx, redisKey_UserEnvelope(apptoken, username)).Result()
+	str, err := s.Get(ctx, s.redisKey_UserEnvelope(apptoken, username)).Result()
+	if err == redis.Nil {
+		return nil, errors.Wrap(plisskenserver.ErrUserNotFound, "")
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	err = json.Unmarshal([]byte(str), &req)
 	if err != nil {
@@ -113,35 +187,195 @@ func (s RedisWrapper) LoadUserEnvelope(
 	return &req, nil
 }
 
+// CompleteRegistration WATCHes the pending request and the envelope while
+// building the envelope, then stores the envelope and deletes the request in
+// a MULTI/EXEC transaction. If either changed in between, nothing is written.
+// In a cluster, this needs HashTags: both keys must be in the same slot.
+func (s RedisWrapper) CompleteRegistration(
+	ctx context.Context,
+	apptoken, username string,
+	requestID []byte,
+	build func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error),
+) error {
+	reqKey := s.redisKey_UserRequest(apptoken, username)
+	envKey := s.redisKey_UserEnvelope(apptoken, username)
+	watched := false
+	err := s.Watch(ctx, func(tx *redis.Tx) error {
+		watched = true
+		str, err := tx.Get(ctx, reqKey).Result()
+		if err == redis.Nil {
+			return errors.Wrap(plisskenserver.ErrUserNotFound, "no pending registration")
+		}
+		if err != nil {
+			return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+		}
+		var req plisskenserver.UserRequest
+		err = json.Unmarshal([]byte(str), &req)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		n, err := tx.Exists(ctx, envKey).Result()
+		if err != nil {
+			return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+		}
+		if n > 0 {
+			return errors.Wrap(plisskenserver.ErrUserExists, "")
+		}
+		err = plisskenserver.CheckUserRequestID(&req, requestID)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		env, err := build(&req)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		b, err := json.Marshal(env)
+		if err != nil {
+			return errors.Wrap(err, "")
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, envKey, string(b), 0)
+			pipe.Del(ctx, reqKey)
+			return nil
+		})
+		if err == redis.TxFailedErr {
+			// Don't retry: a new request needs a new envelope from the client,
+			// and a new envelope means the user registered concurrently
+			return errors.Wrap(plisskenserver.ErrUserNotFound,
+				"pending registration changed concurrently")
+		}
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}, reqKey, envKey)
+	if err != nil && !watched {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	// The index is outside of the transaction: in a cluster, it's in another
+	// slot than the user's keys
+	err = s.SAdd(ctx, s.redisKey_UsersIndex(apptoken), username).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
+// StoreSessionToken starts a session: the user's other sessions go on. Like
+// SET, an 'expiresAt' of 0 means the session never expires.
 func (s RedisWrapper) StoreSessionToken(
 	ctx context.Context,
 	apptoken, username, sessionToken string,
 	expiresAt time.Duration,
 ) error {
-	err := s.Set(ctx, redisKey_SessionToken(apptoken, username), sessionToken, expiresAt).Err()
+	var expiry time.Time
+	if expiresAt > 0 {
+		expiry = s.clock().Add(expiresAt)
+	}
+	err := s.addSessionToken(ctx,
+		s.redisKey_SessionTokens(apptoken, username), sessionToken, expiry)
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
 	return nil
 }
 
+// maxSessionTokenRetries bounds the retries of addSessionToken's transaction
+// when the user logs in or out concurrently
+const maxSessionTokenRetries = 10
+
+// addSessionToken adds 'token' to the sorted set 'key', scored by the Unix
+// time in milliseconds it expires at ('expiry', or never if it's zero). The
+// expired tokens are dropped, and the key expires with its last token.
+func (s RedisWrapper) addSessionToken(
+	ctx context.Context,
+	key, token string,
+	expiry time.Time) error {
+	now := s.clock()
+	score := math.Inf(1)
+	if !expiry.IsZero() {
+		score = float64(expiry.UnixMilli())
+	}
+	var err error
+	for i := 0; i < maxSessionTokenRetries; i++ {
+		err = s.Watch(ctx, func(tx *redis.Tx) error {
+			// -1 if the key never expires, -2 if it doesn't exist
+			ttl, err := tx.PTTL(ctx, key).Result()
+			if err != nil {
+				return err
+			}
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.ZAdd(ctx, key, &redis.Z{Score: score, Member: token})
+				pipe.ZRemRangeByScore(ctx, key,
+					"-inf", strconv.FormatInt(now.UnixMilli(), 10))
+				switch {
+				case expiry.IsZero() || ttl == -1:
+					pipe.Persist(ctx, key)
+				case ttl == -2 || now.Add(ttl).Before(expiry):
+					pipe.PExpireAt(ctx, key, expiry)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
 func (s RedisWrapper) HasSessionToken(
 	ctx context.Context,
 	apptoken, username, sessionToken string) (bool, error) {
-	t, err := s.Get(ctx, redisKey_SessionToken(apptoken, username)).Result()
+	expiry, err := s.ZScore(ctx,
+		s.redisKey_SessionTokens(apptoken, username), sessionToken).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return expiry > float64(s.clock().UnixMilli()), nil
+}
+
+// DeleteSessionToken ends the session of 'sessionToken'. The user's other
+// sessions go on.
+func (s RedisWrapper) DeleteSessionToken(
+	ctx context.Context,
+	apptoken, username, sessionToken string) error {
+	err := s.ZRem(ctx, s.redisKey_SessionTokens(apptoken, username), sessionToken).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	return nil
+}
+
+func (s RedisWrapper) DeleteSessionTokens(
+	ctx context.Context,
+	apptoken, username string) error {
+	err := s.Del(ctx, s.redisKey_SessionTokens(apptoken, username)).Err()
 	if err != nil {
-		return false, errors.Wrap(err, "")
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
-	return t == sessionToken, nil
+	return nil
 }
 
 func (s RedisWrapper) StoreAppSecret(
 	ctx context.Context,
 	apptoken, appSecret string,
 ) error {
-	err := s.Set(ctx, redisKey_AppSecret(apptoken), appSecret, 0).Err()
+	err := s.Set(ctx, s.redisKey_AppSecret(apptoken), appSecret, 0).Err()
 	if err != nil {
-		return errors.Wrap(err, "")
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
+	}
+	// Outside of a transaction with the secret, like in StoreUserEnvelope
+	err = s.SAdd(ctx, s.redisKey_AppsIndex(), apptoken).Err()
+	if err != nil {
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	return nil
 }
@@ -149,9 +383,12 @@ func (s RedisWrapper) StoreAppSecret(
 func (s RedisWrapper) HasAppSecret(
 	ctx context.Context,
 	apptoken, appSecret string) (bool, error) {
-	t, err := s.Get(ctx, redisKey_AppSecret(apptoken)).Result()
+	t, err := s.Get(ctx, s.redisKey_AppSecret(apptoken)).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
 	if err != nil {
-		return false, errors.Wrap(err, "")
+		return false, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 	return t == appSecret, nil
 }
@@ -160,20 +397,16 @@ func (s RedisWrapper) StoreAuthNonce(
 	ctx context.Context,
 	apptoken, username string,
 	nonce []byte) error {
-	err := s.LPush(ctx, redisKey_AuthNonces(apptoken, username),
-		hex.EncodeToString(nonce)).Err()
+	// Keep only the last 'MaxAuthNonces' nonces
+	key := s.redisKey_AuthNonces(apptoken, username)
+	_, err := s.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.LPush(ctx, key, hex.EncodeToString(nonce))
+		pipe.LTrim(ctx, key, 0, plisskenserver.MaxAuthNonces-1)
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "")
+		return errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
-	// Keep only the last 'authNoncesMaxCount' requests, but don't run LTRIM
-	// every time; do it on a random chance
-	if mathRand.Intn(3) == 0 {
-		if err = s.LTrim(ctx, redisKey_AuthNonces(apptoken, username),
-			0, authNoncesMaxCount).Err(); err != nil {
-			return errors.Wrap(err, "")
-		}
-	}
-
 	return nil
 }
 
@@ -182,17 +415,20 @@ func (s RedisWrapper) HasAuthNonce(
 	apptoken, username string,
 	inputAuthNonce []byte) (bool, error) {
 	t, err := s.LRange(ctx,
-		redisKey_AuthNonces(apptoken, username),
-		0, authNoncesMaxCount).Result()
+		s.redisKey_AuthNonces(apptoken, username),
+		0, plisskenserver.MaxAuthNonces-1).Result()
 	if err != nil {
-		return false, errors.Wrap(err, "")
+		return false, errors.Wrap(plisskenserver.StorageUnavailable(err), "")
 	}
 
 	for _, v := range t {
 		b, err := hex.DecodeString(v)
 		if err != nil {
 			// TODO <22-04-2022, afjoseph> Deal with corruption
-			logrus.Errorf("Failed to decode auth nonce: %s", v)
+			logrus.WithFields(logrus.Fields{
+				"apptoken": apptoken,
+				"username": username,
+			}).Errorf("Failed to decode auth nonce")
 		}
 		if bytes.Equal(b, inputAuthNonce) {
 			return true, nil
@@ -201,32 +437,3 @@ func (s RedisWrapper) HasAuthNonce(
 
 	return false, nil
 }
-
-func (s RedisWrapper) GetAllAppTokens(ctx context.Context) ([]string, error) {
-	keys, err := s.Keys(ctx, redisKey_AppSecret("*")).Result()
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-
-	var tokens []string
-	for _, key := range keys {
-		arr := strings.Split(key, ":")
-		tokens = append(tokens, arr[1])
-	}
-	return tokens, nil
-}
-
-func (s RedisWrapper) GetAllUsernamesFromEnvelopes(
-	ctx context.Context, apptoken string) ([]string, error) {
-	keys, err := s.Keys(ctx, redisKey_UserEnvelope(apptoken, "*")).Result()
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-
-	var usernames []string
-	for _, key := range keys {
-		arr := strings.Split(key, ":")
-		usernames = append(usernames, arr[2])
-	}
-	return usernames, nil
-}
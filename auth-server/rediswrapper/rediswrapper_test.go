@@ -0,0 +1,437 @@
+package rediswrapper
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/afjoseph/plissken-protocol/server/storagetest"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { client.Close() })
+		return RedisWrapper{UniversalClient: client}
+	})
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr(), MaxRetries: -1})
+	defer client.Close()
+	m.Close()
+
+	_, err := RedisWrapper{UniversalClient: client}.LoadUserEnvelope(
+		context.Background(), "app", "user")
+	require.ErrorIs(t, err, plisskenserver.ErrStorageUnavailable)
+}
+
+func TestSessionTokens(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	now := time.Now()
+	s := RedisWrapper{UniversalClient: client, now: func() time.Time { return now }}
+	key := s.redisKey_SessionTokens("app", "user")
+
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "short", time.Minute))
+	require.InDelta(t, time.Hour, m.TTL(key), float64(time.Minute),
+		"the key lives as long as its last session")
+	now = now.Add(time.Minute)
+	ok, err := s.HasSessionToken(ctx, "app", "user", "short")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "forever", 0))
+	require.Zero(t, m.TTL(key))
+	members, err := m.ZMembers(key)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"token", "forever"}, members,
+		"expired sessions are dropped")
+}
+
+func TestDeleteSessionTokens(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client}
+
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "other", time.Hour))
+	// Stale tokens don't end any session
+	require.NoError(t, s.DeleteSessionToken(ctx, "app", "user", "old"))
+	ok, err := s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+	// Ending a session doesn't end the user's others
+	require.NoError(t, s.DeleteSessionToken(ctx, "app", "user", "token"))
+	ok, err = s.HasSessionToken(ctx, "app", "user", "token")
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasSessionToken(ctx, "app", "user", "other")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.NoError(t, s.DeleteSessionToken(ctx, "app", "user", "token"))
+
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "user", "token", time.Hour))
+	require.NoError(t, s.DeleteSessionTokens(ctx, "app", "user"))
+	for _, token := range []string{"token", "other"} {
+		ok, err = s.HasSessionToken(ctx, "app", "user", token)
+		require.NoError(t, err)
+		require.False(t, ok)
+	}
+}
+
+func TestCompleteRegistrationRacingNewRequest(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client}
+
+	oldReq := &plisskenserver.UserRequest{
+		SerializedClientOprvPrivateKey: []byte("old"), ID: []byte("old")}
+	newReq := &plisskenserver.UserRequest{
+		SerializedClientOprvPrivateKey: []byte("new"), ID: []byte("new")}
+	require.NoError(t, s.StoreUserRequest(ctx, "app", "user", oldReq))
+
+	// A new registration starts while the old one is being finalized
+	err := s.CompleteRegistration(ctx, "app", "user", oldReq.ID,
+		func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error) {
+			require.NoError(t, s.StoreUserRequest(ctx, "app", "user", newReq))
+			return &plisskenserver.UserEnvelope{
+				SerializedOprvPrivateKey: req.SerializedClientOprvPrivateKey,
+			}, nil
+		})
+	require.ErrorIs(t, err, plisskenserver.ErrUserNotFound)
+
+	_, err = s.LoadUserEnvelope(ctx, "app", "user")
+	require.ErrorIs(t, err, plisskenserver.ErrUserNotFound, "no envelope must be stored")
+	req, err := s.LoadUserRequest(ctx, "app", "user")
+	require.NoError(t, err)
+	require.Equal(t, newReq, req, "the new request must be kept")
+}
+
+func listAll(t *testing.T, list func(cursor string) ([]string, string, error)) []string {
+	seen := map[string]bool{}
+	var ret []string
+	cursor := ""
+	for {
+		page, next, err := list(cursor)
+		require.NoError(t, err)
+		for _, str := range page {
+			if !seen[str] {
+				seen[str] = true
+				ret = append(ret, str)
+			}
+		}
+		if next == "" {
+			sort.Strings(ret)
+			return ret
+		}
+		cursor = next
+	}
+}
+
+func TestListing(t *testing.T) {
+	ctx := context.Background()
+	client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client}
+
+	// Key components are escaped: none of these users can collide
+	apptokens := []string{"app", "app:user", "{app}"}
+	usernames := []string{"user", "a:b", "user:envelope", "{tag}", "100%", "%3A"}
+	for _, apptoken := range apptokens {
+		require.NoError(t, s.StoreAppSecret(ctx, apptoken, "secret-"+apptoken))
+		for _, username := range usernames {
+			require.NoError(t, s.StoreUserEnvelope(ctx, apptoken, username,
+				&plisskenserver.UserEnvelope{PubU: []byte(apptoken + "/" + username)}))
+		}
+	}
+	for i := 0; i < 50; i++ {
+		require.NoError(t, s.StoreUserEnvelope(ctx, "app", fmt.Sprintf("user-%02d", i),
+			&plisskenserver.UserEnvelope{}))
+	}
+
+	want := append([]string(nil), apptokens...)
+	sort.Strings(want)
+	require.Equal(t, want, listAll(t, func(cursor string) ([]string, string, error) {
+		return s.ListAppTokens(ctx, cursor, 2)
+	}))
+	for _, apptoken := range apptokens[1:] {
+		want = append([]string(nil), usernames...)
+		sort.Strings(want)
+		require.Equal(t, want, listAll(t, func(cursor string) ([]string, string, error) {
+			return s.ListUsernames(ctx, apptoken, cursor, 2)
+		}))
+		for _, username := range usernames {
+			env, err := s.LoadUserEnvelope(ctx, apptoken, username)
+			require.NoError(t, err)
+			require.Equal(t, apptoken+"/"+username, string(env.PubU))
+		}
+	}
+	require.Len(t, listAll(t, func(cursor string) ([]string, string, error) {
+		return s.ListUsernames(ctx, "app", cursor, 10)
+	}), len(usernames)+50)
+
+	_, _, err := s.ListUsernames(ctx, "app", "not a cursor", 10)
+	require.Error(t, err)
+}
+
+func TestBuildIndexes(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client}
+
+	// Keys written before the indexes existed, and before escaping
+	m.Set("app_secrets:app:secret", "secret")
+	m.Set("reg:app:user:envelope", "{}")
+	m.Set("reg:app:a:b:envelope", "{}")
+	m.Set("reg:app:user:request", "{}")
+
+	require.NoError(t, s.BuildIndexes(ctx))
+	tokens, _, err := s.ListAppTokens(ctx, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, tokens)
+	require.Equal(t, []string{"a:b", "user"},
+		listAll(t, func(cursor string) ([]string, string, error) {
+			return s.ListUsernames(ctx, "app", cursor, 10)
+		}))
+
+	// Only the first call scans the keyspace
+	m.Set("app_secrets:other:secret", "secret")
+	require.NoError(t, s.BuildIndexes(ctx))
+	tokens, _, err = s.ListAppTokens(ctx, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, tokens)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client}
+
+	// Keys written before escaping
+	m.Set("app_secrets:app:secret", "secret")
+	m.Set("app_secrets:app:x:secret", "secret")
+	m.Set("app_secrets:{app}:secret", "secret")
+	m.Set("reg:app:bob:envelope", "bob")
+	m.Set("reg:app:a:b:envelope", "a:b")
+	// Its new name is the old name of "a:b"'s
+	m.Set("reg:app:a%3Ab:envelope", "a%3Ab")
+	m.Set("reg:{app}:c:envelope", "c")
+	m.Set("reg:app:a:b:request", "{}")
+	m.Set("tokens:app:a:b:token", "token")
+	m.Set("tokens:app:bob:token", "token")
+	m.SetTTL("tokens:app:bob:token", time.Hour)
+
+	require.NoError(t, s.MigrateKeys(ctx))
+	for key, val := range map[string]string{
+		"app_secrets:app:secret":       "secret",
+		"app_secrets:app%3Ax:secret":   "secret",
+		"app_secrets:%7Bapp%7D:secret": "secret",
+		"reg:app:bob:envelope":         "bob",
+		"reg:app:a%3Ab:envelope":       "a:b",
+		"reg:app:a%253Ab:envelope":     "a%3Ab",
+		"reg:%7Bapp%7D:c:envelope":     "c",
+	} {
+		got, err := m.Get(key)
+		require.NoError(t, err, key)
+		require.Equal(t, val, got, key)
+	}
+	require.Len(t, m.Keys(), 10, "old keys and pending registrations "+
+		"with escaped names must be gone: %v", m.Keys())
+	// Sessions are kept, and still expire
+	ok, err := s.HasSessionToken(ctx, "app", "bob", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s.HasSessionToken(ctx, "app", "a:b", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.InDelta(t, time.Hour, m.TTL("tokens:app:bob:tokens"), float64(time.Minute))
+
+	// Only the first call renames keys
+	m.Set("reg:app:d%:envelope", "d%")
+	require.NoError(t, s.MigrateKeys(ctx))
+	require.True(t, m.Exists("reg:app:d%:envelope"))
+
+	// Hash tags are added too
+	m = miniredis.RunT(t)
+	client = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	s = RedisWrapper{UniversalClient: client, HashTags: true}
+	m.Set("reg:app:bob:envelope", "bob")
+	m.Set("tokens:app:bob:token", "token")
+	require.NoError(t, s.MigrateKeys(ctx))
+	require.True(t, m.Exists("reg:{app:bob}:envelope"))
+	require.False(t, m.Exists("tokens:app:bob:token"))
+	require.True(t, m.Exists("tokens:{app:bob}:tokens"))
+
+	// Refuses to guess which app an envelope belongs to
+	m = miniredis.RunT(t)
+	client = redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	s = RedisWrapper{UniversalClient: client}
+	m.Set("app_secrets:app:secret", "secret")
+	m.Set("app_secrets:app:a:secret", "secret")
+	m.Set("reg:app:a:b:envelope", "a:b")
+	m.Set("reg:app:c%:envelope", "c%")
+	require.Error(t, s.MigrateKeys(ctx))
+	require.Error(t, s.BuildIndexes(ctx))
+	require.True(t, m.Exists("reg:app:c%:envelope"), "nothing is renamed")
+	require.False(t, m.Exists(redisKey_KeysMigrated))
+}
+
+func TestHashTags(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		client := redis.NewClient(&redis.Options{Addr: miniredis.RunT(t).Addr()})
+		t.Cleanup(func() { client.Close() })
+		return RedisWrapper{UniversalClient: client, HashTags: true}
+	})
+
+	ctx := context.Background()
+	m := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: m.Addr()})
+	defer client.Close()
+	s := RedisWrapper{UniversalClient: client, HashTags: true}
+	require.NoError(t, s.MigrateKeys(ctx))
+
+	require.NoError(t, s.StoreAppSecret(ctx, "app", "secret"))
+	require.NoError(t, s.StoreUserRequest(ctx, "app", "{a:b}",
+		&plisskenserver.UserRequest{SerializedClientOprvPrivateKey: []byte("k"), ID: []byte("id")}))
+	require.NoError(t, s.CompleteRegistration(ctx, "app", "{a:b}", []byte("id"),
+		func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error) {
+			return &plisskenserver.UserEnvelope{}, nil
+		}))
+	require.True(t, m.Exists("app_secrets:{app}:secret"))
+	require.True(t, m.Exists("reg:{app:%7Ba%3Ab%7D}:envelope"))
+	require.True(t, m.Exists("index:{app}:users"))
+
+	// Hash-tagged keys can be indexed too
+	m.Del("index:apps")
+	m.Del("index:{app}:users")
+	require.NoError(t, s.BuildIndexes(ctx))
+	tokens, _, err := s.ListAppTokens(ctx, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, tokens)
+	usernames, _, err := s.ListUsernames(ctx, "app", "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"{a:b}"}, usernames)
+}
+
+// crossSlotHook fails the transactions whose keys may be in several slots,
+// like a cluster does: miniredis serves all of them from a single node
+type crossSlotHook struct{}
+
+func (crossSlotHook) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (crossSlotHook) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	return nil
+}
+
+func (crossSlotHook) BeforeProcessPipeline(
+	ctx context.Context,
+	cmds []redis.Cmder) (context.Context, error) {
+	if len(cmds) < 2 || cmds[0].Name() != "multi" {
+		return ctx, nil
+	}
+	slotKey := ""
+	for _, cmd := range cmds[1 : len(cmds)-1] {
+		if len(cmd.Args()) < 2 {
+			continue
+		}
+		key := hashSlotKey(fmt.Sprint(cmd.Args()[1]))
+		if slotKey != "" && key != slotKey {
+			return ctx, fmt.Errorf("CROSSSLOT %q and %q", slotKey, key)
+		}
+		slotKey = key
+	}
+	return ctx, nil
+}
+
+func (crossSlotHook) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+// hashSlotKey is the part of 'key' that a cluster hashes to find its slot
+func hashSlotKey(key string) string {
+	start := strings.Index(key, "{")
+	if start < 0 {
+		return key
+	}
+	end := strings.Index(key[start+1:], "}")
+	if end <= 0 {
+		return key
+	}
+	return key[start+1 : start+1+end]
+}
+
+func newClusterClient(t *testing.T, addr string) *redis.ClusterClient {
+	client := redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs: []string{addr},
+		NewClient: func(opt *redis.Options) *redis.Client {
+			node := redis.NewClient(opt)
+			node.AddHook(crossSlotHook{})
+			return node
+		},
+	})
+	client.AddHook(crossSlotHook{})
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func TestCluster(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		client := newClusterClient(t, miniredis.RunT(t).Addr())
+		return RedisWrapper{UniversalClient: client, HashTags: true}
+	})
+
+	ctx := context.Background()
+	client := newClusterClient(t, miniredis.RunT(t).Addr())
+	_, err := client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, "a", "1", 0)
+		pipe.Set(ctx, "b", "1", 0)
+		return nil
+	})
+	require.Error(t, err, "transactions must not span slots")
+
+	s := RedisWrapper{UniversalClient: client, HashTags: true}
+	require.NoError(t, s.BuildIndexes(ctx))
+	require.NoError(t, s.StoreAppSecret(ctx, "app", "secret"))
+	require.NoError(t, s.StoreUserEnvelope(ctx, "app", "alice", &plisskenserver.UserEnvelope{}))
+	require.NoError(t, s.StoreUserRequest(ctx, "app", "bob",
+		&plisskenserver.UserRequest{ID: []byte("id")}))
+	require.NoError(t, s.CompleteRegistration(ctx, "app", "bob", []byte("id"),
+		func(req *plisskenserver.UserRequest) (*plisskenserver.UserEnvelope, error) {
+			return &plisskenserver.UserEnvelope{}, nil
+		}))
+	require.NoError(t, s.StoreSessionToken(ctx, "app", "bob", "token", time.Hour))
+	ok, err := s.HasSessionToken(ctx, "app", "bob", "token")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	tokens, _, err := s.ListAppTokens(ctx, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"app"}, tokens)
+	usernames, _, err := s.ListUsernames(ctx, "app", "", 10)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"alice", "bob"}, usernames)
+}
@@ -0,0 +1,112 @@
+// Package secrets resolves named secrets (server keys, app secrets, etc.) from
+// somewhere other than the auth-server's YAML config: environment variables,
+// files (e.g., Docker or Kubernetes secrets) or a HashiCorp Vault KV store.
+package secrets
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	ProviderEnv   = "env"
+	ProviderFile  = "file"
+	ProviderVault = "vault"
+)
+
+var ErrSecretNotFound = errors.New("secret not found")
+
+// Provider resolves a secret by name
+type Provider interface {
+	GetSecret(ctx context.Context, name string) ([]byte, error)
+}
+
+// Config selects and configures a Provider
+type Config struct {
+	// REQUIRED: One of 'env', 'file' or 'vault'
+	Provider string `yaml:"provider"`
+
+	// OPTIONAL (env): Prefix of the environment variables.
+	// Defaults to DefaultEnvPrefix
+	EnvPrefix string `yaml:"env-prefix"`
+
+	// REQUIRED (file): Directory holding one file per secret
+	Dir string `yaml:"dir"`
+
+	// REQUIRED (vault): Address of the Vault server.
+	// The token is read from the VAULT_TOKEN env var.
+	VaultAddr string `yaml:"vault-addr"`
+
+	// OPTIONAL (vault): Mount path of the KV v2 secrets engine.
+	// Defaults to 'secret'
+	VaultMount string `yaml:"vault-mount"`
+}
+
+// New makes the Provider described by 'cfg'
+func New(cfg Config) (Provider, error) {
+	switch cfg.Provider {
+	case ProviderEnv:
+		prefix := cfg.EnvPrefix
+		if prefix == "" {
+			prefix = DefaultEnvPrefix
+		}
+		return &EnvProvider{Prefix: prefix}, nil
+	case ProviderFile:
+		if cfg.Dir == "" {
+			return nil, errors.New("secrets.dir is empty")
+		}
+		return &FileProvider{Dir: cfg.Dir}, nil
+	case ProviderVault:
+		if cfg.VaultAddr == "" {
+			return nil, errors.New("secrets.vault-addr is empty")
+		}
+		token := os.Getenv("VAULT_TOKEN")
+		if token == "" {
+			return nil, errors.New("VAULT_TOKEN env var is empty")
+		}
+		return NewVaultProvider(cfg.VaultAddr, token, cfg.VaultMount), nil
+	default:
+		return nil, errors.Errorf("unknown secrets provider: '%s'", cfg.Provider)
+	}
+}
+
+const DefaultEnvPrefix = "PLISSKEN_SECRET_"
+
+// EnvProvider reads secrets from environment variables. A secret named
+// 'server-key' is read from $<Prefix>SERVER_KEY.
+type EnvProvider struct {
+	Prefix string
+}
+
+func (p *EnvProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	key := p.Prefix + strings.ToUpper(
+		strings.NewReplacer("-", "_", ".", "_", "/", "_").Replace(name))
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return nil, errors.Wrapf(ErrSecretNotFound, "env var %s", key)
+	}
+	return []byte(v), nil
+}
+
+// FileProvider reads each secret from a file named after it in Dir
+type FileProvider struct {
+	Dir string
+}
+
+func (p *FileProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	if name == "" || name != filepath.Base(name) {
+		return nil, errors.Errorf("bad secret name: '%s'", name)
+	}
+	b, err := os.ReadFile(filepath.Join(p.Dir, name))
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrSecretNotFound, "file %s", name)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return b, nil
+}
@@ -0,0 +1,85 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvProvider(t *testing.T) {
+	t.Setenv("PLISSKEN_SECRET_APP_SECRET_MY_APP", "bunnyfoofoo")
+	p := &EnvProvider{Prefix: DefaultEnvPrefix}
+
+	b, err := p.GetSecret(context.Background(), "app-secret.my-app")
+	require.NoError(t, err)
+	require.Equal(t, "bunnyfoofoo", string(b))
+
+	_, err = p.GetSecret(context.Background(), "nope")
+	require.True(t, errors.Is(err, ErrSecretNotFound))
+}
+
+func TestFileProvider(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "server-key"), []byte("bunnyfoofoo"), 0o600)
+	require.NoError(t, err)
+	p := &FileProvider{Dir: dir}
+
+	b, err := p.GetSecret(context.Background(), "server-key")
+	require.NoError(t, err)
+	require.Equal(t, "bunnyfoofoo", string(b))
+
+	_, err = p.GetSecret(context.Background(), "nope")
+	require.True(t, errors.Is(err, ErrSecretNotFound))
+	_, err = p.GetSecret(context.Background(), "../server-key")
+	require.Error(t, err)
+}
+
+func TestVaultProvider(t *testing.T) {
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.testtoken" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path != "/v1/kv/data/plissken/server" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		resp := map[string]interface{}{
+			"data": map[string]interface{}{
+				"data": map[string]interface{}{
+					"key":   "bunnyfoofoo",
+					"value": "truebeef",
+				},
+				"metadata": map[string]interface{}{"version": 3},
+			},
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer stub.Close()
+
+	p := NewVaultProvider(stub.URL, "s.testtoken", "kv")
+	b, err := p.GetSecret(context.Background(), "plissken/server#key")
+	require.NoError(t, err)
+	require.Equal(t, "bunnyfoofoo", string(b))
+
+	b, err = p.GetSecret(context.Background(), "plissken/server")
+	require.NoError(t, err)
+	require.Equal(t, "truebeef", string(b))
+
+	_, err = p.GetSecret(context.Background(), "plissken/server#nope")
+	require.True(t, errors.Is(err, ErrSecretNotFound))
+	_, err = p.GetSecret(context.Background(), "plissken/nope")
+	require.True(t, errors.Is(err, ErrSecretNotFound))
+
+	p.Token = "s.badtoken"
+	_, err = p.GetSecret(context.Background(), "plissken/server#key")
+	require.Error(t, err)
+	require.False(t, errors.Is(err, ErrSecretNotFound))
+}
@@ -0,0 +1,101 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const defaultVaultMount = "secret"
+
+// VaultProvider reads secrets from a HashiCorp Vault KV version 2 secrets
+// engine over its HTTP API.
+//
+// Secret names are "<path>#<field>", e.g. "plissken/server#key". If '#<field>'
+// is omitted, the "value" field is used.
+type VaultProvider struct {
+	Addr       string
+	Token      string
+	Mount      string
+	HTTPClient *http.Client
+}
+
+func NewVaultProvider(addr, token, mount string) *VaultProvider {
+	if mount == "" {
+		mount = defaultVaultMount
+	}
+	return &VaultProvider{
+		Addr:       strings.TrimRight(addr, "/"),
+		Token:      token,
+		Mount:      strings.Trim(mount, "/"),
+		HTTPClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type vaultKVv2Response struct {
+	Data struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+func (p *VaultProvider) GetSecret(ctx context.Context, name string) ([]byte, error) {
+	path, field := name, "value"
+	if i := strings.LastIndex(name, "#"); i != -1 {
+		path, field = name[:i], name[i+1:]
+	}
+	path = strings.Trim(path, "/")
+	if path == "" || field == "" {
+		return nil, errors.Errorf("bad secret name: '%s'", name)
+	}
+
+	u := fmt.Sprintf("%s/v1/%s/data/%s", p.Addr,
+		url.PathEscape(p.Mount), escapePath(path))
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	req.Header.Set("X-Vault-Token", p.Token)
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errors.Wrapf(ErrSecretNotFound, "vault path %s", path)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf(
+			"unexpected status code from vault for %s: %d", path, resp.StatusCode)
+	}
+
+	typedResp := &vaultKVv2Response{}
+	err = json.NewDecoder(resp.Body).Decode(typedResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	v, ok := typedResp.Data.Data[field]
+	if !ok {
+		return nil, errors.Wrapf(ErrSecretNotFound,
+			"field %s in vault path %s", field, path)
+	}
+	str, ok := v.(string)
+	if !ok {
+		return nil, errors.Errorf(
+			"field %s in vault path %s is not a string", field, path)
+	}
+	return []byte(str), nil
+}
+
+func escapePath(path string) string {
+	parts := strings.Split(path, "/")
+	for i := range parts {
+		parts[i] = url.PathEscape(parts[i])
+	}
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,33 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"time"
+
+	"github.com/afjoseph/plissken-protocol/accesstoken"
+	"github.com/pkg/errors"
+)
+
+// AccessTokenIssuer signs an access token on every login: see package
+// accesstoken. Resource servers check them with the public part of 'Key'.
+type AccessTokenIssuer struct {
+	Key    ed25519.PrivateKey
+	TTL    time.Duration
+	Issuer string
+}
+
+// issue signs a token for 'username', valid from 'now'
+func (i *AccessTokenIssuer) issue(apptoken, username string, now time.Time) (string, time.Time, error) {
+	expiresAt := now.Add(i.TTL)
+	token, err := accesstoken.Sign(i.Key, &accesstoken.Claims{
+		Issuer:    i.Issuer,
+		Subject:   username,
+		Audience:  apptoken,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: expiresAt.Unix(),
+	})
+	if err != nil {
+		return "", time.Time{}, errors.Wrap(err, "")
+	}
+	return token, expiresAt, nil
+}
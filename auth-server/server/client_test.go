@@ -0,0 +1,512 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/memstore"
+	"github.com/afjoseph/plissken-protocol/accesstoken"
+	plisskenclient "github.com/afjoseph/plissken-protocol/client"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/plisskenmw"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+const testAppToken = "testAppToken"
+
+// hostForTest serves 'store' with the keys of 'keyring' on a random port.
+// 'accessTokens' is optional.
+func hostForTest(
+	t *testing.T,
+	keyring *plisskenserver.Keyring,
+	store Store,
+	accessTokens *AccessTokenIssuer,
+	opts ...plisskenserver.Option,
+) string {
+	srv, err := Host(keyring, nil, "127.0.0.1:0", false, "test", "test", store, accessTokens, nil, nil, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return "http://127.0.0.1:" + srv.Port
+}
+
+// newTestKeyring returns a keyring of 'n' random keys and their public keys
+func newTestKeyring(t testing.TB, n int) (*plisskenserver.Keyring, []x25519.Key) {
+	keyring := plisskenserver.NewKeyring()
+	pubKeys := []x25519.Key{}
+	for i := 0; i < n; i++ {
+		key, err := keyring.Add("", nil)
+		require.NoError(t, err)
+		pubKeys = append(pubKeys, key.Pub)
+	}
+	return keyring, pubKeys
+}
+
+func TestHTTPClient(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	keyring, pubKeys := newTestKeyring(t, 1)
+	endpoint := hostForTest(t, keyring, store, nil)
+	client := plisskenclient.NewHTTPClient(endpoint+"/", pubKeys...)
+
+	err := client.Register(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	err = client.Register(ctx, testAppToken, "bob", "hunter3")
+	require.True(t, errors.Is(err, plisskenserver.ErrUserExists), err)
+	var problem *plisskenclient.ProblemError
+	require.True(t, errors.As(err, &problem))
+	require.Equal(t, ErrCodeUserExists, problem.Code)
+	require.NotEmpty(t, problem.RequestID)
+
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	require.Equal(t, "bob", session.Username)
+	require.Len(t, session.Token, plisskenserver.DefaultSessionTokenLength)
+	ok, err := store.HasSessionToken(ctx, testAppToken, "bob", session.HexToken())
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	_, err = client.Login(ctx, testAppToken, "bob", "hunter3")
+	require.True(t, errors.Is(err, plisskenclient.ErrWrongPassword), err)
+	_, err = client.Login(ctx, testAppToken, "alice", "hunter2")
+	require.True(t, errors.Is(err, plisskenserver.ErrUserNotFound), err)
+
+	// Someone else's server
+	_, otherPubKeys := newTestKeyring(t, 1)
+	_, err = plisskenclient.NewHTTPClient(endpoint, otherPubKeys...).
+		Login(ctx, testAppToken, "bob", "hunter2")
+	require.True(t, errors.Is(err, plisskenclient.ErrUntrustedServerKey), err)
+}
+
+func TestHTTPClientKeyRotation(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	keyring, pubKeys := newTestKeyring(t, 2)
+
+	// Register with the old key only
+	oldKeyring := plisskenserver.NewKeyring()
+	oldKey, _ := keyring.Get("")
+	_, err := oldKeyring.Add(oldKey.ID, oldKey.PrivateKey())
+	require.NoError(t, err)
+	err = plisskenclient.NewHTTPClient(hostForTest(t, oldKeyring, store, nil), pubKeys[0]).
+		Register(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+
+	endpoint := hostForTest(t, keyring, store, nil)
+	// The new key isn't pinned: don't migrate to it
+	_, err = plisskenclient.NewHTTPClient(endpoint, pubKeys[0]).
+		Login(ctx, testAppToken, "bob", "hunter2")
+	require.True(t, errors.Is(err, plisskenclient.ErrUntrustedServerKey), err)
+
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	_, err = client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	env, err := store.LoadUserEnvelope(ctx, testAppToken, "bob")
+	require.NoError(t, err)
+	require.Equal(t, keyring.Current().ID, env.KeyID)
+
+	// Migrated: the old key isn't needed anymore
+	_, err = plisskenclient.NewHTTPClient(endpoint, pubKeys[1]).
+		Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+
+	// New users are sealed for the server's current key, even if the client
+	// still lists the old one first, and only if it's pinned
+	err = plisskenclient.NewHTTPClient(endpoint, pubKeys[0]).
+		Register(ctx, testAppToken, "alice", "hunter2")
+	require.True(t, errors.Is(err, plisskenclient.ErrUntrustedServerKey), err)
+	require.NoError(t, client.Register(ctx, testAppToken, "alice", "hunter2"))
+	env, err = store.LoadUserEnvelope(ctx, testAppToken, "alice")
+	require.NoError(t, err)
+	require.Equal(t, keyring.Current().ID, env.KeyID)
+	_, err = plisskenclient.NewHTTPClient(endpoint, pubKeys[1]).
+		Login(ctx, testAppToken, "alice", "hunter2")
+	require.NoError(t, err)
+}
+
+func TestAccessTokensAndMiddleware(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	signingPubKey, signingKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	endpoint := hostForTest(t, keyring, store, &AccessTokenIssuer{
+		Key: signingKey,
+		TTL: time.Minute,
+	})
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	require.NoError(t, client.Register(ctx, testAppToken, "bob", "hunter2"))
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	require.NotEmpty(t, session.AccessToken)
+	require.WithinDuration(t, time.Now().Add(time.Minute), session.AccessTokenExpiresAt, 5*time.Second)
+
+	auth, err := plisskenmw.New(plisskenmw.Config{
+		AppToken:             testAppToken,
+		AuthEndpoint:         endpoint,
+		AppSecret:            "my-secret",
+		AccessTokenPublicKey: signingPubKey,
+	})
+	require.NoError(t, err)
+	for _, cred := range []string{
+		session.BearerToken(),
+		plisskencommon.EncodeSessionCredential(session.Username, session.Token),
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+cred)
+		id, err := auth.Authenticate(r)
+		require.NoError(t, err)
+		require.Equal(t, "bob", id.Username)
+		require.Equal(t, testAppToken, id.AppToken)
+	}
+}
+
+func TestClock(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	signingPubKey, signingKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	now := time.Unix(1650000000, 0)
+	clock := func() time.Time { return now }
+	endpoint := hostForTest(t, keyring, store,
+		&AccessTokenIssuer{Key: signingKey, TTL: time.Minute},
+		plisskenserver.WithClock(clock))
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	client.Config.Now = clock
+	require.NoError(t, client.Register(ctx, testAppToken, "bob", "hunter2"))
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	require.Equal(t, now.Add(time.Minute), session.AccessTokenExpiresAt)
+	claims, err := accesstoken.Verify(signingPubKey, session.AccessToken, now)
+	require.NoError(t, err)
+	require.Equal(t, now.Unix(), claims.IssuedAt)
+
+	req, err := http.NewRequest(http.MethodGet, endpoint+"/check-credentials?"+
+		url.Values{"apptoken": {testAppToken}, "appsecret": {"my-secret"}}.Encode(), nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+
+		plisskencommon.EncodeSessionCredential("bob", session.Token))
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	var creds CheckCredentialsResponseData
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&creds))
+	require.Equal(t, now.Unix(), creds.CreatedAt)
+	require.Equal(t, now.Add(defaultExpiryDuration).Unix(), creds.ExpiresAt)
+
+	// Expired access tokens fall back to the session credential
+	require.Equal(t, session.AccessToken, session.BearerToken())
+	now = now.Add(time.Minute)
+	require.Equal(t,
+		plisskencommon.EncodeSessionCredential("bob", session.Token),
+		session.BearerToken())
+}
+
+func TestSessionCookies(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	srv, err := Host(keyring, []string{"https://app.example.com"}, "127.0.0.1:0",
+		false, "test", "test", store, nil,
+		&SessionCookie{Path: "/", SameSite: http.SameSiteLaxMode, Insecure: true}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	endpoint := "http://127.0.0.1:" + srv.Port
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	client.HTTPClient = &http.Client{Jar: jar}
+	client.SessionCookie = true
+	require.NoError(t, client.Register(ctx, testAppToken, "bob", "hunter2"))
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	require.NotEmpty(t, session.CSRFToken)
+
+	// The jar got both cookies
+	u, err := url.Parse(endpoint)
+	require.NoError(t, err)
+	cookies := map[string]string{}
+	for _, cookie := range jar.Cookies(u) {
+		cookies[cookie.Name] = cookie.Value
+	}
+	cred := plisskencommon.EncodeSessionCredential(session.Username, session.Token)
+	require.Equal(t, cred, cookies[plisskencommon.SessionCookieName])
+	require.Equal(t, session.CSRFToken, cookies[plisskencommon.CSRFCookieName])
+
+	// A resource server gets them and the CSRF header
+	auth, err := plisskenmw.New(plisskenmw.Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: endpoint,
+		AppSecret:    "my-secret",
+	})
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	for name, value := range cookies {
+		r.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+	_, err = auth.Authenticate(r)
+	require.True(t, errors.Is(err, plisskenmw.ErrCSRF), err)
+	r.Header.Set(plisskencommon.CSRFHeaderName, session.CSRFToken)
+	id, err := auth.Authenticate(r)
+	require.NoError(t, err)
+	require.Equal(t, "bob", id.Username)
+
+	// Logging out with a bearer credential leaves the cookies alone
+	req, err := http.NewRequest(http.MethodPost, endpoint+"/logout",
+		strings.NewReader(`{"apptoken":"`+testAppToken+`"}`))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+plisskencommon.EncodeSessionCredential("bob",
+		bytes.Repeat([]byte{1}, plisskenserver.DefaultSessionTokenLength)))
+	resp, err := client.HTTPClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Len(t, jar.Cookies(u), 2)
+
+	// Logging out by cookie needs the CSRF header too, and drops the cookies
+	logout := func(csrfToken string) int {
+		req, err := http.NewRequest(http.MethodPost, endpoint+"/logout",
+			strings.NewReader(`{"apptoken":"`+testAppToken+`"}`))
+		require.NoError(t, err)
+		if csrfToken != "" {
+			req.Header.Set(plisskencommon.CSRFHeaderName, csrfToken)
+		}
+		resp, err := client.HTTPClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusForbidden, logout(""))
+	require.Equal(t, http.StatusOK, logout(session.CSRFToken))
+	require.Empty(t, jar.Cookies(u))
+	auth, err = plisskenmw.New(plisskenmw.Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: endpoint,
+		AppSecret:    "my-secret",
+		CacheTTL:     -1,
+	})
+	require.NoError(t, err)
+	_, err = auth.Authenticate(r)
+	require.True(t, errors.Is(err, plisskenmw.ErrUnauthenticated), err)
+
+	// Servers without session cookies refuse to set them
+	_, err = client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	client.Endpoint = hostForTest(t, keyring, store, nil)
+	_, err = client.Login(ctx, testAppToken, "bob", "hunter2")
+	var problem *plisskenclient.ProblemError
+	require.True(t, errors.As(err, &problem), err)
+	require.Equal(t, http.StatusBadRequest, problem.StatusCode)
+}
+
+func TestCheckCredentials(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	endpoint := hostForTest(t, keyring, store, nil)
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	require.NoError(t, client.Register(ctx, testAppToken, "bob", "hunter2"))
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+
+	check := func(query url.Values, authz string) int {
+		req, err := http.NewRequest(http.MethodGet,
+			endpoint+"/check-credentials?"+query.Encode(), nil)
+		require.NoError(t, err)
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	app := url.Values{"apptoken": {testAppToken}, "appsecret": {"my-secret"}}
+	bearer := "Bearer " + plisskencommon.EncodeSessionCredential("bob", session.Token)
+	require.Equal(t, http.StatusOK, check(app, bearer))
+	require.Equal(t, http.StatusUnauthorized, check(app, "Bearer "+
+		plisskencommon.EncodeSessionCredential("alice", session.Token)))
+	require.Equal(t, http.StatusUnauthorized, check(app, "Bearer garbage"))
+	require.Equal(t, http.StatusBadRequest, check(app, "Basic Ym9iOmh1bnRlcjI="))
+	require.Equal(t, http.StatusUnauthorized, check(
+		url.Values{"apptoken": {testAppToken}, "appsecret": {"wrong"}}, bearer))
+
+	// Still accepted in the query
+	legacy := url.Values{
+		"apptoken":      {testAppToken},
+		"appsecret":     {"my-secret"},
+		"username":      {"bob"},
+		"session_token": {session.HexToken()},
+	}
+	require.Equal(t, http.StatusOK, check(legacy, ""))
+}
+
+func TestLogout(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	endpoint := hostForTest(t, keyring, store, nil)
+	client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+	require.NoError(t, client.Register(ctx, testAppToken, "bob", "hunter2"))
+	auth, err := plisskenmw.New(plisskenmw.Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: endpoint,
+		AppSecret:    "my-secret",
+		CacheTTL:     -1,
+	})
+	require.NoError(t, err)
+	isValid := func(session *plisskenclient.Session) bool {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Authorization", "Bearer "+session.BearerToken())
+		_, err := auth.Authenticate(r)
+		return err == nil
+	}
+
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	require.NoError(t, err)
+	require.True(t, isValid(session))
+	require.NoError(t, client.Logout(ctx, session))
+	require.False(t, isValid(session))
+	// Ending an ended session is fine
+	require.NoError(t, client.Logout(ctx, session))
+
+	// ...but ending all sessions needs a valid one
+	err = client.LogoutAll(ctx, session)
+	require.True(t, errors.Is(err, plisskenserver.ErrInvalidToken), err)
+
+	// Users can be logged in several times: logging out ends one session
+	sessions := make([]*plisskenclient.Session, 3)
+	for i := range sessions {
+		sessions[i], err = client.Login(ctx, testAppToken, "bob", "hunter2")
+		require.NoError(t, err)
+	}
+	for _, session := range sessions {
+		require.True(t, isValid(session))
+	}
+	require.NoError(t, client.Logout(ctx, sessions[0]))
+	require.False(t, isValid(sessions[0]))
+	require.True(t, isValid(sessions[1]))
+	require.True(t, isValid(sessions[2]))
+	require.NoError(t, client.LogoutAll(ctx, sessions[1]))
+	require.False(t, isValid(sessions[1]))
+	require.False(t, isValid(sessions[2]))
+}
+
+// finalizeLoginRewriter changes the /finalize_password_authentication
+// requests of a client with 'rewrite'
+type finalizeLoginRewriter struct {
+	rewrite func(req *plisskencommon.FinalizePasswordAuthData)
+}
+
+func (r finalizeLoginRewriter) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Path != "/finalize_password_authentication" {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	var data plisskencommon.FinalizePasswordAuthData
+	err := json.NewDecoder(req.Body).Decode(&data)
+	req.Body.Close()
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	r.rewrite(&data)
+	body, err := json.Marshal(&data)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	req = req.Clone(req.Context())
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestFinalizeLogin(t *testing.T) {
+	ctx := context.Background()
+	store := memstore.New()
+	require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "my-secret"))
+	keyring, pubKeys := newTestKeyring(t, 1)
+	endpoint := hostForTest(t, keyring, store, nil)
+	require.NoError(t, plisskenclient.NewHTTPClient(endpoint, pubKeys...).
+		Register(ctx, testAppToken, "bob", "hunter2"))
+	login := func(rewrite func(req *plisskencommon.FinalizePasswordAuthData)) (
+		*plisskenclient.Session, error) {
+		client := plisskenclient.NewHTTPClient(endpoint, pubKeys...)
+		client.HTTPClient = &http.Client{Transport: finalizeLoginRewriter{rewrite}}
+		return client.Login(ctx, testAppToken, "bob", "hunter2")
+	}
+
+	// Session tokens are hex: their case doesn't matter
+	session, err := login(func(req *plisskencommon.FinalizePasswordAuthData) {
+		req.SessionToken = strings.ToUpper(req.SessionToken)
+	})
+	require.NoError(t, err)
+	ok, err := store.HasSessionToken(ctx, testAppToken, "bob",
+		hex.EncodeToString(session.Token))
+	require.NoError(t, err)
+	require.True(t, ok, "the session must be stored like its credential encodes it")
+
+	// A re-sealed envelope that can't be one is the client's fault
+	_, err = login(func(req *plisskencommon.FinalizePasswordAuthData) {
+		req.EnvU = "00"
+		req.EnvUNonce = strings.Repeat("00", plisskencommon.EnvUNonceSize)
+	})
+	var problem *plisskenclient.ProblemError
+	require.True(t, errors.As(err, &problem), err)
+	require.Equal(t, http.StatusBadRequest, problem.StatusCode)
+	require.Equal(t, ErrCodeBadRequest, problem.Code)
+}
+
+// envelopeErrorStore fails to load envelopes with 'err'
+type envelopeErrorStore struct {
+	Store
+	err error
+}
+
+func (s envelopeErrorStore) LoadUserEnvelope(
+	ctx context.Context,
+	apptoken, username string) (*plisskenserver.UserEnvelope, error) {
+	return nil, s.err
+}
+
+func TestRegisterStorageErrors(t *testing.T) {
+	ctx := context.Background()
+	keyring, pubKeys := newTestKeyring(t, 1)
+	for _, tc := range []struct {
+		err    error
+		status int
+		code   string
+	}{
+		{plisskenserver.StorageUnavailable(context.DeadlineExceeded),
+			http.StatusServiceUnavailable, ErrCodeStorageUnavailable},
+		{errors.New("corrupted envelope"),
+			http.StatusInternalServerError, ErrCodeInternal},
+	} {
+		store := envelopeErrorStore{Store: memstore.New(), err: tc.err}
+		err := plisskenclient.NewHTTPClient(hostForTest(t, keyring, store, nil), pubKeys...).
+			Register(ctx, testAppToken, "bob", "hunter2")
+		var problem *plisskenclient.ProblemError
+		require.True(t, errors.As(err, &problem), err)
+		require.Equal(t, tc.status, problem.StatusCode, tc.err.Error())
+		require.Equal(t, tc.code, problem.Code, tc.err.Error())
+	}
+}
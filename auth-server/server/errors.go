@@ -0,0 +1,155 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/afjoseph/plissken-auth-server/logging"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/plisskenmw"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+)
+
+// Machine-readable codes sent in the "code" field of error responses. They're
+// part of the API: don't change them.
+const (
+	ErrCodeBadRequest         = "bad_request"
+	ErrCodeNotFound           = "not_found"
+	ErrCodeUserNotFound       = "user_not_found"
+	ErrCodeUserExists         = "user_exists"
+	ErrCodeNonceNotFound      = "nonce_not_found"
+	ErrCodeInvalidToken       = "invalid_token"
+	ErrCodeInvalidAppSecret   = "invalid_app_secret"
+	ErrCodeCSRF               = "csrf_failed"
+	ErrCodeStorageUnavailable = "storage_unavailable"
+	ErrCodeInternal           = "internal_error"
+)
+
+// ProblemContentType is the content type of error responses (RFC 9457)
+const ProblemContentType = "application/problem+json"
+
+// ProblemTypePrefix prefixes the code in a problem's "type" URI
+const ProblemTypePrefix = "urn:plissken:problem:"
+
+var problemTitles = map[string]string{
+	ErrCodeBadRequest:         "Malformed request",
+	ErrCodeNotFound:           "No such endpoint",
+	ErrCodeUserNotFound:       "User not found",
+	ErrCodeUserExists:         "User already exists",
+	ErrCodeNonceNotFound:      "Unknown or expired login attempt",
+	ErrCodeInvalidToken:       "Invalid session token",
+	ErrCodeInvalidAppSecret:   "Invalid app secret",
+	ErrCodeCSRF:               "Missing or bad CSRF token",
+	ErrCodeStorageUnavailable: "Storage unavailable",
+	ErrCodeInternal:           "Internal server error",
+}
+
+// errInvalidAppSecret is only used by the auth-server: the protocol doesn't
+// know about app secrets
+var errInvalidAppSecret = errors.New("invalid app secret")
+
+// Problem is the body of every error response: an RFC 9457 problem document,
+// extended with a stable 'code' (also the suffix of 'type') and the request's
+// ID.
+type Problem struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Status    int    `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Instance  string `json:"instance,omitempty"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func newProblem(c *gin.Context, status int, code, detail string) *Problem {
+	return &Problem{
+		Type:      ProblemTypePrefix + code,
+		Title:     problemTitles[code],
+		Status:    status,
+		Detail:    detail,
+		Instance:  c.Request.URL.Path,
+		Code:      code,
+		RequestID: c.Writer.Header().Get(logging.RequestIDHeader),
+	}
+}
+
+// statusAndCode maps an error to the HTTP status and code describing it best.
+// Errors matching none of the known ones get 'fallbackStatus'.
+func statusAndCode(err error, fallbackStatus int) (int, string) {
+	switch {
+	case errors.Is(err, plisskenserver.ErrUserNotFound):
+		return http.StatusNotFound, ErrCodeUserNotFound
+	case errors.Is(err, plisskenserver.ErrUserExists):
+		return http.StatusConflict, ErrCodeUserExists
+	case errors.Is(err, plisskenserver.ErrNonceNotFound):
+		return http.StatusUnauthorized, ErrCodeNonceNotFound
+	case errors.Is(err, plisskenserver.ErrInvalidToken):
+		return http.StatusUnauthorized, ErrCodeInvalidToken
+	case errors.Is(err, errInvalidAppSecret):
+		return http.StatusUnauthorized, ErrCodeInvalidAppSecret
+	case errors.Is(err, plisskenmw.ErrCSRF):
+		return http.StatusForbidden, ErrCodeCSRF
+	case errors.Is(err, plisskenserver.ErrStorageUnavailable):
+		return http.StatusServiceUnavailable, ErrCodeStorageUnavailable
+	case errors.Is(err, plisskencommon.ErrInvalidMessage):
+		return http.StatusBadRequest, ErrCodeBadRequest
+	case fallbackStatus == http.StatusBadRequest:
+		return http.StatusBadRequest, ErrCodeBadRequest
+	default:
+		return fallbackStatus, ErrCodeInternal
+	}
+}
+
+// abortWithError aborts the request with the status and code matching 'err',
+// or 'fallbackStatus' if nothing matches. 'detail' is shown to the client;
+// 'err' is only logged. The response is written by handleErrors.
+func abortWithError(c *gin.Context, fallbackStatus int, err error, detail string) {
+	status, code := statusAndCode(err, fallbackStatus)
+	// Unlike c.AbortWithError(), don't write the headers yet
+	c.Abort()
+	c.Status(status)
+	c.Error(err).
+		SetType(gin.ErrorTypePublic).
+		SetMeta(newProblem(c, status, code, detail))
+}
+
+func writeProblem(c *gin.Context, p *Problem) {
+	c.Header("Content-Type", ProblemContentType)
+	c.JSON(p.Status, p)
+}
+
+// handleErrors logs every error of the request and, if a handler called
+// abortWithError, writes the last one as a problem document
+func handleErrors(c *gin.Context) {
+	c.Next() // execute all the handlers
+	logger := logging.FromContext(c.Request.Context())
+	for _, appErr := range c.Errors {
+		logger.WithError(appErr.Err).Error("Error occurred")
+	}
+	publicErr := c.Errors.ByType(gin.ErrorTypePublic).Last()
+	if publicErr == nil || c.Writer.Written() {
+		return
+	}
+	p, ok := publicErr.Meta.(*Problem)
+	if !ok {
+		status, code := statusAndCode(publicErr.Err, c.Writer.Status())
+		p = newProblem(c, status, code, "")
+	}
+	writeProblem(c, p)
+}
+
+// handleNoRoute answers requests to unknown endpoints
+func handleNoRoute(c *gin.Context) {
+	writeProblem(c, newProblem(c, http.StatusNotFound, ErrCodeNotFound, ""))
+}
+
+// handlePanic answers requests whose handler panicked. It runs outside of
+// handleErrors, so it writes the problem itself.
+func handlePanic(c *gin.Context, recovered interface{}) {
+	logging.FromContext(c.Request.Context()).
+		Errorf("Recovered from panic: %v", recovered)
+	c.Abort()
+	writeProblem(c, newProblem(
+		c, http.StatusInternalServerError, ErrCodeInternal, ""))
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/afjoseph/plissken-auth-server/logging"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/gin-gonic/gin"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusAndCode(t *testing.T) {
+	for _, tc := range []struct {
+		err            error
+		fallbackStatus int
+		status         int
+		code           string
+	}{
+		{errors.Wrap(plisskenserver.ErrUserNotFound, ""), http.StatusBadRequest, http.StatusNotFound, ErrCodeUserNotFound},
+		{plisskenserver.ErrUserExists, http.StatusForbidden, http.StatusConflict, ErrCodeUserExists},
+		{errors.Wrap(plisskenserver.ErrNonceNotFound, ""), http.StatusBadRequest, http.StatusUnauthorized, ErrCodeNonceNotFound},
+		{errors.Wrap(plisskenserver.ErrInvalidToken, ""), http.StatusBadRequest, http.StatusUnauthorized, ErrCodeInvalidToken},
+		{errInvalidAppSecret, http.StatusUnauthorized, http.StatusUnauthorized, ErrCodeInvalidAppSecret},
+		{errors.Wrap(plisskenserver.StorageUnavailable(context.DeadlineExceeded), ""), http.StatusInternalServerError, http.StatusServiceUnavailable, ErrCodeStorageUnavailable},
+		{errors.New("bad hex"), http.StatusBadRequest, http.StatusBadRequest, ErrCodeBadRequest},
+		{errors.Wrap(plisskencommon.CheckSize("envu", nil, plisskencommon.EnvUSize), ""), http.StatusInternalServerError, http.StatusBadRequest, ErrCodeBadRequest},
+		{errors.New("boom"), http.StatusInternalServerError, http.StatusInternalServerError, ErrCodeInternal},
+	} {
+		status, code := statusAndCode(tc.err, tc.fallbackStatus)
+		require.Equal(t, tc.status, status, tc.err.Error())
+		require.Equal(t, tc.code, code, tc.err.Error())
+	}
+}
+
+func TestProblemResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(logging.Middleware(), gin.CustomRecovery(handlePanic), handleErrors)
+	router.GET("/user", func(c *gin.Context) {
+		abortWithError(c, http.StatusBadRequest,
+			errors.Wrap(plisskenserver.ErrUserNotFound, ""), "no such user")
+	})
+	router.GET("/panic", func(c *gin.Context) { panic("oops") })
+	router.NoRoute(handleNoRoute)
+
+	for _, tc := range []struct {
+		path   string
+		status int
+		code   string
+		detail string
+	}{
+		{"/user", http.StatusNotFound, ErrCodeUserNotFound, "no such user"},
+		{"/panic", http.StatusInternalServerError, ErrCodeInternal, ""},
+		{"/nope", http.StatusNotFound, ErrCodeNotFound, ""},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		require.Equal(t, tc.status, w.Code, tc.path)
+		require.Equal(t, ProblemContentType, w.Header().Get("Content-Type"), tc.path)
+
+		var p Problem
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &p), tc.path)
+		require.Equal(t, Problem{
+			Type:      ProblemTypePrefix + tc.code,
+			Title:     problemTitles[tc.code],
+			Status:    tc.status,
+			Detail:    tc.detail,
+			Instance:  tc.path,
+			Code:      tc.code,
+			RequestID: w.Header().Get(logging.RequestIDHeader),
+		}, p)
+		require.NotEmpty(t, p.RequestID)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/afjoseph/plissken-auth-server/memstore"
+	plisskenclient "github.com/afjoseph/plissken-protocol/client"
+	"github.com/sirupsen/logrus"
+)
+
+// fuzzRoutes are the routes FuzzHandlers picks from. GET routes get the body
+// as their query.
+var fuzzRoutes = []struct {
+	method string
+	path   string
+}{
+	{http.MethodPost, "/start_password_registration"},
+	{http.MethodPost, "/finalize_password_registration"},
+	{http.MethodPost, "/start_password_authentication"},
+	{http.MethodPost, "/finalize_password_authentication"},
+	{http.MethodPost, "/logout"},
+	{http.MethodPost, "/logout_all"},
+	{http.MethodGet, "/check-credentials"},
+}
+
+// FuzzHandlers sends arbitrary requests to every route of a server with a
+// logged-in user, access tokens and session cookies. Handlers may reject them,
+// but never with a 5xx: panics are recovered as 500s. Seeds are in
+// testdata/fuzz.
+func FuzzHandlers(f *testing.F) {
+	ctx := context.Background()
+	logrus.SetOutput(io.Discard)
+	f.Cleanup(func() { logrus.SetOutput(os.Stderr) })
+
+	store := memstore.New()
+	if err := store.StoreAppSecret(ctx, testAppToken, "my-secret"); err != nil {
+		f.Fatal(err)
+	}
+	keyring, pubKeys := newTestKeyring(f, 1)
+	_, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	srv, err := Host(keyring, []string{"https://app.example"}, "127.0.0.1:0",
+		false, "test", "test", store,
+		&AccessTokenIssuer{Key: signingKey, TTL: time.Minute},
+		&SessionCookie{Path: "/", SameSite: http.SameSiteLaxMode}, nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Cleanup(func() { srv.Shutdown(ctx) })
+	client := plisskenclient.NewHTTPClient("http://127.0.0.1:"+srv.Port, pubKeys...)
+	if err := client.Register(ctx, testAppToken, "bob", "hunter2"); err != nil {
+		f.Fatal(err)
+	}
+	session, err := client.Login(ctx, testAppToken, "bob", "hunter2")
+	if err != nil {
+		f.Fatal(err)
+	}
+	// The session is random: the checked-in seeds can't have it
+	for i := range fuzzRoutes {
+		f.Add(uint8(i), "Bearer "+session.BearerToken(), "",
+			[]byte(`{"apptoken":"`+testAppToken+`"}`))
+	}
+
+	handler := srv.HttpServer.Handler
+	f.Fuzz(func(t *testing.T, route uint8, authorization, cookie string, body []byte) {
+		r := fuzzRoutes[int(route)%len(fuzzRoutes)]
+		req := httptest.NewRequest(r.method, r.path, bytes.NewReader(body))
+		if r.method == http.MethodGet {
+			req.URL.RawQuery = string(body)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		if cookie != "" {
+			req.Header.Set("Cookie", cookie)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if rec.Code >= 500 {
+			t.Fatalf("%s %s answered %d: %s", r.method, r.path, rec.Code, rec.Body)
+		}
+	})
+}
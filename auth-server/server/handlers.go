@@ -4,11 +4,13 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net/http"
-	"net/http/httputil"
 	"strings"
 	"time"
 
+	"github.com/afjoseph/plissken-auth-server/logging"
 	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/plisskenmw"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
 	"github.com/pkg/errors"
@@ -17,20 +19,8 @@ import (
 
 const defaultExpiryDuration = 15 * time.Minute
 
-func handleErrors(c *gin.Context) {
-	c.Next() // execute all the handlers
-	for _, appErr := range c.Errors {
-		logrus.Errorf("Error occurred: %v", appErr.Err)
-	}
-	errorToPrint := c.Errors.ByType(gin.ErrorTypePublic).Last()
-	if errorToPrint != nil && errorToPrint.Meta != nil {
-		if c.Writer.Written() {
-			fmt.Fprintf(c.Writer, "Error: %s\n", errorToPrint.Meta)
-		} else {
-			c.String(500, errorToPrint.Meta.(string))
-		}
-	}
-}
+// indexPageSize is how many app tokens or usernames handleIndex fetches at once
+const indexPageSize = 100
 
 func (s *MyServer) handleHealthRoute(c *gin.Context) {
 	c.String(200, s.gitCommitHash+":"+s.sdkVersion)
@@ -38,101 +28,66 @@ func (s *MyServer) handleHealthRoute(c *gin.Context) {
 }
 
 func (s *MyServer) handleStartPasswordRegistration(c *gin.Context) {
-	b, err := httputil.DumpRequest(c.Request, true)
-	if err != nil {
-		return
-	}
-	logrus.Debugf("%+v", string(b))
-
 	var req plisskencommon.OprfRequestResults
-	err = c.MustBindWith(&req, binding.JSON)
+	err := c.ShouldBindWith(&req, binding.JSON)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("JSON body is bad")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "JSON body is bad")
 		return
 	}
 
 	ok, err := s.opaqueServer.IsRegistered(
 		c.Request.Context(), req.AppToken, req.Username)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("request failed to evaluate")
+		// Not the request's fault: storage outages are a 503
+		abortWithError(c, http.StatusInternalServerError, err, "while checking the username")
 		return
 	}
 	if ok {
-		c.String(http.StatusForbidden, "User already registered")
+		abortWithError(c, http.StatusForbidden,
+			plisskenserver.ErrUserExists, "User already registered")
 		return
 	}
 
-	eval, err := s.opaqueServer.HandleNewUserRequest(
+	eval, requestID, err := s.opaqueServer.HandleNewUserRequest(
 		c.Request.Context(), req.AppToken, req.Username, req.EvalReq)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("request failed to evaluate")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "request failed to evaluate")
 		return
 	}
 
-	c.JSON(200, &plisskencommon.OprfServerEvaluation{Eval: eval})
+	c.JSON(200, &plisskencommon.OprfServerEvaluation{
+		Eval:      eval,
+		PubS:      s.opaqueServer.PubS[:],
+		KeyID:     s.opaqueServer.KeyID,
+		RequestID: requestID,
+	})
 }
 
 func (s *MyServer) handleFinalizePasswordRegistration(c *gin.Context) {
-	b, err := httputil.DumpRequest(c.Request, true)
-	if err != nil {
-		return
-	}
-	logrus.Debugf("%+v", string(b))
-
 	var req plisskencommon.PasswordRegistrationData
-	err = c.MustBindWith(&req, binding.JSON)
+	err := c.ShouldBindWith(&req, binding.JSON)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("JSON body is bad")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "JSON body is bad")
 		return
 	}
 
 	err = s.opaqueServer.StoreUserData(
 		c.Request.Context(),
-		req.AppToken, req.Username, req.PubU, req.EnvU,
-		req.EnvUNonce, req.Salt,
+		req.AppToken, req.Username, req.RequestID, req.PubU, req.EnvU,
+		req.EnvUNonce, req.Salt, req.PubS,
 	)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusInternalServerError,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("Failed to store user data")
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "Failed to store user data")
 		return
 	}
 	c.Status(200)
 }
 
 func (s *MyServer) handleStartPasswordAuthentication(c *gin.Context) {
-	b, err := httputil.DumpRequest(c.Request, true)
-	if err != nil {
-		return
-	}
-	logrus.Debugf("%+v", string(b))
-
 	var req plisskencommon.OprfRequestResults
-	err = c.MustBindWith(&req, binding.JSON)
+	err := c.ShouldBindWith(&req, binding.JSON)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("JSON body is bad")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "JSON body is bad")
 		return
 	}
 
@@ -142,41 +97,43 @@ func (s *MyServer) handleStartPasswordAuthentication(c *gin.Context) {
 		c.Request.Context(), req.AppToken,
 		req.Username, req.EvalReq)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("request failed to evaluate")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "request failed to evaluate")
+		return
+	}
+	// Ask the client to re-seal its envelope if it's bound to a retired key
+	var rotationPubS []byte
+	newPubS, err := s.opaqueServer.PendingKeyRotation(
+		c.Request.Context(), req.AppToken, req.Username)
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "request failed to evaluate")
 		return
 	}
+	if newPubS != nil {
+		rotationPubS = newPubS[:]
+	}
+
 	c.JSON(200, &plisskencommon.StartPasswordAuthServerResp{
-		Eval:      eval,
-		EnvU:      envU,
-		EnvUNonce: envUNonce,
-		RwdUSalt:  rwdUSalt,
-		AuthNonce: authNonce,
+		Eval:         eval,
+		EnvU:         envU,
+		EnvUNonce:    envUNonce,
+		RwdUSalt:     rwdUSalt,
+		AuthNonce:    authNonce,
+		RotationPubS: rotationPubS,
 	})
 }
 
 func (s *MyServer) handleFinalizePasswordAuthentication(c *gin.Context) {
 	var req plisskencommon.FinalizePasswordAuthData
-	err := c.MustBindWith(&req, binding.JSON)
+	err := c.ShouldBindWith(&req, binding.JSON)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic)
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "JSON body is bad")
 		return
 	}
 
 	// Decode session token and check it
 	b, err := hex.DecodeString(req.SessionToken)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("session token is bad")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "session token is bad")
 		return
 	}
 	ok, err := s.opaqueServer.IsAuthenticated(
@@ -184,39 +141,150 @@ func (s *MyServer) handleFinalizePasswordAuthentication(c *gin.Context) {
 		req.AppToken,
 		req.Username, b)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("while checking session token")
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "while checking session token")
 		return
 	}
 	if !ok {
-		c.String(http.StatusUnauthorized, "Session token is invalid")
+		abortWithError(c, http.StatusUnauthorized,
+			plisskenserver.ErrInvalidToken, "Session token is invalid")
 		return
 	}
 
-	// Session token is valid: store it for future use
-	err = s.redisWrapper.StoreSessionToken(
+	// Client re-sealed its envelope for our newest key: store it
+	if req.EnvU != "" {
+		envU, err := hex.DecodeString(req.EnvU)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "envu is bad")
+			return
+		}
+		envUNonce, err := hex.DecodeString(req.EnvUNonce)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "envu nonce is bad")
+			return
+		}
+		err = s.opaqueServer.MigrateUserEnvelope(
+			c.Request.Context(),
+			req.AppToken, req.Username, b, envU, envUNonce)
+		if err != nil {
+			// Mapped like any error: an envelope failing validation is a
+			// 400, only unknown errors are a 500
+			abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while migrating user envelope")
+			return
+		}
+	}
+
+	// Session token is valid: store it for future use, encoded like session
+	// credentials encode it whatever the case of the client's hex
+	err = s.store.StoreSessionToken(
 		c.Request.Context(),
-		req.AppToken, req.Username, req.SessionToken,
+		req.AppToken, req.Username, hex.EncodeToString(b),
 		defaultExpiryDuration,
 	)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusInternalServerError,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("while saving session token")
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while saving session token")
+		return
+	}
+
+	resp := &plisskencommon.FinalizePasswordAuthServerResp{}
+	if req.SessionCookie {
+		if s.sessionCookie == nil {
+			abortWithError(c, http.StatusBadRequest,
+				errors.New("session cookies are disabled"), "Session cookies are disabled")
+			return
+		}
+		resp.CSRFToken, err = s.sessionCookie.set(c.Writer,
+			plisskencommon.EncodeSessionCredential(req.Username, b),
+			defaultExpiryDuration)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while setting session cookie")
+			return
+		}
+	}
+	if s.accessTokens != nil {
+		token, expiresAt, err := s.accessTokens.issue(
+			req.AppToken, req.Username, s.opaqueServer.Now())
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while signing access token")
+			return
+		}
+		resp.AccessToken = token
+		resp.AccessTokenExpiresAt = expiresAt.Unix()
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// handleLogout ends the session of the request's session credential or, with
+// 'all', every session of its user. Only /logout_all needs the session to be
+// valid: ending an ended session is fine.
+func (s *MyServer) handleLogout(c *gin.Context, all bool) {
+	var req plisskencommon.LogoutData
+	err := c.ShouldBindWith(&req, binding.JSON)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "JSON body is bad")
+		return
+	}
+	cred, fromCookie := plisskenmw.Credential(c.Request, plisskencommon.SessionCookieName)
+	if cred == "" {
+		abortWithError(c, http.StatusUnauthorized,
+			errors.Wrap(plisskenserver.ErrInvalidToken, "no session credential"),
+			"Session credential is missing")
+		return
+	}
+	if fromCookie {
+		err = plisskenmw.CheckCSRF(c.Request, plisskencommon.CSRFCookieName)
+		if err != nil {
+			abortWithError(c, http.StatusForbidden, errors.Wrap(err, ""), "CSRF check failed")
+			return
+		}
+	}
+	username, sessionToken, err := plisskencommon.DecodeSessionCredential(cred)
+	if err != nil {
+		abortWithError(c, http.StatusUnauthorized,
+			errors.Wrap(plisskenserver.ErrInvalidToken, err.Error()), "Session credential is invalid")
+		return
+	}
+
+	ctx := c.Request.Context()
+	if all {
+		ok, err := s.store.HasSessionToken(ctx, req.AppToken, username, sessionToken)
+		if err != nil {
+			abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while checking session token")
+			return
+		}
+		if !ok {
+			abortWithError(c, http.StatusUnauthorized,
+				plisskenserver.ErrInvalidToken, "Session token is invalid")
+			return
+		}
+		err = s.store.DeleteSessionTokens(ctx, req.AppToken, username)
+	} else {
+		err = s.store.DeleteSessionToken(ctx, req.AppToken, username, sessionToken)
+	}
+	if err != nil {
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while deleting session tokens")
 		return
 	}
+	logging.FromContext(ctx).WithFields(logrus.Fields{
+		"apptoken": req.AppToken,
+		"username": username,
+		"all":      all,
+	}).Info("Logged out")
 
+	// A bearer credential's session isn't the cookies' one
+	if fromCookie && s.sessionCookie != nil {
+		s.sessionCookie.clear(c.Writer)
+	}
 	c.Status(http.StatusOK)
 }
 
+// CheckCredentialsRequestData is the query of /check-credentials. The user's
+// session credential is sent as 'Authorization: Bearer <credential>' (see
+// plisskencommon.EncodeSessionCredential).
 type CheckCredentialsRequestData struct {
-	AppToken     string `form:"apptoken"`
-	AppSecret    string `form:"appsecret"`
+	AppToken  string `form:"apptoken"`
+	AppSecret string `form:"appsecret"`
+	// Deprecated: Send the session credential instead. Query parameters end
+	// up in access logs.
 	Username     string `form:"username"`
 	SessionToken string `form:"session_token"`
 }
@@ -230,55 +298,67 @@ type CheckCredentialsResponseData struct {
 
 func (s *MyServer) handleCheckCredentials(c *gin.Context) {
 	var req CheckCredentialsRequestData
-	err := c.MustBindWith(&req, binding.Query)
+	err := c.ShouldBindWith(&req, binding.Query)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusBadRequest,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic)
+		abortWithError(c, http.StatusBadRequest, errors.Wrap(err, ""), "query is bad")
 		return
 	}
-	fmt.Printf("req = %+v\n", req)
 
 	// Check app secret
-	ok, err := s.redisWrapper.HasAppSecret(
+	ok, err := s.store.HasAppSecret(
 		c.Request.Context(), req.AppToken, req.AppSecret)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusInternalServerError,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("while checking app secret")
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while checking app secret")
 		return
 	}
 	if !ok {
-		c.String(http.StatusUnauthorized, "App secret is invalid")
+		abortWithError(c, http.StatusUnauthorized,
+			errInvalidAppSecret, "App secret is invalid")
 		return
 	}
 
+	// Read the session credential
+	authz := c.GetHeader("Authorization")
+	if authz != "" {
+		if !strings.HasPrefix(authz, "Bearer ") {
+			abortWithError(c, http.StatusBadRequest,
+				errors.New("not a bearer token"), "Authorization header is bad")
+			return
+		}
+		req.Username, req.SessionToken, err = plisskencommon.DecodeSessionCredential(
+			strings.TrimPrefix(authz, "Bearer "))
+		if err != nil {
+			abortWithError(c, http.StatusUnauthorized,
+				errors.Wrap(plisskenserver.ErrInvalidToken, err.Error()), "Session credential is invalid")
+			return
+		}
+	}
+	logging.FromContext(c.Request.Context()).WithFields(logrus.Fields{
+		"apptoken": req.AppToken,
+		"username": req.Username,
+	}).Debug("Checking credentials")
+
 	// Check session token
-	ok, err = s.redisWrapper.HasSessionToken(
+	ok, err = s.store.HasSessionToken(
 		c.Request.Context(),
 		req.AppToken, req.Username, req.SessionToken,
 	)
 	if err != nil {
-		c.AbortWithError(
-			http.StatusInternalServerError,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("while checking app secret")
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while checking session token")
 		return
 	}
 	if !ok {
-		c.String(http.StatusUnauthorized, "Session token is invalid")
+		abortWithError(c, http.StatusUnauthorized,
+			plisskenserver.ErrInvalidToken, "Session token is invalid")
 		return
 	}
 
+	now := s.opaqueServer.Now()
 	typedResp := CheckCredentialsResponseData{
 		Username:   req.Username,
-		CreatedAt:  time.Now().Unix(),
+		CreatedAt:  now.Unix(),
 		SdkVersion: s.sdkVersion,
-		ExpiresAt:  time.Now().Add(defaultExpiryDuration).Unix(),
+		ExpiresAt:  now.Add(defaultExpiryDuration).Unix(),
 	}
 	c.JSON(http.StatusOK, typedResp)
 }
@@ -286,13 +366,12 @@ func (s *MyServer) handleCheckCredentials(c *gin.Context) {
 func (s *MyServer) handleIndex(c *gin.Context) {
 	var sb strings.Builder
 
-	tokens, err := s.redisWrapper.GetAllAppTokens(c.Request.Context())
+	ctx := c.Request.Context()
+	tokens, err := ListAll(func(cursor string) ([]string, string, error) {
+		return s.store.ListAppTokens(ctx, cursor, indexPageSize)
+	})
 	if err != nil {
-		c.AbortWithError(
-			http.StatusInternalServerError,
-			errors.Wrapf(err, "")).
-			SetType(gin.ErrorTypePublic).
-			SetMeta("while fetching app tokens")
+		abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while fetching app tokens")
 		return
 	}
 
@@ -302,14 +381,12 @@ func (s *MyServer) handleIndex(c *gin.Context) {
 			sb.WriteString("======================================================\n")
 			sb.WriteString("======================================================\n")
 		}
-		usernames, err := s.redisWrapper.GetAllUsernamesFromEnvelopes(
-			c.Request.Context(), token)
+		usernames, err := ListAll(func(cursor string) ([]string, string, error) {
+			return s.store.ListUsernames(ctx, token, cursor, indexPageSize)
+		})
 		if err != nil {
-			c.AbortWithError(
-				http.StatusInternalServerError,
-				errors.Wrapf(err, "")).
-				SetType(gin.ErrorTypePublic).
-				SetMeta(fmt.Sprintf("while fetching usernames for app token %s", token))
+			abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""),
+				fmt.Sprintf("while fetching usernames for app token %s", token))
 			return
 		}
 
@@ -318,13 +395,9 @@ func (s *MyServer) handleIndex(c *gin.Context) {
 			if usrIdx > 0 {
 				sb.WriteString("---------------------------------------\n")
 			}
-			env, err := s.redisWrapper.LoadUserEnvelope(c.Request.Context(), token, username)
+			env, err := s.store.LoadUserEnvelope(ctx, token, username)
 			if err != nil {
-				c.AbortWithError(
-					http.StatusInternalServerError,
-					errors.Wrapf(err, "")).
-					SetType(gin.ErrorTypePublic).
-					SetMeta("while checking fetching user envelopes")
+				abortWithError(c, http.StatusInternalServerError, errors.Wrap(err, ""), "while checking fetching user envelopes")
 				return
 			}
 			sb.WriteString(fmt.Sprintf("Data for username %s | apptoken %s\n\n", username, token))
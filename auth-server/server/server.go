@@ -6,9 +6,9 @@ import (
 	"net/http"
 	"os"
 	"strconv"
-	"strings"
 
-	"github.com/afjoseph/plissken-auth-server/rediswrapper"
+	"github.com/afjoseph/plissken-auth-server/logging"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
 	plisskenserver "github.com/afjoseph/plissken-protocol/server"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -22,29 +22,40 @@ type MyServer struct {
 
 	gitCommitHash       string
 	sdkVersion          string
-	redisWrapper        *rediswrapper.RedisWrapper
+	store               Store
 	opaqueServer        *plisskenserver.Server
 	corsOriginWhitelist []string
+	accessTokens        *AccessTokenIssuer
+	sessionCookie       *SessionCookie
 }
 
 func Host(
-	serverPrivKey []byte,
+	keyring *plisskenserver.Keyring,
 	corsOriginWhitelist []string,
 	addr string,
 	verbose bool,
 	sdkVersion string,
 	gitCommitHash string,
-	rdw *rediswrapper.RedisWrapper,
+	store Store,
+	// Optional: nil disables access tokens
+	accessTokens *AccessTokenIssuer,
+	// Optional: nil disables session cookies. Needs a 'corsOriginWhitelist'.
+	sessionCookie *SessionCookie,
 	errChan chan<- error,
+	// Passed to the OPAQUE server, e.g. plisskenserver.WithClock in tests
+	opts ...plisskenserver.Option,
 ) (*MyServer, error) {
 	logrus.Tracef("Host with corsOriginWhitelist: %v | addr: %v | verbose: %v",
 		corsOriginWhitelist, addr, verbose)
 
 	// Init OpaqueServer
-	opaqueServer, err := plisskenserver.NewServer(rdw, serverPrivKey)
+	opaqueServer, err := plisskenserver.NewServerWithKeyring(store, keyring, opts...)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
+	if sessionCookie != nil && corsOriginWhitelist == nil {
+		return nil, errors.New("session cookies need a CORS origin whitelist")
+	}
 
 	// Init server code
 	if verbose {
@@ -55,27 +66,30 @@ func Host(
 	router := gin.New()
 	gin.DefaultWriter = os.Stdout
 	router.Use(
-		gin.Logger(),
-		gin.Recovery(),
+		logging.Middleware(),
+		gin.CustomRecovery(handlePanic),
 		handleErrors,
 		cors.New(
 			func() cors.Config {
 				cfg := cors.DefaultConfig()
 				cfg.AllowHeaders = []string{
-					"Origin", "Content-Length", "Content-Type", "Authorization"}
-				// TODO <27-02-22, afjoseph> Change this to the actual website
+					"Origin", "Content-Length", "Content-Type", "Authorization",
+					plisskencommon.CSRFHeaderName}
 				if corsOriginWhitelist == nil {
 					cfg.AllowAllOrigins = true
 				} else {
 					cfg.AllowOriginFunc = func(origin string) bool {
 						logrus.Debugf("Asking for origin: %s", origin)
+						// Exact matches only: credentialed requests are
+						// allowed
 						for _, v := range corsOriginWhitelist {
-							if strings.Contains(origin, v) {
+							if origin == v {
 								return true
 							}
 						}
 						return false
 					}
+					cfg.AllowCredentials = sessionCookie != nil
 				}
 				return cfg
 			}(),
@@ -86,9 +100,11 @@ func Host(
 	srv := &MyServer{
 		opaqueServer:        opaqueServer,
 		corsOriginWhitelist: corsOriginWhitelist,
-		redisWrapper:        rdw,
+		store:               store,
 		sdkVersion:          sdkVersion,
 		gitCommitHash:       gitCommitHash,
+		accessTokens:        accessTokens,
+		sessionCookie:       sessionCookie,
 	}
 	router.GET("/health", func(c *gin.Context) { srv.handleHealthRoute(c) })
 	router.POST("/start_password_registration", func(c *gin.Context) {
@@ -103,12 +119,19 @@ func Host(
 	router.POST("/finalize_password_authentication", func(c *gin.Context) {
 		srv.handleFinalizePasswordAuthentication(c)
 	})
+	router.POST("/logout", func(c *gin.Context) {
+		srv.handleLogout(c, false)
+	})
+	router.POST("/logout_all", func(c *gin.Context) {
+		srv.handleLogout(c, true)
+	})
 	router.GET("/check-credentials", func(c *gin.Context) {
 		srv.handleCheckCredentials(c)
 	})
 	router.GET("/", func(c *gin.Context) {
 		srv.handleIndex(c)
 	})
+	router.NoRoute(handleNoRoute)
 
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
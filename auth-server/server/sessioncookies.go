@@ -0,0 +1,66 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
+	"github.com/pkg/errors"
+)
+
+// SessionCookie sets the session credential in an HttpOnly cookie on logins
+// that ask for it, so that browser scripts never handle it. A readable CSRF
+// cookie is set next to it: see plisskencommon.CSRFHeaderName.
+type SessionCookie struct {
+	Domain   string
+	Path     string
+	SameSite http.SameSite
+	// Drops the Secure attribute. Only for local development.
+	Insecure bool
+}
+
+// set writes both cookies for 'cred', valid for 'ttl', and returns the CSRF
+// token
+func (sc *SessionCookie) set(w http.ResponseWriter, cred string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "")
+	}
+	csrfToken := hex.EncodeToString(b)
+	http.SetCookie(w, sc.cookie(plisskencommon.SessionCookieName, cred, ttl, true))
+	// Not HttpOnly: scripts read it to fill the CSRF header
+	http.SetCookie(w, sc.cookie(plisskencommon.CSRFCookieName, csrfToken, ttl, false))
+	return csrfToken, nil
+}
+
+// clear tells the browser to drop both cookies
+func (sc *SessionCookie) clear(w http.ResponseWriter) {
+	http.SetCookie(w, sc.cookie(plisskencommon.SessionCookieName, "", -1, true))
+	http.SetCookie(w, sc.cookie(plisskencommon.CSRFCookieName, "", -1, false))
+}
+
+// cookie returns a cookie valid for 'ttl'. A negative 'ttl' deletes it.
+func (sc *SessionCookie) cookie(name, value string, ttl time.Duration, httpOnly bool) *http.Cookie {
+	return &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Domain:   sc.Domain,
+		Path:     sc.Path,
+		MaxAge:   maxAge(ttl),
+		Secure:   !sc.Insecure,
+		HttpOnly: httpOnly,
+		SameSite: sc.SameSite,
+	}
+}
+
+// maxAge converts 'ttl' to a Max-Age: net/http sends 'Max-Age=0' for negative
+// values, and omits the attribute for 0
+func maxAge(ttl time.Duration) int {
+	if ttl < 0 {
+		return -1
+	}
+	return int(ttl.Seconds())
+}
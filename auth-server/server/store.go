@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+// Store is everything the auth-server needs from its storage: the protocol's
+// own plisskenserver.Storage, plus session tokens and app secrets.
+//
+// It's implemented by rediswrapper.RedisWrapper, sqlstore.Store and
+// memstore.Store, and cachestore.Store caches lookups of any of them.
+type Store interface {
+	plisskenserver.Storage
+
+	// StoreSessionToken starts a session of the user. Users can have several
+	// sessions at once: logging in again doesn't end the others.
+	StoreSessionToken(ctx context.Context, apptoken, username, sessionToken string, expiresAt time.Duration) error
+	HasSessionToken(ctx context.Context, apptoken, username, sessionToken string) (bool, error)
+	// DeleteSessionToken ends the user's session of 'sessionToken'. It's not
+	// an error if there's no such session.
+	DeleteSessionToken(ctx context.Context, apptoken, username, sessionToken string) error
+	// DeleteSessionTokens ends every session of the user
+	DeleteSessionTokens(ctx context.Context, apptoken, username string) error
+
+	StoreAppSecret(ctx context.Context, apptoken, appSecret string) error
+	HasAppSecret(ctx context.Context, apptoken, appSecret string) (bool, error)
+
+	// ListAppTokens returns a page of at most about 'count' of the app tokens
+	// having an app secret, starting at 'cursor', and the cursor of the next
+	// page. The first and the end cursors are "", and 'count' must be positive. Like with Redis' SCAN, an
+	// app token can be returned more than once.
+	ListAppTokens(ctx context.Context, cursor string, count int) (tokens []string, next string, err error)
+	// ListUsernames pages through the usernames of 'apptoken' having an
+	// envelope, like ListAppTokens
+	ListUsernames(ctx context.Context, apptoken, cursor string, count int) (usernames []string, next string, err error)
+}
+
+// ListAll calls 'list' until it went through all the pages
+func ListAll(
+	list func(cursor string) ([]string, string, error),
+) ([]string, error) {
+	var ret []string
+	seen := map[string]bool{}
+	cursor := ""
+	for {
+		page, next, err := list(cursor)
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		for _, str := range page {
+			if !seen[str] {
+				seen[str] = true
+				ret = append(ret, str)
+			}
+		}
+		if next == "" {
+			return ret, nil
+		}
+		cursor = next
+	}
+}
@@ -0,0 +1,134 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// migration is one step of the schema. Migrations are applied in order and
+// never edited once released: add a new one instead.
+type migration struct {
+	version int
+	// Statements to run; '{{binary}}' is replaced by the dialect's binary type
+	// and '{{serial}}' by its auto-incrementing primary key definition
+	statements []string
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		statements: []string{
+			`CREATE TABLE user_requests (
+				apptoken TEXT NOT NULL,
+				username TEXT NOT NULL,
+				oprf_priv_key {{binary}} NOT NULL,
+				created_at BIGINT NOT NULL,
+				PRIMARY KEY (apptoken, username)
+			)`,
+			`CREATE TABLE user_envelopes (
+				apptoken TEXT NOT NULL,
+				username TEXT NOT NULL,
+				pub_u {{binary}} NOT NULL,
+				env_u {{binary}} NOT NULL,
+				env_u_nonce {{binary}} NOT NULL,
+				rwd_u_salt {{binary}} NOT NULL,
+				oprf_priv_key {{binary}} NOT NULL,
+				key_id TEXT NOT NULL DEFAULT '',
+				created_at BIGINT NOT NULL,
+				updated_at BIGINT NOT NULL,
+				PRIMARY KEY (apptoken, username)
+			)`,
+			`CREATE TABLE auth_nonces (
+				id {{serial}},
+				apptoken TEXT NOT NULL,
+				username TEXT NOT NULL,
+				nonce {{binary}} NOT NULL,
+				created_at BIGINT NOT NULL
+			)`,
+			`CREATE INDEX auth_nonces_user ON auth_nonces (apptoken, username, id)`,
+			`CREATE TABLE session_tokens (
+				apptoken TEXT NOT NULL,
+				username TEXT NOT NULL,
+				session_token TEXT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				PRIMARY KEY (apptoken, username)
+			)`,
+			`CREATE TABLE app_secrets (
+				apptoken TEXT NOT NULL PRIMARY KEY,
+				app_secret TEXT NOT NULL
+			)`,
+		},
+	},
+	{
+		// Users can have several sessions. SQLite can't change a primary key:
+		// the table is copied instead.
+		version: 2,
+		statements: []string{
+			`CREATE TABLE session_tokens_v2 (
+				apptoken TEXT NOT NULL,
+				username TEXT NOT NULL,
+				session_token TEXT NOT NULL,
+				expires_at BIGINT NOT NULL,
+				PRIMARY KEY (apptoken, username, session_token)
+			)`,
+			`INSERT INTO session_tokens_v2 (apptoken, username, session_token, expires_at)
+				SELECT apptoken, username, session_token, expires_at FROM session_tokens`,
+			`DROP TABLE session_tokens`,
+			`ALTER TABLE session_tokens_v2 RENAME TO session_tokens`,
+		},
+	},
+	{
+		// Pending registrations are finalized with the ID they were started
+		// with. It's NULL for the ones started before: they can't be.
+		version: 3,
+		statements: []string{
+			`ALTER TABLE user_requests ADD COLUMN request_id {{binary}}`,
+		},
+	},
+}
+
+// migrate brings the schema up to date. Each migration runs in its own
+// transaction.
+func (s *Store) migrate(ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER NOT NULL PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	var current int
+	err = s.db.QueryRowContext(ctx,
+		`SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		err = s.withTx(ctx, func(tx *sql.Tx) error {
+			for _, stmt := range m.statements {
+				_, err := tx.ExecContext(ctx, s.dialect.ddl(stmt))
+				if err != nil {
+					return errors.Wrap(err, "")
+				}
+			}
+			_, err := tx.ExecContext(ctx, s.rebind(
+				`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+				m.version, time.Now().Unix())
+			return errors.Wrap(err, "")
+		})
+		if err != nil {
+			return errors.Wrapf(err, "while applying migration %d", m.version)
+		}
+		logrus.Infof("Applied SQL schema migration %d", m.version)
+	}
+	return nil
+}
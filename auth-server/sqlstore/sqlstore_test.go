@@ -0,0 +1,222 @@
+package sqlstore
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	plisskenclient "github.com/afjoseph/plissken-protocol/client"
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/afjoseph/plissken-protocol/server/storagetest"
+	"github.com/stretchr/testify/require"
+)
+
+const testAppToken = "my-app-token"
+
+func openTestStore(t *testing.T) (*Store, string) {
+	url := "sqlite://" + filepath.Join(t.TempDir(), "plissken.db")
+	s, err := Open(context.Background(), url)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s, url
+}
+
+func TestProtocolOverSqlite(t *testing.T) {
+	ctx := context.Background()
+	store, _ := openTestStore(t)
+	s, err := plisskenserver.NewServer(store, nil)
+	require.NoError(t, err)
+
+	// Register
+	_, finData, evalReq, err := plisskenclient.MakeOprfRequest("bunnyfoofoo")
+	require.NoError(t, err)
+	eval, requestID, err := s.HandleNewUserRequest(ctx, testAppToken, "truebeef", evalReq)
+	require.NoError(t, err)
+	envU, envUNonce, pubU, salt, err := plisskenclient.MakeEnvU(finData, eval, s.PubS)
+	require.NoError(t, err)
+	require.NoError(t, s.StoreUserData(ctx, testAppToken, "truebeef", requestID,
+		pubU, envU, envUNonce, salt, s.PubS[:]))
+
+	// Login
+	_, finData, evalReq, err = plisskenclient.MakeOprfRequest("bunnyfoofoo")
+	require.NoError(t, err)
+	eval, envU, envUNonce, salt, authNonce, err := s.HandleNewUserAuthentication(
+		ctx, testAppToken, "truebeef", evalReq)
+	require.NoError(t, err)
+	sessionToken, err := plisskenclient.DeriveSessionToken(
+		finData, eval, envU, envUNonce, salt, authNonce)
+	require.NoError(t, err)
+	ok, err := s.IsAuthenticated(ctx, testAppToken, "truebeef", sessionToken)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	usernames, next, err := store.ListUsernames(ctx, testAppToken, "", 10)
+	require.NoError(t, err)
+	require.Equal(t, []string{"truebeef"}, usernames)
+	require.Empty(t, next)
+}
+
+func TestStorageConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) plisskenserver.Storage {
+		store, _ := openTestStore(t)
+		return store
+	})
+}
+
+func TestStore(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("missing rows", func(t *testing.T) {
+		store, _ := openTestStore(t)
+		_, err := store.LoadUserRequest(ctx, testAppToken, "nobody")
+		require.Error(t, err)
+		_, err = store.LoadUserEnvelope(ctx, testAppToken, "nobody")
+		require.Error(t, err)
+		ok, err := store.HasSessionToken(ctx, testAppToken, "nobody", "token")
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = store.HasAppSecret(ctx, "nope", "secret")
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("session tokens expire", func(t *testing.T) {
+		store, _ := openTestStore(t)
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "old", 0))
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "new", time.Hour))
+		ok, err := store.HasSessionToken(ctx, testAppToken, "truebeef", "old")
+		require.NoError(t, err)
+		require.True(t, ok, "logging in again doesn't end the user's other sessions")
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "new")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "new", -time.Hour))
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "new")
+		require.NoError(t, err)
+		require.True(t, ok, "non-positive durations never expire, like Redis")
+
+		now := time.Unix(1650000000, 0)
+		store.now = func() time.Time { return now }
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "new", time.Hour))
+		now = now.Add(time.Hour - time.Second)
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "new")
+		require.NoError(t, err)
+		require.True(t, ok)
+		now = now.Add(time.Second)
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "new")
+		require.NoError(t, err)
+		require.False(t, ok)
+
+		// Expired sessions are deleted on login
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "newer", time.Hour))
+		var count int
+		require.NoError(t, store.db.QueryRow(
+			`SELECT COUNT(*) FROM session_tokens`).Scan(&count))
+		require.Equal(t, 2, count)
+	})
+
+	t.Run("deleting session tokens", func(t *testing.T) {
+		store, _ := openTestStore(t)
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "token", time.Hour))
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "other", time.Hour))
+		require.NoError(t, store.DeleteSessionToken(ctx, testAppToken, "truebeef", "old"))
+		ok, err := store.HasSessionToken(ctx, testAppToken, "truebeef", "token")
+		require.NoError(t, err)
+		require.True(t, ok, "stale tokens don't end any session")
+		require.NoError(t, store.DeleteSessionToken(ctx, testAppToken, "truebeef", "token"))
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "token")
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "other")
+		require.NoError(t, err)
+		require.True(t, ok, "ending a session doesn't end the user's others")
+
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "token", time.Hour))
+		require.NoError(t, store.DeleteSessionTokens(ctx, testAppToken, "truebeef"))
+		for _, token := range []string{"token", "other"} {
+			ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", token)
+			require.NoError(t, err)
+			require.False(t, ok)
+		}
+	})
+
+	t.Run("listing pages", func(t *testing.T) {
+		store, _ := openTestStore(t)
+		for _, apptoken := range []string{"c", "a", "b"} {
+			require.NoError(t, store.StoreAppSecret(ctx, apptoken, "secret"))
+		}
+		tokens, next, err := store.ListAppTokens(ctx, "", 2)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a", "b"}, tokens)
+		tokens, next, err = store.ListAppTokens(ctx, next, 2)
+		require.NoError(t, err)
+		require.Equal(t, []string{"c"}, tokens)
+		require.Empty(t, next)
+
+		for _, username := range []string{"a:b", "{c}", "d%"} {
+			require.NoError(t, store.StoreUserEnvelope(ctx, testAppToken, username,
+				&plisskenserver.UserEnvelope{PubU: []byte{1}, EnvU: []byte{1},
+					EnvUNonce: []byte{1}, RwdUSalt: []byte{1},
+					SerializedOprvPrivateKey: []byte{1}}))
+		}
+		usernames, next, err := store.ListUsernames(ctx, testAppToken, "", 3)
+		require.NoError(t, err)
+		require.Equal(t, []string{"a:b", "d%", "{c}"}, usernames)
+		usernames, next, err = store.ListUsernames(ctx, testAppToken, next, 3)
+		require.NoError(t, err)
+		require.Empty(t, usernames)
+		require.Empty(t, next)
+	})
+
+	t.Run("migrating keeps sessions", func(t *testing.T) {
+		all := migrations
+		migrations = migrations[:1]
+		store, url := openTestStore(t)
+		migrations = all
+		_, err := store.db.Exec(`INSERT INTO session_tokens
+			(apptoken, username, session_token, expires_at) VALUES (?, ?, ?, 0)`,
+			testAppToken, "truebeef", "token")
+		require.NoError(t, err)
+		require.NoError(t, store.Close())
+
+		store, err = Open(ctx, url)
+		require.NoError(t, err)
+		defer store.Close()
+		ok, err := store.HasSessionToken(ctx, testAppToken, "truebeef", "token")
+		require.NoError(t, err)
+		require.True(t, ok)
+		require.NoError(t, store.StoreSessionToken(ctx, testAppToken, "truebeef", "other", 0))
+		ok, err = store.HasSessionToken(ctx, testAppToken, "truebeef", "token")
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("reopening keeps data and doesn't re-run migrations", func(t *testing.T) {
+		store, url := openTestStore(t)
+		require.NoError(t, store.StoreAppSecret(ctx, testAppToken, "secret"))
+		require.NoError(t, store.Close())
+
+		store, err := Open(ctx, url)
+		require.NoError(t, err)
+		defer store.Close()
+		ok, err := store.HasAppSecret(ctx, testAppToken, "secret")
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+}
+
+func TestStorageUnavailable(t *testing.T) {
+	store, _ := openTestStore(t)
+	require.NoError(t, store.Close())
+	_, err := store.LoadUserEnvelope(context.Background(), testAppToken, "truebeef")
+	require.ErrorIs(t, err, plisskenserver.ErrStorageUnavailable)
+}
+
+func TestRebind(t *testing.T) {
+	s := &Store{dialect: dialectPostgres}
+	require.Equal(t,
+		"SELECT 1 FROM t WHERE a = $1 AND b = $2",
+		s.rebind("SELECT 1 FROM t WHERE a = ? AND b = ?"))
+}
@@ -27,14 +27,16 @@ async function main() {
     );
 
     // const session_token = 'b1066c68613e17cbe7e3c2f78ec51a44a67ef94a8748366f1dde4424f0e4da69';
+    const headers = {
+      Authorization: `Bearer ${plissken_js_sdk.session_credential(username, session_token)}`,
+    };
 
     let response = await axios.put(
       `${resource_server_endpoint}/put-resource`,
       null,
       {
+        headers,
         params: {
-          session_token,
-          username,
           ts: Date.now().toString(),
         },
       },
@@ -46,12 +48,7 @@ async function main() {
     console.log('Getting the same value from the resource server');
     response = await axios.get(
       `${resource_server_endpoint}/get-resource`,
-      {
-        params: {
-          session_token,
-          username,
-        },
-      },
+      {headers},
     );
     if (response.status !== 200) {
       throw new Error('Failed to put value');
@@ -60,6 +57,14 @@ async function main() {
     let d = new Date();
     d.setTime(response.data);
     console.log(`Successfully got last time I cut my hair: ${d.toUTCString()}`);
+
+    await plissken_js_sdk.logout(
+      apptoken,
+      username,
+      session_token,
+      plissken_auth_server_endpoint,
+    );
+    console.log('Logged out');
   } catch (error: unknown) {
     console.error(`From plissken-js-sdk: ${error}`);
   }
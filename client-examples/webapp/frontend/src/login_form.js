@@ -91,15 +91,22 @@ class MyForm extends React.Component {
     }
   }
 
+  authHeaders() {
+    const credential = plissken_js_sdk.session_credential(
+      this.state.username,
+      this.state.session_token
+    );
+    return { Authorization: `Bearer ${credential}` };
+  }
+
   async handlePutResourceBtn() {
     try {
       let response = await axios.put(
         `${resource_server_endpoint}/put-resource`,
         null,
         {
+          headers: this.authHeaders(),
           params: {
-            session_token: this.state.session_token,
-            username: this.state.username,
             ts: Date.now().toString(),
           },
         }
@@ -136,10 +143,7 @@ class MyForm extends React.Component {
       let response = await axios.get(
         `${resource_server_endpoint}/get-resource`,
         {
-          params: {
-            session_token: this.state.session_token,
-            username: this.state.username,
-          },
+          headers: this.authHeaders(),
         }
       );
       if (response.status !== 200) {
@@ -1,14 +1,15 @@
 package main
 
 import (
-	"context"
-	"encoding/json"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"net/http"
 	"os"
 	"time"
 
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/plisskenmw"
 	"github.com/alicebob/miniredis/v2"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -25,7 +26,13 @@ type Config struct {
 	PlisskenAppSecret    string `yaml:"plissken-app-secret"`
 	PlisskenAppToken     string `yaml:"plissken-app-token"`
 	PlisskenAuthEndpoint string `yaml:"plissken-auth-endpoint"`
-	Verbose              bool   `yaml:"verbose"`
+	// Optional: hex-encoded public key the auth-server signs access tokens
+	// with
+	PlisskenAccessTokenPublicKey string `yaml:"plissken-access-token-public-key"`
+	// Optional: origins browsers may call us from, with their session
+	// cookie, e.g. 'http://localhost:3000'. Other origins can't.
+	CORSOrigins []string `yaml:"cors-origins"`
+	Verbose     bool     `yaml:"verbose"`
 }
 
 func parseFlags() (config *Config, err error) {
@@ -63,83 +70,61 @@ func main() {
 	}
 	defer m.Close()
 
-	// Define handlers
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, gitCommitHash)
-		w.WriteHeader(http.StatusOK)
-	})
-	http.HandleFunc("/get-resource", func(w http.ResponseWriter, r *http.Request) {
-		// CORS stuff
-		setupCORS(w, r)
-		if r.Method == "OPTIONS" {
-			return
-		}
-
-		// Check credentials
-		username := r.URL.Query().Get("username")
-		sessionToken := r.URL.Query().Get("session_token")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		_, err = checkCredentials(
-			ctx,
-			config.PlisskenAppSecret,
-			config.PlisskenAppToken,
-			config.PlisskenAuthEndpoint,
-			username,
-			sessionToken)
-		if err != nil {
-			logrus.Errorf("while checking credentials: %v", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		// Get resource
-		val, err := m.Get(fmt.Sprintf("%s:last_haircut", username))
-		if err != nil {
-			logrus.Errorf("while getting value: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		fmt.Fprintf(w, val)
-	})
-
-	http.HandleFunc("/put-resource", func(w http.ResponseWriter, r *http.Request) {
-		// CORS stuff
-		setupCORS(w, r)
-		if r.Method == "OPTIONS" {
-			return
-		}
-
-		// Check credentials
-		username := r.URL.Query().Get("username")
-		sessionToken := r.URL.Query().Get("session_token")
-		ts := r.URL.Query().Get("ts")
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
-		_, err = checkCredentials(
-			ctx,
-			config.PlisskenAppSecret,
-			config.PlisskenAppToken,
-			config.PlisskenAuthEndpoint,
-			username,
-			sessionToken)
+	// Init authentication: requests carry a session credential, or an access
+	// token if the auth-server signs them
+	authCfg := plisskenmw.Config{
+		AppToken:     config.PlisskenAppToken,
+		AuthEndpoint: config.PlisskenAuthEndpoint,
+		AppSecret:    config.PlisskenAppSecret,
+		HTTPClient:   &http.Client{Timeout: 5 * time.Second},
+	}
+	if config.PlisskenAccessTokenPublicKey != "" {
+		authCfg.AccessTokenPublicKey, err = hex.DecodeString(
+			config.PlisskenAccessTokenPublicKey)
 		if err != nil {
-			logrus.Errorf("while checking credentials: %v", err)
-			w.WriteHeader(http.StatusUnauthorized)
-			return
+			panic(err)
 		}
+	}
+	auth, err := plisskenmw.New(authCfg)
+	if err != nil {
+		panic(err)
+	}
 
-		// Put resource
-		err = m.Set(
-			fmt.Sprintf("%s:last_haircut", username),
-			ts)
-		if err != nil {
-			logrus.Errorf("while putting value: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
+	// Define handlers
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, gitCommitHash)
 		w.WriteHeader(http.StatusOK)
 	})
+	http.Handle("/get-resource", withCORS(config.CORSOrigins, auth.Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := plisskenmw.FromContext(r.Context())
+
+			// Get resource
+			val, err := m.Get(fmt.Sprintf("%s:last_haircut", id.Username))
+			if err != nil {
+				logrus.Errorf("while getting value: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, val)
+		}))))
+
+	http.Handle("/put-resource", withCORS(config.CORSOrigins, auth.Middleware(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id, _ := plisskenmw.FromContext(r.Context())
+			ts := r.URL.Query().Get("ts")
+
+			// Put resource
+			err := m.Set(
+				fmt.Sprintf("%s:last_haircut", id.Username),
+				ts)
+			if err != nil {
+				logrus.Errorf("while putting value: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))))
 
 	// Start server
 	if err = http.ListenAndServe(config.Addr, nil); err != nil {
@@ -147,56 +132,26 @@ func main() {
 	}
 }
 
-type PlisskenCheckCredentialsResponseData struct {
-	Username   string `json:"username"`
-	CreatedAt  int64  `json:"created_at"`
-	SdkVersion string `json:"sdk_version"`
-	ExpiresAt  int64  `json:"expires_at"`
-}
-
-func checkCredentials(
-	ctx context.Context,
-	plisskenAppSecret,
-	plisskenAppToken,
-	plisskenEndpoint,
-	username, sessionToken string) (*PlisskenCheckCredentialsResponseData, error) {
-	req, err := http.NewRequestWithContext(
-		ctx, "GET", plisskenEndpoint+"/check-credentials",
-		nil,
-	)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
+// withCORS lets the browsers of 'origins' call 'next' with credentials, like
+// a session cookie and its CSRF header. It answers preflight requests itself:
+// they don't carry credentials.
+func withCORS(origins []string, next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range origins {
+		allowed[origin] = true
 	}
-	q := req.URL.Query()
-	q.Add("apptoken", plisskenAppToken)
-	q.Add("appsecret", plisskenAppSecret)
-	q.Add("username", username)
-	q.Add("session_token", sessionToken)
-	req.URL.RawQuery = q.Encode()
-
-	logrus.Debugf("Running /check-credentials request for %s on %s",
-		username, plisskenEndpoint)
-	resp, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, errors.Errorf("unexpected status code: %d", resp.StatusCode)
-	}
-	typedResp := &PlisskenCheckCredentialsResponseData{}
-	err = json.NewDecoder(resp.Body).Decode(typedResp)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	defer resp.Body.Close()
-
-	logrus.Debugf("Received /check-credentials request for %s on %s",
-		username, plisskenEndpoint)
-	return typedResp, nil
-}
-
-func setupCORS(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Origin, Content-Type")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+		if origin := r.Header.Get("Origin"); allowed[origin] {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers",
+				"Origin, Content-Type, Authorization, "+common.CSRFHeaderName)
+		}
+		if r.Method == http.MethodOptions {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
 }
@@ -0,0 +1,48 @@
+// Loads the WebAssembly build of protocol-lib's client (see
+// auth-server/cmd/js-bindings) the first time it's needed. It's embedded,
+// gzipped, so that the SDK works without serving an extra file.
+import {wasm_gzip_base64} from './ext/plissken-bindings/index.js';
+import {to_binding_error} from './errors';
+
+let bindings: Promise<any> | undefined;
+
+function load_bindings(): Promise<any> {
+  if (!bindings) {
+    bindings = instantiate_bindings();
+  }
+
+  return bindings;
+}
+
+async function instantiate_bindings(): Promise<any> {
+  // Defines globalThis.Go. Needs Node.js 18+ or a recent browser.
+  await import('./ext/plissken-bindings/wasm_exec.js');
+  const global = globalThis as any;
+  const gzipped = Uint8Array.from(atob(wasm_gzip_base64), c => c.charCodeAt(0));
+  const wasm = await new Response(new Blob([gzipped]).stream()
+    .pipeThrough(new global.DecompressionStream('gzip'))).arrayBuffer();
+  const go = new global.Go();
+  const {instance} = await WebAssembly.instantiate(wasm, go.importObject);
+  // Runs main() until it blocks, after it set the bindings. Its promise only
+  // resolves when the Go program exits.
+  go.run(instance);
+  if (!global.__plissken_bindings) {
+    throw new Error('plissken bindings failed to load');
+  }
+
+  return global.__plissken_bindings;
+}
+
+/**
+/* Calls the binding `name`.
+/* @throw {BindingError} if the binding failed
+*/
+export async function call_binding(name: string, ...args: string[]): Promise<string> {
+  const b = await load_bindings();
+  const ret = b[name](...args);
+  if (ret.error) {
+    throw to_binding_error(ret.error);
+  }
+
+  return ret.result;
+}
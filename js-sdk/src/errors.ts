@@ -0,0 +1,107 @@
+// Errors thrown when the Plissken server answers with an error. The server
+// sends RFC 9457 problem documents with a stable `code`; each code maps to
+// one of the classes below.
+
+export class PlisskenError extends Error {
+  code: string;
+  status: number;
+  title: string;
+  detail?: string;
+  request_id?: string;
+  constructor(problem: any, status: number) {
+    super(problem.detail || problem.title || `request failed with status ${status}`);
+    this.name = new.target.name;
+    this.code = problem.code || 'unknown';
+    this.status = problem.status || status;
+    this.title = problem.title || '';
+    this.detail = problem.detail;
+    this.request_id = problem.request_id;
+  }
+}
+
+export class BadRequestError extends PlisskenError {}
+export class UserNotFoundError extends PlisskenError {}
+export class UserExistsError extends PlisskenError {}
+// Thrown for both 'invalid_token' and 'nonce_not_found': either way, the user
+// must login again
+export class InvalidTokenError extends PlisskenError {}
+export class InvalidAppSecretError extends PlisskenError {}
+// Thrown when a request authenticated by the session cookie lacks the CSRF
+// header (see csrf_headers())
+export class CSRFError extends PlisskenError {}
+export class StorageUnavailableError extends PlisskenError {}
+export class InternalServerError extends PlisskenError {}
+
+const errorClasses: Record<string, typeof PlisskenError> = {
+  bad_request: BadRequestError,
+  user_not_found: UserNotFoundError,
+  user_exists: UserExistsError,
+  invalid_token: InvalidTokenError,
+  nonce_not_found: InvalidTokenError,
+  invalid_app_secret: InvalidAppSecretError,
+  csrf_failed: CSRFError,
+  storage_unavailable: StorageUnavailableError,
+  internal_error: InternalServerError,
+};
+
+/**
+/* Converts an error thrown by axios into a PlisskenError if the server
+/* answered with a problem document, else returns it as is.
+*/
+export function to_plissken_error(e: any): Error {
+  const response = e && e.response;
+  if (!response) {
+    return e;
+  }
+
+  let problem = response.data;
+  if (typeof problem === 'string') {
+    try {
+      problem = JSON.parse(problem);
+    } catch {
+      problem = {detail: problem};
+    }
+  }
+
+  if (!problem || typeof problem !== 'object') {
+    problem = {};
+  }
+
+  const ErrorClass = errorClasses[problem.code] || PlisskenError;
+  return new ErrorClass(problem, response.status);
+}
+
+// Thrown when the protocol's WebAssembly bindings fail. `code` is one of
+// 'bad_argument', 'wrong_password', 'untrusted_server_key', 'protocol_error'
+// or 'internal_error'.
+export class BindingError extends Error {
+  code: string;
+  constructor(error: {code: string; message: string}) {
+    super(error.message);
+    this.name = new.target.name;
+    this.code = error.code;
+  }
+}
+
+// Thrown when the password can't open the user's envelope
+export class WrongPasswordError extends BindingError {}
+
+// Thrown when the auth-server uses a key that isn't pinned: the user's
+// envelope is sealed for one, or the server registers users with or asks to
+// rotate to one. Pin the new key before rotating the server's.
+export class UntrustedServerKeyError extends BindingError {}
+
+/**
+/* Converts the `error` a binding returned into a BindingError
+*/
+export function to_binding_error(error: {code: string; message: string}): BindingError {
+  if (error.code === 'wrong_password') {
+    return new WrongPasswordError(error);
+  }
+
+  if (error.code === 'untrusted_server_key') {
+    return new UntrustedServerKeyError(error);
+  }
+
+  return new BindingError(error);
+}
@@ -1 +1,2 @@
 export * from './lib';
+export * from './errors';
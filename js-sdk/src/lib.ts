@@ -1,20 +1,59 @@
 import axios from 'axios';
-// XXX <28-03-22, afjoseph> Import JS file and then cast it as any so
-// it works with Typescript, else you'll get "property does not
-// exist on value typeof('blahblah')" errors
-import * as _opaque_client from './ext/plissken-bindings/index.js';
-
-const opaque_client = _opaque_client as any;
+import {call_binding} from './bindings';
+import {to_plissken_error} from './errors';
 
 export function ping(): string {
   return 'pong';
 }
 
+/**
+/* The auth-server's pinned static keys, hex-encoded. Registrations seal the
+/* envelope for the key the server names, or for the first one if it doesn't.
+/* Logins fail with UntrustedServerKeyError if the user's envelope, or the key
+/* the server asks to rotate to, isn't one of them: pin the new key before
+/* rotating the server's.
+*/
+export type ServerPubKeys = string | string[];
+
+// The bindings take the pinned keys comma-separated
+function pinned_keys_arg(keys: ServerPubKeys): string {
+  return Array.isArray(keys) ? keys.join(',') : keys;
+}
+
+/**
+/* POSTs `body` to `route`. `with_credentials` makes the browser send and
+/* store the server's cookies.
+/* @throw {PlisskenError} if the server answered with an error
+*/
+async function post_to_plissken_server(
+  endpoint: string,
+  route: string,
+  body: any,
+  with_credentials = false,
+  headers: Record<string, string> = {},
+): Promise<any> {
+  try {
+    return await axios.post(
+      `${endpoint}${route}`,
+      JSON.stringify(body),
+      {withCredentials: with_credentials, headers},
+    );
+  } catch (e) {
+    throw to_plissken_error(e);
+  }
+}
+
 /**
 /* @throw {Error}
 */
 async function check_endpoint_health(endpoint: string): Promise<void> {
-  const response = await axios.get(`${endpoint}/health`);
+  let response;
+  try {
+    response = await axios.get(`${endpoint}/health`);
+  } catch (e) {
+    throw to_plissken_error(e);
+  }
+
   if (response.status !== 200) {
     throw new Error(`/health route returned bad status code: ${response.status}: ${response.data}`);
   }
@@ -24,9 +63,10 @@ async function start_password_auth_with_plissken_server(
   endpoint: string,
   oprf_request_result: OprfRequestResult,
 ): Promise<StartPasswordAuthenticationData> {
-  const response = await axios.post(
-    `${endpoint}/start_password_authentication`,
-    JSON.stringify(oprf_request_result),
+  const response = await post_to_plissken_server(
+    endpoint,
+    '/start_password_authentication',
+    oprf_request_result,
   );
 
   if (response.status !== 200) {
@@ -39,24 +79,46 @@ async function start_password_auth_with_plissken_server(
 async function finalize_password_auth_with_plissken_server(
   endpoint: string,
   fin_pass_auth_data: FinalizePasswordAutheticationData,
-): Promise<void> {
-  const response = await axios.post(
-    `${endpoint}/finalize_password_authentication`,
-    JSON.stringify(fin_pass_auth_data),
+): Promise<any> {
+  const response = await post_to_plissken_server(
+    endpoint,
+    '/finalize_password_authentication',
+    fin_pass_auth_data,
+    fin_pass_auth_data.session_cookie === true,
   );
   if (response.status !== 200) {
     throw new Error(`/finalize_password_authentication route returned bad status code: ${response.status}: ${response.data}`);
   }
+
+  return response.data;
 }
 
 class OprfServerEvaluation {
   elements: string[];
+  // The key the server registers users with. Unset by servers that predate
+  // key rotation.
+  pub_s?: string;
+  key_id?: string;
+  // Sent back when finalizing the registration. Unset by servers that
+  // predate it.
+  request_id?: string;
   constructor(js_object: any) {
     if (!('elements' in js_object)) {
       throw new Error(`elements not found in OprfServerEvaluation: ${js_object}`);
     }
 
     this.elements = js_object.elements;
+    if ('pub_s' in js_object) {
+      this.pub_s = js_object.pub_s;
+    }
+
+    if ('key_id' in js_object) {
+      this.key_id = js_object.key_id;
+    }
+
+    if ('request_id' in js_object) {
+      this.request_id = js_object.request_id;
+    }
   }
 }
 
@@ -64,46 +126,81 @@ async function start_password_reg_with_plissken_server(
   endpoint: string,
   oprf_request_result: OprfRequestResult,
 ): Promise<OprfServerEvaluation> {
-  try {
-    const response = await axios.post(
-      `${endpoint}/start_password_registration`,
-      JSON.stringify(oprf_request_result),
-    );
-    return new OprfServerEvaluation(response.data);
-  } catch (e) {
-    if (e.response) {
-      throw new Error(`/start_password_registration route returned bad response: ${e.response.status}: ${e.response.data}`);
-    } else {
-      throw e;
-    }
-  }
+  const response = await post_to_plissken_server(
+    endpoint,
+    '/start_password_registration',
+    oprf_request_result,
+  );
+  return new OprfServerEvaluation(response.data);
 }
 
 async function finalize_password_reg_with_plissken_server(
   endpoint: string,
   password_reg_data: PasswordRegistrationData,
 ) {
-  const response = await axios.post(
-    `${endpoint}/finalize_password_registration`,
-    JSON.stringify(password_reg_data),
+  const response = await post_to_plissken_server(
+    endpoint,
+    '/finalize_password_registration',
+    password_reg_data,
   );
-  if (response.status != 200) {
-    throw `/finalize_password_registration route returned bad status code: ${response.status}: ${response.data}`;
+  if (response.status !== 200) {
+    throw new Error(`/finalize_password_registration route returned bad status code: ${response.status}: ${response.data}`);
   }
 }
 
+/**
+/* Logs `username` in and returns the hex-encoded session token.
+/* @throw {WrongPasswordError} if the password is wrong
+/* @throw {UntrustedServerKeyError} if the server uses a key that isn't pinned
+/* @throw {PlisskenError} if the server answered with an error
+*/
 export async function run_password_auth(
   apptoken: string,
   username: string,
   password: string,
-  opaque_server_pub_key: string,
+  opaque_server_pub_key: ServerPubKeys,
   opaque_server_endpoint: string,
 ) {
-  console.log(
-    `Making password authentication request with password: ${password}`,
-  );
+  const {session_token} = await password_auth(
+    apptoken, username, password,
+    opaque_server_pub_key, opaque_server_endpoint, false);
+  return session_token;
+}
+
+/**
+/* Logs in like run_password_auth, but the server keeps the session credential
+/* in an HttpOnly cookie that scripts can't read: the auth-server must have a
+/* `session-cookie` section in its config. Requests to resource servers need
+/* `withCredentials` (or `credentials: 'include'`) and `csrf_headers()`.
+/* @return {string} the CSRF token
+*/
+export async function run_password_auth_with_session_cookie(
+  apptoken: string,
+  username: string,
+  password: string,
+  opaque_server_pub_key: ServerPubKeys,
+  opaque_server_endpoint: string,
+): Promise<string> {
+  const {fin_pass_auth_resp} = await password_auth(
+    apptoken, username, password,
+    opaque_server_pub_key, opaque_server_endpoint, true);
+  if (!fin_pass_auth_resp || !fin_pass_auth_resp.csrf_token) {
+    throw new Error('csrf_token not found in /finalize_password_authentication response');
+  }
+
+  return fin_pass_auth_resp.csrf_token;
+}
+
+async function password_auth(
+  apptoken: string,
+  username: string,
+  password: string,
+  opaque_server_pub_key: ServerPubKeys,
+  opaque_server_endpoint: string,
+  session_cookie: boolean,
+) {
   const oprf_request_result = new OprfRequestResult(
-    JSON.parse(opaque_client.make_oprf_request(apptoken, username, password)));
+    JSON.parse(await call_binding('make_oprf_request', apptoken, username, password)));
   const start_password_auth_data = await start_password_auth_with_plissken_server(
     opaque_server_endpoint,
     oprf_request_result,
@@ -116,20 +213,110 @@ export async function run_password_auth(
   //   )}`,
   // );
 
-  const session_token: string = opaque_client.finalize_password_authentication(
+  const finalized = JSON.parse(await call_binding(
+    'finalize_password_authentication',
     username,
     JSON.stringify(oprf_request_result),
     JSON.stringify(start_password_auth_data),
-    opaque_server_pub_key,
-  );
+    pinned_keys_arg(opaque_server_pub_key),
+  ));
+  const session_token: string = finalized.session_token;
+
+  const fin_pass_auth_data = new FinalizePasswordAutheticationData(
+    apptoken, username, session_token);
+  // Server rotated its key: the binding re-sealed our envelope for the new one
+  if (finalized.envu) {
+    fin_pass_auth_data.envu = finalized.envu;
+    fin_pass_auth_data.envu_nonce = finalized.envu_nonce;
+  }
+
+  if (session_cookie) {
+    fin_pass_auth_data.session_cookie = true;
+  }
 
-  await finalize_password_auth_with_plissken_server(
+  const fin_pass_auth_resp = await finalize_password_auth_with_plissken_server(
     opaque_server_endpoint,
-    new FinalizePasswordAutheticationData(apptoken, username, session_token),
+    fin_pass_auth_data,
   );
 
-  console.log(`session_token: ${session_token}`);
-  return session_token;
+  return {session_token, fin_pass_auth_resp};
+}
+
+/**
+/* Ends the session of `session_token` on the auth-server.
+/* @throw {PlisskenError}
+*/
+export async function logout(
+  apptoken: string,
+  username: string,
+  session_token: string,
+  opaque_server_endpoint: string,
+): Promise<void> {
+  await post_to_plissken_server(
+    opaque_server_endpoint, '/logout', {apptoken}, false,
+    {Authorization: `Bearer ${session_credential(username, session_token)}`});
+}
+
+/**
+/* Ends every session of `username`. `session_token` must still be valid.
+/* @throw {PlisskenError}
+*/
+export async function logout_all(
+  apptoken: string,
+  username: string,
+  session_token: string,
+  opaque_server_endpoint: string,
+): Promise<void> {
+  await post_to_plissken_server(
+    opaque_server_endpoint, '/logout_all', {apptoken}, false,
+    {Authorization: `Bearer ${session_credential(username, session_token)}`});
+}
+
+/**
+/* Logout for sessions started with run_password_auth_with_session_cookie():
+/* ends the cookie's session (or with `all`, every session of its user) and
+/* drops the cookies.
+/* @throw {PlisskenError}
+*/
+export async function logout_with_session_cookie(
+  apptoken: string,
+  csrf_token: string,
+  opaque_server_endpoint: string,
+  all = false,
+): Promise<void> {
+  await post_to_plissken_server(
+    opaque_server_endpoint, all ? '/logout_all' : '/logout', {apptoken}, true,
+    csrf_headers(csrf_token));
+}
+
+export const CSRF_HEADER_NAME = 'X-Plissken-CSRF';
+
+/**
+/* Headers that requests authenticated by the session cookie must carry
+*/
+export function csrf_headers(csrf_token: string): Record<string, string> {
+  return {[CSRF_HEADER_NAME]: csrf_token};
+}
+
+/**
+/* Packs a username and its session token into the credential resource
+/* servers expect in an `Authorization: Bearer` header (see plisskenmw):
+/* base64url(username) + '.' + session_token
+*/
+export function session_credential(
+  username: string,
+  session_token: string,
+): string {
+  let binary = '';
+  for (const b of new TextEncoder().encode(username)) {
+    binary += String.fromCharCode(b);
+  }
+
+  const encoded_username = btoa(binary)
+    .replace(/\+/g, '-')
+    .replace(/\//g, '_')
+    .replace(/=+$/, '');
+  return `${encoded_username}.${session_token}`;
 }
 
 class OprfRequestResult {
@@ -173,6 +360,7 @@ class StartPasswordAuthenticationData {
   envu_nonce: string;
   rwdu_salt: string;
   auth_nonce: string;
+  rotation_pubs?: string;
   constructor(object: any) {
     if (!('elements' in object)) {
       throw new Error(`elements not found in StartPasswordAuthenticationData: ${object}`);
@@ -199,6 +387,9 @@ class StartPasswordAuthenticationData {
     this.envu_nonce = object.envu_nonce;
     this.rwdu_salt = object.rwdu_salt;
     this.auth_nonce = object.auth_nonce;
+    if ('rotation_pubs' in object) {
+      this.rotation_pubs = object.rotation_pubs;
+    }
   }
 }
 
@@ -209,6 +400,8 @@ class PasswordRegistrationData {
   envu_nonce: string;
   pubu: string;
   salt: string;
+  pub_s?: string;
+  request_id: string;
   constructor(object: any) {
     if (!('apptoken' in object)) {
       throw new Error(`apptoken not found in PasswordRegistrationData: ${object}`);
@@ -234,12 +427,20 @@ class PasswordRegistrationData {
       throw new Error(`salt not found in PasswordRegistrationData: ${object}`);
     }
 
+    if (!('request_id' in object)) {
+      throw new Error(`request_id not found in PasswordRegistrationData: ${object}`);
+    }
+
     this.apptoken = object.apptoken;
     this.username = object.username;
     this.envu = object.envu;
     this.envu_nonce = object.envu_nonce;
     this.pubu = object.pubu;
     this.salt = object.salt;
+    this.request_id = object.request_id;
+    if ('pub_s' in object) {
+      this.pub_s = object.pub_s;
+    }
   }
 }
 
@@ -247,6 +448,9 @@ class FinalizePasswordAutheticationData {
   apptoken: string;
   username: string;
   session_token: string;
+  envu?: string;
+  envu_nonce?: string;
+  session_cookie?: boolean;
   constructor(apptoken: string, username: string, session_token: string) {
     this.apptoken = apptoken;
     this.username = username;
@@ -258,25 +462,23 @@ export async function run_password_reg(
   apptoken: string,
   username: string,
   password: string,
-  opaque_server_pub_key: string,
+  opaque_server_pub_key: ServerPubKeys,
   opaque_server_endpoint: string,
 ) {
-  console.log(
-    `Making password registration request with password: ${password}`,
-  );
   const oprf_request_result = new OprfRequestResult(
-    JSON.parse(opaque_client.make_oprf_request(apptoken, username, password)));
+    JSON.parse(await call_binding('make_oprf_request', apptoken, username, password)));
   const oprf_server_eval = await start_password_reg_with_plissken_server(
     opaque_server_endpoint,
     oprf_request_result,
   );
 
   const password_reg_data = new PasswordRegistrationData(
-    JSON.parse(opaque_client.finalize_password_registration(
+    JSON.parse(await call_binding(
+      'finalize_password_registration',
       apptoken, username,
       JSON.stringify(oprf_request_result),
       JSON.stringify(oprf_server_eval),
-      opaque_server_pub_key,
+      pinned_keys_arg(opaque_server_pub_key),
     )));
   await finalize_password_reg_with_plissken_server(
     opaque_server_endpoint,
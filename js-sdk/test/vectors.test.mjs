@@ -0,0 +1,104 @@
+// Runs protocol-lib's known-answer vectors through the WebAssembly bindings,
+// so that they can't drift from the Go client. Needs Node.js 18+ and the
+// bindings generated with `just generate-js-bindings`.
+//
+// Run with: node --test test/
+import assert from 'node:assert/strict';
+import {readFile} from 'node:fs/promises';
+import {test} from 'node:test';
+
+import {wasm_gzip_base64} from '../src/ext/plissken-bindings/index.js';
+
+const vectors_url = new URL(
+  '../../protocol-lib/client/testdata/vectors.json', import.meta.url);
+
+// Same as load_bindings() in src/bindings.ts
+async function load_bindings() {
+  await import('../src/ext/plissken-bindings/wasm_exec.js');
+  const gzipped = Buffer.from(wasm_gzip_base64, 'base64');
+  const wasm = await new Response(new Blob([gzipped]).stream()
+    .pipeThrough(new DecompressionStream('gzip'))).arrayBuffer();
+  const go = new globalThis.Go();
+  const {instance} = await WebAssembly.instantiate(wasm, go.importObject);
+  go.run(instance);
+  return globalThis.__plissken_bindings;
+}
+
+function call(bindings, name, ...args) {
+  const ret = bindings[name](...args);
+  assert.equal(ret.error, undefined, `${name} failed: ${JSON.stringify(ret.error)}`);
+  return ret.result;
+}
+
+const {vectors} = JSON.parse(await readFile(vectors_url, 'utf8'));
+const bindings = await load_bindings();
+
+for (const v of vectors) {
+  test(v.name, () => {
+    // Hashing the password is deterministic, blinding isn't
+    const oprf_request = JSON.parse(
+      call(bindings, 'make_oprf_request', v.apptoken, v.username, v.password));
+    assert.deepEqual(oprf_request.inputs, v.login.oprf_request.inputs);
+
+    const login = JSON.parse(call(bindings, 'finalize_password_authentication',
+      v.username,
+      JSON.stringify(v.login.oprf_request),
+      JSON.stringify(v.login.server_response),
+      v.server_pub_key));
+    assert.equal(login.session_token, v.login.session_token);
+    assert.equal(login.envu, undefined, 'the server did not rotate its key');
+
+    // The bindings' envelopes are random, but must open with the vector's
+    // login. Their salts are always of the current KDF version.
+    const registration = JSON.parse(call(bindings, 'finalize_password_registration',
+      v.apptoken, v.username,
+      JSON.stringify(v.registration.oprf_request),
+      JSON.stringify(v.registration.server_evaluation),
+      v.server_pub_key));
+    for (const field of ['envu', 'envu_nonce', 'pubu']) {
+      assert.equal(registration[field].length,
+        v.registration.registration_data[field].length, field);
+    }
+    assert.equal(registration.request_id, v.registration.server_evaluation.request_id);
+
+    const server_response = {
+      ...v.login.server_response,
+      envu: registration.envu,
+      envu_nonce: registration.envu_nonce,
+      rwdu_salt: registration.salt,
+    };
+    call(bindings, 'finalize_password_authentication',
+      v.username,
+      JSON.stringify(v.login.oprf_request),
+      JSON.stringify(server_response),
+      v.server_pub_key);
+
+    // A tampered envelope looks like a wrong password
+    const envu = v.login.server_response.envu;
+    const tampered = {
+      ...v.login.server_response,
+      envu: (envu.startsWith('00') ? 'ff' : '00') + envu.slice(2),
+    };
+    const ret = bindings.finalize_password_authentication(
+      v.username,
+      JSON.stringify(v.login.oprf_request),
+      JSON.stringify(tampered),
+      v.server_pub_key);
+    assert.equal(ret.error.code, 'wrong_password');
+
+    // The envelope must be sealed for one of the pinned keys
+    const other_key = '09'.repeat(32);
+    const untrusted = bindings.finalize_password_authentication(
+      v.username,
+      JSON.stringify(v.login.oprf_request),
+      JSON.stringify(v.login.server_response),
+      other_key);
+    assert.equal(untrusted.error.code, 'untrusted_server_key');
+    const pinned_login = JSON.parse(call(bindings, 'finalize_password_authentication',
+      v.username,
+      JSON.stringify(v.login.oprf_request),
+      JSON.stringify(v.login.server_response),
+      `${other_key},${v.server_pub_key}`));
+    assert.equal(pinned_login.session_token, v.login.session_token);
+  });
+}
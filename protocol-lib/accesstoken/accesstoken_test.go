@@ -0,0 +1,56 @@
+package accesstoken
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	otherPubKey, _, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	now := time.Unix(1700000000, 0)
+	claims := &Claims{
+		Issuer:    "plissken",
+		Subject:   "bob",
+		Audience:  "my-app",
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(5 * time.Minute).Unix(),
+	}
+	token, err := Sign(privKey, claims)
+	require.NoError(t, err)
+	require.True(t, LooksLikeToken(token))
+
+	got, err := Verify(pubKey, token, now)
+	require.NoError(t, err)
+	require.Equal(t, claims, got)
+
+	_, err = Verify(pubKey, token, now.Add(5*time.Minute))
+	require.True(t, errors.Is(err, ErrExpired), err)
+	_, err = Verify(otherPubKey, token, now)
+	require.True(t, errors.Is(err, ErrInvalid), err)
+
+	parts := strings.Split(token, ".")
+	for _, bad := range []string{
+		"",
+		"a.b",
+		// Another algorithm
+		base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) +
+			"." + parts[1] + ".",
+		// Other claims
+		parts[0] + "." +
+			base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"alice","aud":"my-app","exp":9999999999}`)) +
+			"." + parts[2],
+		parts[0] + "." + parts[1] + ".!!",
+	} {
+		_, err = Verify(pubKey, bad, now)
+		require.True(t, errors.Is(err, ErrInvalid), bad)
+	}
+}
@@ -5,20 +5,31 @@ import (
 
 	"crypto/aes"
 	"crypto/cipher"
-	cryptoRand "crypto/rand"
 	"crypto/sha256"
 
 	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/server"
 	"github.com/cloudflare/circl/dh/x25519"
 	"github.com/cloudflare/circl/oprf"
 	"github.com/pkg/errors"
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/hkdf"
 )
 
+// ErrWrongPassword is returned when envU can't be decrypted with the password
+var ErrWrongPassword = errors.New("wrong password")
+
+// MakeOprfRequest is Config.MakeOprfRequest with the default Config
 func MakeOprfRequest(password string) (
+	inputs [][]byte,
+	finData *oprf.FinalizeData,
+	evalReq *oprf.EvaluationRequest,
+	err error) {
+	return (&Config{}).MakeOprfRequest(password)
+}
+
+func (c *Config) MakeOprfRequest(password string) (
 	// Used to recreate the OPRF request client-side when passing it
-	// back-and-forth to GopherJS. This means that the server-side doesn't need
+	// back-and-forth to the JS bindings. This means that the server-side doesn't need
 	// this.
 	inputs [][]byte,
 	// Used, along with evalReq, as the OPRF request results
@@ -33,7 +44,10 @@ func MakeOprfRequest(password string) (
 	if err != nil {
 		return nil, nil, nil, errors.Wrap(err, "")
 	}
-	finData, evalReq, err = oprf.NewClient(common.OprfSuiteID).Blind([][]byte{b})
+	// Not Blind(): it always uses crypto/rand
+	blind := common.G.RandomScalar(c.rand())
+	finData, evalReq, err = oprf.NewClient(common.OprfSuiteID).
+		DeterministicBlind([][]byte{b}, []oprf.Blind{blind})
 	if err != nil {
 		return nil, nil, nil, errors.Wrap(err, "")
 	}
@@ -44,6 +58,13 @@ func finalizeRequest(
 	finData *oprf.FinalizeData,
 	eval *oprf.Evaluation,
 ) ([][]byte, error) {
+	if finData == nil {
+		return nil, errors.New("missing OPRF finalize data")
+	}
+	err := common.CheckEvaluation(eval)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
 	b, err := oprf.NewClient(common.OprfSuiteID).Finalize(finData, eval)
 	if err != nil {
 		return nil, errors.Wrap(err, "oprf.NewClient")
@@ -54,36 +75,18 @@ func finalizeRequest(
 	return b, nil
 }
 
-func hardenOprfResult(
-	x []byte, precomputedSalt []byte,
-) (rwdU []byte, salt []byte, err error) {
-	if precomputedSalt != nil {
-		salt = precomputedSalt
-	} else {
-		salt = make([]byte, 32)
-		_, err = cryptoRand.Read(salt)
-		if err != nil {
-			return nil, nil, errors.Wrap(err, "")
-		}
-	}
-	key := argon2.IDKey(x, salt,
-		1,
-		// TODO <15-04-2022, afjoseph> This is significantly less secure than
-		// the amount we need in a production context (something around
-		// 64*1024). We're doing it like this since the GopherJS generated code
-		// is insanely slow on JS (takes about 10 seconds). Later, we'll
-		// implement Argon2 in JS and it'll be much faster.
-		128,
-		4, 32)
-	if len(key) == 0 {
-		return nil, nil, errors.New("Key is nil or empty")
-	}
-	return key, salt, nil
+// MakeEnvU is Config.MakeEnvU with the default Config
+func MakeEnvU(
+	finData *oprf.FinalizeData,
+	eval *oprf.Evaluation,
+	pubS x25519.Key,
+) (envU, envUNonce, pubU, salt []byte, err error) {
+	return (&Config{}).MakeEnvU(finData, eval, pubS)
 }
 
 // Construction of the encrypted envU is:
 // ciphertext + tag + nonce
-func MakeEnvU(
+func (c *Config) MakeEnvU(
 	finData *oprf.FinalizeData,
 	eval *oprf.Evaluation,
 	pubS x25519.Key,
@@ -96,18 +99,66 @@ func MakeEnvU(
 	if err != nil {
 		return nil, nil, nil, nil, errors.Wrap(err, "finalizeRequest")
 	}
-	rwdU, salt, err := hardenOprfResult(oprfRet[0], nil)
+	salt, err = newKDFSalt(c.rand())
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrap(err, "")
+	}
+	rwdU, err := hardenOprfResult(oprfRet[0], salt)
 	if err != nil {
 		return nil, nil, nil, nil, errors.Wrap(err, "hardenOprfResult")
 	}
 
 	var privU, pubUAsKey x25519.Key
-	_, err = io.ReadFull(cryptoRand.Reader, privU[:])
+	_, err = io.ReadFull(c.rand(), privU[:])
 	if err != nil {
 		return nil, nil, nil, nil, errors.Wrap(err, "")
 	}
 	x25519.KeyGen(&pubUAsKey, &privU)
 
+	envU, nonce, err := sealEnvU(c.rand(), rwdU, privU, pubS)
+	if err != nil {
+		return nil, nil, nil, nil, errors.Wrap(err, "sealEnvU")
+	}
+	return envU, nonce, pubUAsKey[:], salt, nil
+}
+
+// RewrapEnvU is Config.RewrapEnvU with the default Config
+func RewrapEnvU(
+	finData *oprf.FinalizeData,
+	eval *oprf.Evaluation,
+	envU,
+	envUNonce,
+	rwdUSalt []byte,
+	newPubS x25519.Key,
+) (newEnvU, newEnvUNonce []byte, err error) {
+	return (&Config{}).RewrapEnvU(finData, eval, envU, envUNonce, rwdUSalt, newPubS)
+}
+
+// RewrapEnvU decrypts the user's envU and re-seals it for 'newPubS', keeping
+// the same privU. It doesn't check that 'newPubS' is pinned: logins should use
+// FinalizeLogin, which does.
+func (c *Config) RewrapEnvU(
+	finData *oprf.FinalizeData,
+	eval *oprf.Evaluation,
+	envU,
+	envUNonce,
+	rwdUSalt []byte,
+	newPubS x25519.Key,
+) (newEnvU, newEnvUNonce []byte, err error) {
+	env, err := openEnvU(finData, eval, envU, envUNonce, rwdUSalt)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	return env.reseal(c.rand(), newPubS)
+}
+
+// sealEnvU encodes (privU, pubS) and encrypts it with a key derived from rwdU.
+// The nonce is read from 'rand'.
+func sealEnvU(
+	rand io.Reader,
+	rwdU []byte,
+	privU, pubS x25519.Key,
+) (envU, envUNonce []byte, err error) {
 	// Encoding envU
 	encodedEnvU := []byte{}
 	encodedEnvU = append(encodedEnvU, privU[:]...)
@@ -122,26 +173,26 @@ func MakeEnvU(
 	aesKey := make([]byte, 16) // AES128-GCM
 	_, err = io.ReadFull(kdfr, aesKey)
 	if err != nil {
-		return nil, nil, nil, nil, errors.Wrap(err, "io.readfull")
+		return nil, nil, errors.Wrap(err, "io.readfull")
 	}
 
 	// AES128-GCM encryption
 	ciph, err := aes.NewCipher(aesKey)
 	if err != nil {
-		return nil, nil, nil, nil, errors.Wrap(err, "aes.newcipher")
+		return nil, nil, errors.Wrap(err, "aes.newcipher")
 	}
-	nonce := make([]byte, 12)
-	_, err = cryptoRand.Read(nonce)
+	nonce := make([]byte, common.EnvUNonceSize)
+	_, err = io.ReadFull(rand, nonce)
 	if err != nil {
-		return nil, nil, nil, nil, errors.Wrap(err, "cryptorand.read")
+		return nil, nil, errors.Wrap(err, "cryptorand.read")
 	}
 	aesGcm, err := cipher.NewGCM(ciph)
 	if err != nil {
-		return nil, nil, nil, nil, errors.Wrap(err, "cipher.newgcm")
+		return nil, nil, errors.Wrap(err, "cipher.newgcm")
 	}
 	envU = aesGcm.Seal(nil, nonce, encodedEnvU, nil)
 	// envU = append(envU, nonce...)
-	return envU, nonce, pubUAsKey[:], salt, nil
+	return envU, nonce, nil
 }
 
 func DeriveSessionToken(
@@ -152,12 +203,96 @@ func DeriveSessionToken(
 	rwdUSalt,
 	authNonce []byte,
 ) ([]byte, error) {
+	env, err := openEnvU(finData, eval, envU, envUNonce, rwdUSalt)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return env.sessionToken(authNonce)
+}
+
+// FinalizeLogin is Config.FinalizeLogin with the default Config
+func FinalizeLogin(
+	finData *oprf.FinalizeData,
+	startResp *common.StartPasswordAuthServerResp,
+	pinned []x25519.Key,
+) (sessionToken, newEnvU, newEnvUNonce []byte, err error) {
+	return (&Config{}).FinalizeLogin(finData, startResp, pinned)
+}
+
+// FinalizeLogin opens the envelope of the server's start_password_authentication
+// response and derives the session token. It fails with ErrUntrustedServerKey
+// if the envelope is sealed for a key that isn't in 'pinned', or if the server
+// asks to rotate to one. If the server asked for a rotation, the envelope is
+// also re-sealed for the new key: send it in FinalizePasswordAuthData.
+func (c *Config) FinalizeLogin(
+	finData *oprf.FinalizeData,
+	startResp *common.StartPasswordAuthServerResp,
+	pinned []x25519.Key,
+) (sessionToken, newEnvU, newEnvUNonce []byte, err error) {
+	env, err := openEnvU(finData, startResp.Eval,
+		startResp.EnvU, startResp.EnvUNonce, startResp.RwdUSalt)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "")
+	}
+	// The envelope says which key the server proves itself with: unless it's
+	// pinned, we may be talking to someone else
+	if !isPinned(pinned, *env.pubS) {
+		return nil, nil, nil, errors.Wrapf(ErrUntrustedServerKey,
+			"envelope is sealed for %s", server.KeyFingerprint(*env.pubS))
+	}
+	sessionToken, err = env.sessionToken(startResp.AuthNonce)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "")
+	}
+	if startResp.RotationPubS == nil {
+		return sessionToken, nil, nil, nil
+	}
+	newPubS, err := common.ParseX25519Key("rotation_pubs", startResp.RotationPubS)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "")
+	}
+	if !isPinned(pinned, newPubS) {
+		return nil, nil, nil, errors.Wrapf(ErrUntrustedServerKey,
+			"server asked to rotate to %s", server.KeyFingerprint(newPubS))
+	}
+	newEnvU, newEnvUNonce, err = env.reseal(c.rand(), newPubS)
+	if err != nil {
+		return nil, nil, nil, errors.Wrap(err, "")
+	}
+	return sessionToken, newEnvU, newEnvUNonce, nil
+}
+
+func isPinned(pinned []x25519.Key, pubS x25519.Key) bool {
+	for _, k := range pinned {
+		if k == pubS {
+			return true
+		}
+	}
+	return false
+}
+
+// openedEnvU is a decrypted envU, along with the rwdU that sealed it. It lets
+// a login derive the session token, check pubS and re-seal envU while only
+// hardening the OPRF result once.
+type openedEnvU struct {
+	rwdU  []byte
+	privU *x25519.Key
+	pubS  *x25519.Key
+}
+
+func openEnvU(
+	finData *oprf.FinalizeData,
+	eval *oprf.Evaluation,
+	envU,
+	envUNonce,
+	rwdUSalt []byte,
+) (*openedEnvU, error) {
 	oprfRet, err := finalizeRequest(finData, eval)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
 
-	rwdU, _, err := hardenOprfResult(oprfRet[0], rwdUSalt)
+	rwdU, err := hardenOprfResult(oprfRet[0], rwdUSalt)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
@@ -167,10 +302,13 @@ func DeriveSessionToken(
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
+	return &openedEnvU{rwdU: rwdU, privU: privU, pubS: pubS}, nil
+}
 
+func (e *openedEnvU) sessionToken(authNonce []byte) ([]byte, error) {
 	// Derive shared key
 	var sharedKey x25519.Key
-	ok := x25519.Shared(&sharedKey, privU, pubS)
+	ok := x25519.Shared(&sharedKey, e.privU, e.pubS)
 	if !ok {
 		return nil, errors.New("while deriving session key")
 	}
@@ -180,7 +318,7 @@ func DeriveSessionToken(
 	// x25519.Key + len(authNonce) instead of appending later
 	b := make([]byte, x25519.Size)
 	kdfr := hkdf.New(sha256.New, sharedKey[:], authNonce, nil)
-	_, err = io.ReadFull(kdfr, b)
+	_, err := io.ReadFull(kdfr, b)
 	if err != nil {
 		return nil, errors.Wrap(err, "")
 	}
@@ -190,6 +328,10 @@ func DeriveSessionToken(
 	return st, nil
 }
 
+func (e *openedEnvU) reseal(rand io.Reader, newPubS x25519.Key) (envU, envUNonce []byte, err error) {
+	return sealEnvU(rand, e.rwdU, *e.privU, newPubS)
+}
+
 // Construction of the encrypted envU is:
 // ciphertext + tag + nonce
 func decryptEnvU(
@@ -214,12 +356,25 @@ func decryptEnvU(
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "")
 	}
-	encodedEnvU, err := aesGcm.Open(nil, envUNonce, envU, nil)
+	err = common.CheckSize("envu_nonce", envUNonce, aesGcm.NonceSize())
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
+	err = common.CheckSize("envu", envU, common.EnvUSize)
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "")
 	}
-	var privU, pubS x25519.Key
+	encodedEnvU, err := aesGcm.Open(nil, envUNonce, envU, nil)
+	if err != nil {
+		// Either the password is wrong, or envU was tampered with: we can't
+		// tell them apart
+		return nil, nil, errors.Wrap(ErrWrongPassword, err.Error())
+	}
+	var privU x25519.Key
 	copy(privU[:], encodedEnvU[:x25519.Size])
-	copy(pubS[:], encodedEnvU[x25519.Size:])
+	pubS, err := common.ParseX25519Key("envu's pubS", encodedEnvU[x25519.Size:])
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
+	}
 	return &privU, &pubS, nil
 }
@@ -0,0 +1,31 @@
+package client
+
+import (
+	cryptoRand "crypto/rand"
+	"io"
+	"time"
+)
+
+// Config is where the client gets its randomness and the time from. The zero
+// value uses crypto/rand and time.Now. Tests replace them to make the client
+// deterministic, like the vectors in testdata/vectors.json do.
+type Config struct {
+	// Rand makes blinds, KDF salts, privU and envU's nonces
+	Rand io.Reader
+	// Now tells whether access tokens expired: see Session.BearerToken
+	Now func() time.Time
+}
+
+func (c *Config) rand() io.Reader {
+	if c.Rand == nil {
+		return cryptoRand.Reader
+	}
+	return c.Rand
+}
+
+func (c *Config) now() time.Time {
+	if c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
@@ -0,0 +1,338 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/pkg/errors"
+)
+
+// ErrUntrustedServerKey is returned when the auth-server uses a static key
+// that isn't pinned, e.g. in HTTPClient.ServerPubKeys
+var ErrUntrustedServerKey = errors.New("server static key isn't pinned")
+
+// maxResponseSize bounds the auth-server's responses: they're a few hundred
+// bytes
+const maxResponseSize = 1 << 20
+
+// HTTPClient registers and logs users in with an auth-server, like the JS SDK
+// does
+type HTTPClient struct {
+	// Endpoint is the auth-server's base URL, e.g.
+	// "https://plissken-auth-server.fly.dev"
+	Endpoint string
+
+	// ServerPubKeys are the pinned static public keys of the auth-server.
+	// Registrations seal envelopes for the key the server names, or for the
+	// first one if it doesn't. Registrations and logins fail with
+	// ErrUntrustedServerKey if that key, the user's envelope, or the key the
+	// server asks to rotate to, isn't one of them: pin the new key here before
+	// rotating the server's.
+	ServerPubKeys []x25519.Key
+
+	// HTTPClient sends the requests. Defaults to http.DefaultClient.
+	HTTPClient *http.Client
+
+	// SessionCookie asks the auth-server to set the session credential in
+	// an HttpOnly cookie on login. Give HTTPClient a cookie jar to keep it.
+	SessionCookie bool
+
+	// Config is where registrations and logins get their randomness, and
+	// sessions the time, from. The zero value is fine.
+	Config Config
+}
+
+// Session is a logged-in user. Resource servers check it with the
+// auth-server's /check-credentials.
+type Session struct {
+	AppToken string
+	Username string
+	Token    []byte
+	// AccessToken is only set if the auth-server signs access tokens. They let
+	// resource servers authenticate the user without calling the auth-server.
+	AccessToken          string
+	AccessTokenExpiresAt time.Time
+	// CSRFToken is only set if HTTPClient.SessionCookie is. Requests
+	// authenticated by the session cookie send it in the
+	// common.CSRFHeaderName header.
+	CSRFToken string
+
+	now func() time.Time
+}
+
+// HexToken returns the session token as the auth-server expects it
+func (s *Session) HexToken() string {
+	return hex.EncodeToString(s.Token)
+}
+
+// BearerToken returns what to send resource servers in an 'Authorization:
+// Bearer' header: the access token if there's one and it didn't expire, else
+// the session credential (see common.EncodeSessionCredential)
+func (s *Session) BearerToken() string {
+	if s.AccessToken != "" && !s.accessTokenExpired() {
+		return s.AccessToken
+	}
+	return common.EncodeSessionCredential(s.Username, s.Token)
+}
+
+func (s *Session) accessTokenExpired() bool {
+	if s.AccessTokenExpiresAt.IsZero() {
+		return false
+	}
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+	return !now().Before(s.AccessTokenExpiresAt)
+}
+
+// ProblemError is an error response of the auth-server: see
+// auth-server/server/errors.go. Its Unwrap() maps the code to the protocol's
+// errors, so errors.Is(err, server.ErrUserExists) works.
+type ProblemError struct {
+	StatusCode int    `json:"status"`
+	Code       string `json:"code"`
+	Title      string `json:"title"`
+	Detail     string `json:"detail"`
+	RequestID  string `json:"request_id"`
+}
+
+var problemCodeErrors = map[string]error{
+	"user_not_found":      server.ErrUserNotFound,
+	"user_exists":         server.ErrUserExists,
+	"nonce_not_found":     server.ErrNonceNotFound,
+	"invalid_token":       server.ErrInvalidToken,
+	"storage_unavailable": server.ErrStorageUnavailable,
+}
+
+func (e *ProblemError) Error() string {
+	msg := e.Detail
+	if msg == "" {
+		msg = e.Title
+	}
+	if msg == "" {
+		msg = http.StatusText(e.StatusCode)
+	}
+	if e.Code != "" {
+		msg = fmt.Sprintf("%s (%s)", msg, e.Code)
+	}
+	return fmt.Sprintf("auth-server answered %d: %s", e.StatusCode, msg)
+}
+
+func (e *ProblemError) Unwrap() error {
+	return problemCodeErrors[e.Code]
+}
+
+// NewHTTPClient returns a client of the auth-server at 'endpoint' that trusts
+// 'serverPubKeys'
+func NewHTTPClient(endpoint string, serverPubKeys ...x25519.Key) *HTTPClient {
+	return &HTTPClient{
+		Endpoint:      strings.TrimSuffix(endpoint, "/"),
+		ServerPubKeys: serverPubKeys,
+	}
+}
+
+// Register registers 'username' with 'password' for the app 'apptoken'. It
+// fails with server.ErrUserExists if the user is already registered, and with
+// ErrUntrustedServerKey if the server registers users with a key that isn't
+// pinned.
+func (c *HTTPClient) Register(ctx context.Context, apptoken, username, password string) error {
+	if len(c.ServerPubKeys) == 0 {
+		return errors.New("no pinned server public key")
+	}
+	inputs, finData, evalReq, err := c.Config.MakeOprfRequest(password)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	var evalResp common.OprfServerEvaluation
+	err = c.post(ctx, "/start_password_registration",
+		&common.OprfRequestResults{
+			Username: username,
+			AppToken: apptoken,
+			Inputs:   inputs,
+			FinData:  finData,
+			EvalReq:  evalReq,
+		}, &evalResp)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+
+	// Seal envU for the key the server registers users with. Servers that
+	// predate key rotation don't say: use ours.
+	pubS := c.ServerPubKeys[0]
+	if evalResp.PubS != nil {
+		// Validated by UnmarshalJSON
+		copy(pubS[:], evalResp.PubS)
+		if !isPinned(c.ServerPubKeys, pubS) {
+			return errors.Wrapf(ErrUntrustedServerKey,
+				"server registers users with %s", server.KeyFingerprint(pubS))
+		}
+	}
+	envU, envUNonce, pubU, salt, err := c.Config.MakeEnvU(finData, evalResp.Eval, pubS)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	err = c.post(ctx, "/finalize_password_registration",
+		&common.PasswordRegistrationData{
+			Username:  username,
+			AppToken:  apptoken,
+			EnvU:      envU,
+			EnvUNonce: envUNonce,
+			PubU:      pubU,
+			Salt:      salt,
+			PubS:      pubS[:],
+			RequestID: evalResp.RequestID,
+		}, nil)
+	return errors.Wrap(err, "")
+}
+
+// Login logs 'username' in. It fails with ErrWrongPassword if 'password' is
+// wrong, and with server.ErrUserNotFound if the user isn't registered.
+//
+// If the server asks for it, the user's envelope is re-sealed for the
+// server's newest static key.
+func (c *HTTPClient) Login(ctx context.Context, apptoken, username, password string) (*Session, error) {
+	inputs, finData, evalReq, err := c.Config.MakeOprfRequest(password)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	var startResp common.StartPasswordAuthServerResp
+	err = c.post(ctx, "/start_password_authentication",
+		&common.OprfRequestResults{
+			Username: username,
+			AppToken: apptoken,
+			Inputs:   inputs,
+			FinData:  finData,
+			EvalReq:  evalReq,
+		}, &startResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	sessionToken, newEnvU, newEnvUNonce, err := c.Config.FinalizeLogin(
+		finData, &startResp, c.ServerPubKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+
+	finReq := &common.FinalizePasswordAuthData{
+		Username:      username,
+		AppToken:      apptoken,
+		SessionToken:  hex.EncodeToString(sessionToken),
+		SessionCookie: c.SessionCookie,
+	}
+	if newEnvU != nil {
+		finReq.EnvU = hex.EncodeToString(newEnvU)
+		finReq.EnvUNonce = hex.EncodeToString(newEnvUNonce)
+	}
+	var finResp common.FinalizePasswordAuthServerResp
+	err = c.post(ctx, "/finalize_password_authentication", finReq, &finResp)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	session := &Session{
+		AppToken:    apptoken,
+		Username:    username,
+		Token:       sessionToken,
+		AccessToken: finResp.AccessToken,
+		CSRFToken:   finResp.CSRFToken,
+		now:         c.Config.now,
+	}
+	if finResp.AccessTokenExpiresAt != 0 {
+		session.AccessTokenExpiresAt = time.Unix(finResp.AccessTokenExpiresAt, 0)
+	}
+	return session, nil
+}
+
+// Logout ends 'session' on the auth-server. Resource servers that cache
+// session checks may still accept it for a little while.
+func (c *HTTPClient) Logout(ctx context.Context, session *Session) error {
+	return c.logout(ctx, "/logout", session)
+}
+
+// LogoutAll ends every session of the user of 'session'
+func (c *HTTPClient) LogoutAll(ctx context.Context, session *Session) error {
+	return c.logout(ctx, "/logout_all", session)
+}
+
+func (c *HTTPClient) logout(ctx context.Context, route string, session *Session) error {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+
+		common.EncodeSessionCredential(session.Username, session.Token))
+	err := c.postWithHeader(ctx, route, header,
+		&common.LogoutData{AppToken: session.AppToken}, nil)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	return nil
+}
+
+// post sends 'body' as JSON to 'route' and, if 'resp' isn't nil, decodes the
+// response into it. Error responses are returned as *ProblemError.
+func (c *HTTPClient) post(ctx context.Context, route string, body, resp interface{}) error {
+	return c.postWithHeader(ctx, route, nil, body, resp)
+}
+
+// postWithHeader is post with extra request headers
+func (c *HTTPClient) postWithHeader(
+	ctx context.Context,
+	route string,
+	header http.Header,
+	body, resp interface{},
+) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(c.Endpoint, "/")+route, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	httpResp, err := httpClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "while calling %s", route)
+	}
+	defer httpResp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(httpResp.Body, maxResponseSize))
+	if err != nil {
+		return errors.Wrapf(err, "while reading the response of %s", route)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		problem := &ProblemError{}
+		// Not every error is a problem document, e.g. a proxy's: keep the
+		// status code anyway
+		_ = json.Unmarshal(respBody, problem)
+		problem.StatusCode = httpResp.StatusCode
+		return errors.WithStack(problem)
+	}
+	// Older auth-servers answer some routes with an empty body
+	if resp == nil || len(respBody) == 0 {
+		return nil
+	}
+	err = json.Unmarshal(respBody, resp)
+	if err != nil {
+		return errors.Wrapf(err, "while decoding the response of %s", route)
+	}
+	return nil
+}
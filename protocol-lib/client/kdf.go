@@ -0,0 +1,87 @@
+package client
+
+import (
+	"io"
+
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// KDFParams are the Argon2id parameters hardening the OPRF's output into rwdU
+type KDFParams struct {
+	Time      uint32
+	MemoryKiB uint32
+	Threads   uint8
+}
+
+// A user's KDF parameters are picked at registration and can't change until
+// they register again, so they're versioned and the version is stored with
+// the salt: a versioned salt is the version's byte followed by
+// kdfSaltSize random bytes. The server stores it as is.
+//
+// Salts of registrations made before versioning are kdfSaltSize bytes long
+// and use LegacyKDFParams.
+const (
+	kdfSaltSize = common.RwdUSaltSize
+	kdfKeySize  = 32
+
+	// CurrentKDFVersion is the version of new registrations
+	CurrentKDFVersion byte = 1
+)
+
+var kdfVersions = map[byte]KDFParams{
+	// RFC 9106's second recommended option
+	1: {Time: 3, MemoryKiB: 64 * 1024, Threads: 4},
+}
+
+// LegacyKDFParams were used when the client ran as GopherJS, where anything
+// stronger took seconds. Only for registrations made back then.
+var LegacyKDFParams = KDFParams{Time: 1, MemoryKiB: 128, Threads: 4}
+
+// KDFParamsForVersion returns the parameters of a KDF version
+func KDFParamsForVersion(version byte) (KDFParams, error) {
+	params, ok := kdfVersions[version]
+	if !ok {
+		return KDFParams{}, errors.Errorf("unknown KDF version %d", version)
+	}
+	return params, nil
+}
+
+// newKDFSalt returns a salt of the current KDF version, read from 'rand'
+func newKDFSalt(rand io.Reader) ([]byte, error) {
+	salt := make([]byte, 1+kdfSaltSize)
+	salt[0] = CurrentKDFVersion
+	_, err := io.ReadFull(rand, salt[1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return salt, nil
+}
+
+// kdfParamsForSalt returns the parameters a user's salt was made for
+func kdfParamsForSalt(salt []byte) (KDFParams, error) {
+	switch len(salt) {
+	case kdfSaltSize:
+		return LegacyKDFParams, nil
+	case 1 + kdfSaltSize:
+		return KDFParamsForVersion(salt[0])
+	default:
+		return KDFParams{}, errors.Errorf("bad KDF salt length %d", len(salt))
+	}
+}
+
+// hardenOprfResult derives rwdU from the OPRF's output 'x' and the user's
+// 'salt'. Registrations make a new salt with newKDFSalt.
+func hardenOprfResult(x []byte, salt []byte) (rwdU []byte, err error) {
+	params, err := kdfParamsForSalt(salt)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	key := argon2.IDKey(x, salt,
+		params.Time, params.MemoryKiB, params.Threads, kdfKeySize)
+	if len(key) == 0 {
+		return nil, errors.New("Key is nil or empty")
+	}
+	return key, nil
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+)
+
+func TestKDFVersions(t *testing.T) {
+	x := []byte("oprf output")
+
+	salt, err := newKDFSalt(rand.Reader)
+	require.NoError(t, err)
+	require.Len(t, salt, 1+kdfSaltSize)
+	require.Equal(t, CurrentKDFVersion, salt[0])
+	rwdU, err := hardenOprfResult(x, salt)
+	require.NoError(t, err)
+	again, err := hardenOprfResult(x, salt)
+	require.NoError(t, err)
+	require.Equal(t, rwdU, again)
+
+	// Registrations made before versioning keep their parameters
+	legacySalt := bytes.Repeat([]byte{0xaa}, kdfSaltSize)
+	rwdU, err = hardenOprfResult(x, legacySalt)
+	require.NoError(t, err)
+	require.Equal(t, argon2.IDKey(x, legacySalt,
+		LegacyKDFParams.Time, LegacyKDFParams.MemoryKiB,
+		LegacyKDFParams.Threads, kdfKeySize), rwdU)
+
+	unknownVersion := append([]byte{0xff}, legacySalt...)
+	_, err = hardenOprfResult(x, unknownVersion)
+	require.Error(t, err)
+	_, err = hardenOprfResult(x, legacySalt[:16])
+	require.Error(t, err)
+}
+
+// BenchmarkHardenOprfResult is the cost of the KDF on every registration and
+// login. Run it as WASM with 'just bench-plissken-protocol-wasm' to see what
+// browsers pay.
+func BenchmarkHardenOprfResult(b *testing.B) {
+	x := []byte("oprf output")
+	salts := map[string][]byte{
+		"legacy": bytes.Repeat([]byte{0xaa}, kdfSaltSize),
+	}
+	for version := range kdfVersions {
+		salts[fmt.Sprintf("v%d", version)] = append(
+			[]byte{version}, bytes.Repeat([]byte{0xaa}, kdfSaltSize)...)
+	}
+	for name, salt := range salts {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				_, err := hardenOprfResult(x, salt)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
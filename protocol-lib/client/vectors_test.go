@@ -0,0 +1,210 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/afjoseph/plissken-protocol/server"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/sha3"
+)
+
+var updateVectors = flag.Bool("update-vectors", false,
+	"rewrite testdata/vectors.json instead of checking it")
+
+var vectorsPath = filepath.Join("testdata", "vectors.json")
+
+// The vectors pin the bytes clients and servers exchange, so that changing
+// the KDF, HKDF labels, envU's layout or the serialization breaks this test
+// instead of deployed clients. The JS bindings run them too: see
+// js-sdk/test/vectors.test.mjs.
+type vectorFile struct {
+	Comment string    `json:"comment"`
+	Vectors []*vector `json:"vectors"`
+}
+
+type vector struct {
+	Name string `json:"name"`
+	// Seeds the client's and the server's randomness: see seededRand
+	Seed          string `json:"seed"`
+	AppToken      string `json:"apptoken"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	ServerPrivKey string `json:"server_priv_key"`
+	ServerPubKey  string `json:"server_pub_key"`
+	Registration  struct {
+		OprfRequest      json.RawMessage `json:"oprf_request"`
+		ServerEvaluation json.RawMessage `json:"server_evaluation"`
+		RegistrationData json.RawMessage `json:"registration_data"`
+	} `json:"registration"`
+	Login struct {
+		OprfRequest    json.RawMessage `json:"oprf_request"`
+		ServerResponse json.RawMessage `json:"server_response"`
+		SessionToken   string          `json:"session_token"`
+	} `json:"login"`
+}
+
+// seededRand returns a deterministic stream of "random" bytes: SHAKE256 of
+// 'seed' and 'label'
+func seededRand(seed, label string) io.Reader {
+	h := sha3.NewShake256()
+	h.Write([]byte(seed + "/" + label))
+	return h
+}
+
+// makeVector registers and logs a user in with deterministic randomness. A
+// 'legacy' vector is registered with the KDF parameters older clients used.
+func makeVector(t *testing.T, name, seed string, legacy bool) *vector {
+	ctx := context.Background()
+	cfg := &Config{Rand: seededRand(seed, "client")}
+	v := &vector{
+		Name:     name,
+		Seed:     seed,
+		AppToken: "vectors-app",
+		Username: "bob",
+		Password: "correct horse battery staple",
+	}
+	privS := make([]byte, x25519.Size)
+	_, err := io.ReadFull(seededRand(seed, "server key"), privS)
+	require.NoError(t, err)
+	srv, err := server.NewServer(server.NewMemoryStorage(), privS,
+		server.WithRand(seededRand(seed, "server")))
+	require.NoError(t, err)
+	v.ServerPrivKey = hex.EncodeToString(privS)
+	v.ServerPubKey = hex.EncodeToString(srv.PubS[:])
+
+	// Registration
+	inputs, finData, evalReq, err := cfg.MakeOprfRequest(v.Password)
+	require.NoError(t, err)
+	v.Registration.OprfRequest = mustMarshal(t, &common.OprfRequestResults{
+		Username: v.Username,
+		AppToken: v.AppToken,
+		Inputs:   inputs,
+		FinData:  finData,
+		EvalReq:  evalReq,
+	})
+	eval, requestID, err := srv.HandleNewUserRequest(ctx, v.AppToken, v.Username, evalReq)
+	require.NoError(t, err)
+	v.Registration.ServerEvaluation = mustMarshal(t,
+		&common.OprfServerEvaluation{Eval: eval, RequestID: requestID})
+	var envU, envUNonce, pubU, salt []byte
+	if legacy {
+		envU, envUNonce, pubU, salt = makeLegacyEnvU(t, cfg, finData, eval, srv.PubS)
+	} else {
+		envU, envUNonce, pubU, salt, err = cfg.MakeEnvU(finData, eval, srv.PubS)
+		require.NoError(t, err)
+	}
+	v.Registration.RegistrationData = mustMarshal(t, &common.PasswordRegistrationData{
+		Username:  v.Username,
+		AppToken:  v.AppToken,
+		EnvU:      envU,
+		EnvUNonce: envUNonce,
+		PubU:      pubU,
+		Salt:      salt,
+		RequestID: requestID,
+	})
+	require.NoError(t, srv.StoreUserData(ctx, v.AppToken, v.Username, requestID,
+		pubU, envU, envUNonce, salt, srv.PubS[:]))
+
+	// Login
+	inputs, finData, evalReq, err = cfg.MakeOprfRequest(v.Password)
+	require.NoError(t, err)
+	v.Login.OprfRequest = mustMarshal(t, &common.OprfRequestResults{
+		Username: v.Username,
+		AppToken: v.AppToken,
+		Inputs:   inputs,
+		FinData:  finData,
+		EvalReq:  evalReq,
+	})
+	eval, envU, envUNonce, salt, authNonce, err := srv.HandleNewUserAuthentication(
+		ctx, v.AppToken, v.Username, evalReq)
+	require.NoError(t, err)
+	v.Login.ServerResponse = mustMarshal(t, &common.StartPasswordAuthServerResp{
+		Eval:      eval,
+		EnvU:      envU,
+		EnvUNonce: envUNonce,
+		RwdUSalt:  salt,
+		AuthNonce: authNonce,
+	})
+	sessionToken, err := DeriveSessionToken(finData, eval, envU, envUNonce, salt, authNonce)
+	require.NoError(t, err)
+	ok, err := srv.IsAuthenticated(ctx, v.AppToken, v.Username, sessionToken)
+	require.NoError(t, err)
+	require.True(t, ok)
+	v.Login.SessionToken = hex.EncodeToString(sessionToken)
+	return v
+}
+
+// makeLegacyEnvU is MakeEnvU with a salt of LegacyKDFParams
+func makeLegacyEnvU(
+	t *testing.T,
+	cfg *Config,
+	finData *oprf.FinalizeData,
+	eval *oprf.Evaluation,
+	pubS x25519.Key,
+) (envU, envUNonce, pubU, salt []byte) {
+	oprfRet, err := finalizeRequest(finData, eval)
+	require.NoError(t, err)
+	salt = make([]byte, kdfSaltSize)
+	_, err = io.ReadFull(cfg.rand(), salt)
+	require.NoError(t, err)
+	rwdU, err := hardenOprfResult(oprfRet[0], salt)
+	require.NoError(t, err)
+	var privU, pubUAsKey x25519.Key
+	_, err = io.ReadFull(cfg.rand(), privU[:])
+	require.NoError(t, err)
+	x25519.KeyGen(&pubUAsKey, &privU)
+	envU, envUNonce, err = sealEnvU(cfg.rand(), rwdU, privU, pubS)
+	require.NoError(t, err)
+	return envU, envUNonce, pubUAsKey[:], salt
+}
+
+func mustMarshal(t *testing.T, v interface{}) json.RawMessage {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return b
+}
+
+func TestVectors(t *testing.T) {
+	file := &vectorFile{
+		Comment: "Generated by 'go test ./client -run TestVectors -update-vectors'. " +
+			"Changing them breaks deployed clients.",
+		Vectors: []*vector{
+			makeVector(t, "registration and login", "plissken vector 1", false),
+			makeVector(t, "login with legacy KDF parameters", "plissken vector 2", true),
+		},
+	}
+	b, err := json.MarshalIndent(file, "", "  ")
+	require.NoError(t, err)
+	b = append(b, '\n')
+	if *updateVectors {
+		require.NoError(t, os.WriteFile(vectorsPath, b, 0o644))
+	}
+	expected, err := os.ReadFile(vectorsPath)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(expected, b),
+		"the protocol's messages changed: if that's on purpose, rerun with -update-vectors")
+
+	// Logins decode the messages as they're in the file, like the JS bindings
+	// do
+	for _, v := range file.Vectors {
+		oprfReq := &common.OprfRequestResults{}
+		require.NoError(t, json.Unmarshal(v.Login.OprfRequest, oprfReq))
+		resp := &common.StartPasswordAuthServerResp{}
+		require.NoError(t, json.Unmarshal(v.Login.ServerResponse, resp))
+		sessionToken, err := DeriveSessionToken(oprfReq.FinData, resp.Eval,
+			resp.EnvU, resp.EnvUNonce, resp.RwdUSalt, resp.AuthNonce)
+		require.NoError(t, err, v.Name)
+		require.Equal(t, v.Login.SessionToken, hex.EncodeToString(sessionToken), v.Name)
+	}
+}
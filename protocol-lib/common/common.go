@@ -75,25 +75,31 @@ func (d *OprfRequestResults) UnmarshalJSON(data []byte) error {
 	d.Username = di.Username
 	d.AppToken = di.AppToken
 
+	if len(d.HexEncodedInputs) != OprfBatchSize {
+		return invalid("inputs", "%d inputs, expected %d",
+			len(d.HexEncodedInputs), OprfBatchSize)
+	}
 	d.Inputs = [][]byte{}
 	for _, sin := range d.HexEncodedInputs {
-		in, err := hex.DecodeString(sin)
+		in, err := decodeHex("inputs", sin)
 		if err != nil {
-			return errors.Wrap(err, "")
+			return err
+		}
+		if len(in) == 0 {
+			return invalid("inputs", "empty input")
 		}
 		d.Inputs = append(d.Inputs, in)
 	}
 
+	if len(d.HexEncodedBlinds) != len(d.Inputs) {
+		return invalid("blinds", "%d blinds for %d inputs",
+			len(d.HexEncodedBlinds), len(d.Inputs))
+	}
 	blinds := []oprf.Blind{}
 	for _, sbl := range d.HexEncodedBlinds {
-		blAsByteSlice, err := hex.DecodeString(sbl)
+		bl, err := decodeScalar("blinds", sbl)
 		if err != nil {
-			return errors.Wrap(err, "")
-		}
-		bl := G.NewScalar()
-		err = bl.UnmarshalBinary(blAsByteSlice)
-		if err != nil {
-			return errors.Wrap(err, "")
+			return err
 		}
 		blinds = append(blinds, bl)
 	}
@@ -101,19 +107,44 @@ func (d *OprfRequestResults) UnmarshalJSON(data []byte) error {
 	d.FinData, d.EvalReq, err = oprf.NewClient(OprfSuiteID).
 		DeterministicBlind(d.Inputs, blinds)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return invalid("inputs", "%v", err)
 	}
 
+	// The evaluation request is recomputed from the inputs and blinds: if
+	// it's sent too, it must match
+	if d.HexEncodedEvalReqElements != nil {
+		elements, err := decodeElements("eval_req_elements",
+			d.HexEncodedEvalReqElements)
+		if err != nil {
+			return err
+		}
+		for i, el := range elements {
+			if !el.IsEqual(d.EvalReq.Elements[i]) {
+				return invalid("eval_req_elements",
+					"doesn't match the inputs and blinds")
+			}
+		}
+	}
 	return nil
 }
 
 type OprfServerEvaluation struct {
 	*innerOprfServerEvaluation
 	Eval *oprf.Evaluation `json:"-"`
+	// The server's current static key and its ID: the key to seal envU for.
+	// Unset by servers that predate key rotation.
+	PubS  []byte `json:"-"`
+	KeyID string `json:"-"`
+	// Identifies this registration: the client sends it back when
+	// finalizing, so that another start call can't replace it in between
+	RequestID []byte `json:"-"`
 }
 
 type innerOprfServerEvaluation struct {
-	HexEncodedElements []string `json:"elements"`
+	HexEncodedElements  []string `json:"elements"`
+	HexEncodedPubS      string   `json:"pub_s,omitempty"`
+	KeyID               string   `json:"key_id,omitempty"`
+	HexEncodedRequestID string   `json:"request_id,omitempty"`
 }
 
 func (d *OprfServerEvaluation) MarshalJSON() ([]byte, error) {
@@ -127,7 +158,10 @@ func (d *OprfServerEvaluation) MarshalJSON() ([]byte, error) {
 	}
 
 	return json.Marshal(&innerOprfServerEvaluation{
-		HexEncodedElements: arr,
+		HexEncodedElements:  arr,
+		HexEncodedPubS:      hex.EncodeToString(d.PubS),
+		KeyID:               d.KeyID,
+		HexEncodedRequestID: hex.EncodeToString(d.RequestID),
 	})
 }
 
@@ -139,19 +173,31 @@ func (d *OprfServerEvaluation) UnmarshalJSON(data []byte) error {
 	}
 	d.innerOprfServerEvaluation = di
 
-	d.Eval = &oprf.Evaluation{}
-	d.Eval.Elements = []oprf.Evaluated{}
-	for _, hsel := range d.HexEncodedElements {
-		sel, err := hex.DecodeString(hsel)
+	elements, err := decodeElements("elements", d.HexEncodedElements)
+	if err != nil {
+		return err
+	}
+	d.Eval = &oprf.Evaluation{Elements: elements}
+	d.KeyID = di.KeyID
+	if di.HexEncodedPubS != "" {
+		d.PubS, err = decodeHex("pub_s", di.HexEncodedPubS)
+		if err != nil {
+			return err
+		}
+		_, err = ParseX25519Key("pub_s", d.PubS)
 		if err != nil {
-			return errors.Wrap(err, "")
+			return err
 		}
-		el := G.NewElement()
-		err = el.UnmarshalBinary(sel)
+	}
+	if di.HexEncodedRequestID != "" {
+		d.RequestID, err = decodeHex("request_id", di.HexEncodedRequestID)
+		if err != nil {
+			return err
+		}
+		err = CheckSize("request_id", d.RequestID, RequestIDSize)
 		if err != nil {
-			return errors.Wrap(err, "")
+			return err
 		}
-		d.Eval.Elements = append(d.Eval.Elements, el)
 	}
 	return nil
 }
@@ -164,6 +210,11 @@ type PasswordRegistrationData struct {
 	EnvUNonce []byte `json:"-"`
 	PubU      []byte `json:"-"`
 	Salt      []byte `json:"-"`
+	// The server key envU is sealed for. Clients that predate key rotation
+	// don't send it.
+	PubS []byte `json:"-"`
+	// The RequestID of the OprfServerEvaluation this registration finalizes
+	RequestID []byte `json:"-"`
 }
 
 type innerPasswordRegistrationData struct {
@@ -173,6 +224,8 @@ type innerPasswordRegistrationData struct {
 	HexEncodedEnvUNonce string `json:"envu_nonce"`
 	HexEncodedPubU      string `json:"pubu"`
 	HexEncodedSalt      string `json:"salt"`
+	HexEncodedPubS      string `json:"pub_s,omitempty"`
+	HexEncodedRequestID string `json:"request_id"`
 }
 
 func (d *PasswordRegistrationData) MarshalJSON() ([]byte, error) {
@@ -183,6 +236,8 @@ func (d *PasswordRegistrationData) MarshalJSON() ([]byte, error) {
 		HexEncodedEnvUNonce: hex.EncodeToString(d.EnvUNonce),
 		HexEncodedPubU:      hex.EncodeToString(d.PubU),
 		HexEncodedSalt:      hex.EncodeToString(d.Salt),
+		HexEncodedPubS:      hex.EncodeToString(d.PubS),
+		HexEncodedRequestID: hex.EncodeToString(d.RequestID),
 	})
 }
 
@@ -190,29 +245,67 @@ func (d *PasswordRegistrationData) UnmarshalJSON(data []byte) error {
 	di := &innerPasswordRegistrationData{}
 	err := json.Unmarshal(data, di)
 	if err != nil {
-		return err
+		return errors.Wrap(err, "")
 	}
 	d.innerPasswordRegistrationData = di
 
 	d.Username = d.innerPasswordRegistrationData.Username
 	d.AppToken = d.innerPasswordRegistrationData.AppToken
-	d.EnvU, err = hex.DecodeString(d.HexEncodedEnvU)
+	d.EnvU, err = decodeHex("envu", d.HexEncodedEnvU)
 	if err != nil {
 		return err
 	}
-	d.EnvUNonce, err = hex.DecodeString(d.HexEncodedEnvUNonce)
+	d.EnvUNonce, err = decodeHex("envu_nonce", d.HexEncodedEnvUNonce)
 	if err != nil {
 		return err
 	}
-	d.PubU, err = hex.DecodeString(d.HexEncodedPubU)
+	d.PubU, err = decodeHex("pubu", d.HexEncodedPubU)
 	if err != nil {
 		return err
 	}
-	d.Salt, err = hex.DecodeString(d.HexEncodedSalt)
+	d.Salt, err = decodeHex("salt", d.HexEncodedSalt)
 	if err != nil {
 		return err
 	}
-	return nil
+	if d.HexEncodedPubS != "" {
+		d.PubS, err = decodeHex("pub_s", d.HexEncodedPubS)
+		if err != nil {
+			return err
+		}
+	}
+	d.RequestID, err = decodeHex("request_id", d.HexEncodedRequestID)
+	if err != nil {
+		return err
+	}
+	return d.Validate()
+}
+
+// Validate checks the sizes of the envelope's fields and of the request ID,
+// and that pubU and pubS aren't low-order points
+func (d *PasswordRegistrationData) Validate() error {
+	err := CheckSize("request_id", d.RequestID, RequestIDSize)
+	if err != nil {
+		return err
+	}
+	if d.PubS != nil {
+		_, err := ParseX25519Key("pub_s", d.PubS)
+		if err != nil {
+			return err
+		}
+	}
+	err = CheckSize("envu", d.EnvU, EnvUSize)
+	if err != nil {
+		return err
+	}
+	err = CheckSize("envu_nonce", d.EnvUNonce, EnvUNonceSize)
+	if err != nil {
+		return err
+	}
+	_, err = ParseX25519Key("pubu", d.PubU)
+	if err != nil {
+		return err
+	}
+	return CheckRwdUSalt("salt", d.Salt)
 }
 
 // type SerializedEncryptedUserData struct {
@@ -287,14 +380,18 @@ type StartPasswordAuthServerResp struct {
 	EnvUNonce []byte           `json:"-"`
 	RwdUSalt  []byte           `json:"-"`
 	AuthNonce []byte           `json:"-"`
+	// Set when the server wants the client to re-seal envU for its newest
+	// static key. nil otherwise.
+	RotationPubS []byte `json:"-"`
 }
 
 type innerStartPasswordAuthServerResp struct {
-	HexEncodedElements  []string `json:"elements"`
-	HexEncodedEnvU      string   `json:"envu"`
-	HexEncodedEnvUNonce string   `json:"envu_nonce"`
-	HexEncodedRwdUSalt  string   `json:"rwdu_salt"`
-	HexEncodedAuthNonce string   `json:"auth_nonce"`
+	HexEncodedElements     []string `json:"elements"`
+	HexEncodedEnvU         string   `json:"envu"`
+	HexEncodedEnvUNonce    string   `json:"envu_nonce"`
+	HexEncodedRwdUSalt     string   `json:"rwdu_salt"`
+	HexEncodedAuthNonce    string   `json:"auth_nonce"`
+	HexEncodedRotationPubS string   `json:"rotation_pubs,omitempty"`
 }
 
 func (d *StartPasswordAuthServerResp) MarshalJSON() ([]byte, error) {
@@ -308,11 +405,12 @@ func (d *StartPasswordAuthServerResp) MarshalJSON() ([]byte, error) {
 	}
 
 	return json.Marshal(&innerStartPasswordAuthServerResp{
-		HexEncodedElements:  elements,
-		HexEncodedEnvU:      hex.EncodeToString(d.EnvU),
-		HexEncodedEnvUNonce: hex.EncodeToString(d.EnvUNonce),
-		HexEncodedRwdUSalt:  hex.EncodeToString(d.RwdUSalt),
-		HexEncodedAuthNonce: hex.EncodeToString(d.AuthNonce),
+		HexEncodedElements:     elements,
+		HexEncodedEnvU:         hex.EncodeToString(d.EnvU),
+		HexEncodedEnvUNonce:    hex.EncodeToString(d.EnvUNonce),
+		HexEncodedRwdUSalt:     hex.EncodeToString(d.RwdUSalt),
+		HexEncodedAuthNonce:    hex.EncodeToString(d.AuthNonce),
+		HexEncodedRotationPubS: hex.EncodeToString(d.RotationPubS),
 	})
 }
 
@@ -323,35 +421,53 @@ func (d *StartPasswordAuthServerResp) UnmarshalJSON(data []byte) error {
 		return errors.Wrap(err, "")
 	}
 	d.innerStartPasswordAuthServerResp = di
-	d.Eval = &oprf.Evaluation{}
-	d.Eval.Elements = []oprf.Evaluated{}
-	for _, hsel := range d.HexEncodedElements {
-		sel, err := hex.DecodeString(hsel)
-		if err != nil {
-			return errors.Wrap(err, "")
-		}
-		el := G.NewElement()
-		err = el.UnmarshalBinary(sel)
-		if err != nil {
-			return errors.Wrap(err, "")
-		}
-		d.Eval.Elements = append(d.Eval.Elements, el)
+
+	elements, err := decodeElements("elements", d.HexEncodedElements)
+	if err != nil {
+		return err
 	}
-	d.EnvU, err = hex.DecodeString(d.HexEncodedEnvU)
+	d.Eval = &oprf.Evaluation{Elements: elements}
+	d.EnvU, err = decodeHex("envu", d.HexEncodedEnvU)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return err
 	}
-	d.EnvUNonce, err = hex.DecodeString(d.HexEncodedEnvUNonce)
+	err = CheckSize("envu", d.EnvU, EnvUSize)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return err
 	}
-	d.RwdUSalt, err = hex.DecodeString(d.HexEncodedRwdUSalt)
+	d.EnvUNonce, err = decodeHex("envu_nonce", d.HexEncodedEnvUNonce)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return err
 	}
-	d.AuthNonce, err = hex.DecodeString(d.HexEncodedAuthNonce)
+	err = CheckSize("envu_nonce", d.EnvUNonce, EnvUNonceSize)
 	if err != nil {
-		return errors.Wrap(err, "")
+		return err
+	}
+	d.RwdUSalt, err = decodeHex("rwdu_salt", d.HexEncodedRwdUSalt)
+	if err != nil {
+		return err
+	}
+	err = CheckRwdUSalt("rwdu_salt", d.RwdUSalt)
+	if err != nil {
+		return err
+	}
+	d.AuthNonce, err = decodeHex("auth_nonce", d.HexEncodedAuthNonce)
+	if err != nil {
+		return err
+	}
+	err = CheckSize("auth_nonce", d.AuthNonce, AuthNonceSize)
+	if err != nil {
+		return err
+	}
+	if d.HexEncodedRotationPubS != "" {
+		d.RotationPubS, err = decodeHex("rotation_pubs", d.HexEncodedRotationPubS)
+		if err != nil {
+			return err
+		}
+		_, err = ParseX25519Key("rotation_pubs", d.RotationPubS)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -360,4 +476,28 @@ type FinalizePasswordAuthData struct {
 	Username     string `json:"username"`
 	AppToken     string `json:"apptoken"`
 	SessionToken string `json:"session_token"`
+	// Hex-encoded envU and its nonce, re-sealed for the server's newest
+	// static key. Only set if the server asked for a key rotation.
+	EnvU      string `json:"envu,omitempty"`
+	EnvUNonce string `json:"envu_nonce,omitempty"`
+	// Asks the server to set the session credential in an HttpOnly cookie.
+	// Only browsers need it.
+	SessionCookie bool `json:"session_cookie,omitempty"`
+}
+
+// FinalizePasswordAuthServerResp is the response to a finalized login. The
+// access token is only set if the auth-server signs them: see package
+// accesstoken.
+type FinalizePasswordAuthServerResp struct {
+	AccessToken          string `json:"access_token,omitempty"`
+	AccessTokenExpiresAt int64  `json:"access_token_expires_at,omitempty"`
+	// Only set if a session cookie was asked for: the value to send in the
+	// CSRF header. It's also in the CSRF cookie.
+	CSRFToken string `json:"csrf_token,omitempty"`
+}
+
+// LogoutData is the body of /logout and /logout_all. The session credential
+// is sent as 'Authorization: Bearer <credential>', or in the session cookie.
+type LogoutData struct {
+	AppToken string `json:"apptoken"`
 }
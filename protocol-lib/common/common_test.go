@@ -1,10 +1,15 @@
 package common
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"strings"
 	"testing"
 
+	"github.com/cloudflare/circl/dh/x25519"
 	"github.com/cloudflare/circl/oprf"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/require"
 )
 
@@ -29,3 +34,130 @@ func TestSerializations(t *testing.T) {
 		require.Equal(t, ret.EvalReq, ret2.EvalReq)
 	})
 }
+
+func TestSessionCredential(t *testing.T) {
+	for _, username := range []string{"bob", "bob.o'brien:élan/+", "b"} {
+		cred := EncodeSessionCredential(username, []byte{0xde, 0xad})
+		require.NotContains(t, cred[:len(cred)-5], ".")
+		gotUsername, gotToken, err := DecodeSessionCredential(cred)
+		require.NoError(t, err)
+		require.Equal(t, username, gotUsername)
+		require.Equal(t, "dead", gotToken)
+	}
+	for _, bad := range []string{"", "dead", ".dead", "Ym9i.zz", "Ym9i.dead.beef", "!!.dead"} {
+		_, _, err := DecodeSessionCredential(bad)
+		require.Error(t, err, bad)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	requireInvalid := func(t *testing.T, err error) {
+		t.Helper()
+		require.Error(t, err)
+		require.True(t, errors.Is(err, ErrInvalidMessage), err.Error())
+	}
+
+	t.Run("x25519 keys", func(t *testing.T) {
+		var priv, pub x25519.Key
+		priv[0] = 42
+		x25519.KeyGen(&pub, &priv)
+		_, err := ParseX25519Key("key", pub[:])
+		require.NoError(t, err)
+
+		_, err = ParseX25519Key("key", pub[1:])
+		requireInvalid(t, err)
+		// 0 and 1 are both of low order
+		lowOrder := make([]byte, x25519.Size)
+		_, err = ParseX25519Key("key", lowOrder)
+		requireInvalid(t, err)
+		lowOrder[0] = 1
+		_, err = ParseX25519Key("key", lowOrder)
+		requireInvalid(t, err)
+	})
+
+	t.Run("OprfRequestResults", func(t *testing.T) {
+		finData, evalReq, err := oprf.NewClient(OprfSuiteID).
+			Blind([][]byte{[]byte("bunnyfoofoo")})
+		require.NoError(t, err)
+		b, err := json.Marshal(&OprfRequestResults{
+			Inputs:  [][]byte{[]byte("bunnyfoofoo")},
+			FinData: finData,
+			EvalReq: evalReq,
+		})
+		require.NoError(t, err)
+		valid := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(b, &valid))
+
+		n := int(G.Params().ScalarLength)
+		otherElement, err := G.RandomElement(rand.Reader).MarshalBinaryCompress()
+		require.NoError(t, err)
+		for name, tc := range map[string]struct {
+			field string
+			value interface{}
+		}{
+			"no inputs":         {"inputs", []string{}},
+			"two inputs":        {"inputs", []string{"aa", "bb"}},
+			"bad hex":           {"inputs", []string{"zz"}},
+			"missing blind":     {"blinds", []string{}},
+			"zero blind":        {"blinds", []string{hex.EncodeToString(make([]byte, n))}},
+			"long blind":        {"blinds", []string{hex.EncodeToString(make([]byte, n+1))}},
+			"unreduced blind":   {"blinds", []string{strings.Repeat("ff", n)}},
+			"identity element":  {"eval_req_elements", []string{"00"}},
+			"off-curve element": {"eval_req_elements", []string{"02" + strings.Repeat("ff", 32)}},
+			"other element":     {"eval_req_elements", []string{hex.EncodeToString(otherElement)}},
+		} {
+			t.Run(name, func(t *testing.T) {
+				msg := map[string]interface{}{}
+				for k, v := range valid {
+					msg[k] = v
+				}
+				msg[tc.field] = tc.value
+				b, err := json.Marshal(msg)
+				require.NoError(t, err)
+				var d OprfRequestResults
+				requireInvalid(t, json.Unmarshal(b, &d))
+			})
+		}
+	})
+
+	t.Run("StartPasswordAuthServerResp", func(t *testing.T) {
+		element, err := G.RandomElement(rand.Reader).MarshalBinaryCompress()
+		require.NoError(t, err)
+		valid := map[string]interface{}{
+			"elements":   []string{hex.EncodeToString(element)},
+			"envu":       strings.Repeat("aa", EnvUSize),
+			"envu_nonce": strings.Repeat("aa", EnvUNonceSize),
+			"rwdu_salt":  strings.Repeat("aa", 1+RwdUSaltSize),
+			"auth_nonce": strings.Repeat("aa", AuthNonceSize),
+		}
+		b, err := json.Marshal(valid)
+		require.NoError(t, err)
+		var d StartPasswordAuthServerResp
+		require.NoError(t, json.Unmarshal(b, &d))
+
+		for name, tc := range map[string]struct {
+			field string
+			value interface{}
+		}{
+			"no elements":        {"elements", []string{}},
+			"identity element":   {"elements", []string{"00"}},
+			"short envu":         {"envu", strings.Repeat("aa", EnvUSize-1)},
+			"short envu nonce":   {"envu_nonce", "aa"},
+			"bad salt":           {"rwdu_salt", strings.Repeat("aa", RwdUSaltSize+2)},
+			"long auth nonce":    {"auth_nonce", strings.Repeat("aa", AuthNonceSize+1)},
+			"low-order rotation": {"rotation_pubs", strings.Repeat("00", x25519.Size)},
+		} {
+			t.Run(name, func(t *testing.T) {
+				msg := map[string]interface{}{}
+				for k, v := range valid {
+					msg[k] = v
+				}
+				msg[tc.field] = tc.value
+				b, err := json.Marshal(msg)
+				require.NoError(t, err)
+				var d StartPasswordAuthServerResp
+				requireInvalid(t, json.Unmarshal(b, &d))
+			})
+		}
+	})
+}
@@ -0,0 +1,54 @@
+package common
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Browser clients can keep their session credential in an HttpOnly cookie
+// instead of sending it themselves. Cookie-authenticated requests must then
+// prove they aren't forged by another site: they echo the CSRF cookie's value
+// in the CSRF header (the double-submit pattern).
+const (
+	SessionCookieName = "plissken_session"
+	CSRFCookieName    = "plissken_csrf"
+	CSRFHeaderName    = "X-Plissken-CSRF"
+)
+
+// A session credential packs a username and its hex-encoded session token
+// into a single string, so that both fit in an 'Authorization: Bearer' header
+// or a cookie:
+//
+//	base64url(username) + "." + hex(session token)
+//
+// The username is encoded since it may contain anything.
+
+// EncodeSessionCredential returns the session credential of 'username'
+func EncodeSessionCredential(username string, sessionToken []byte) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(username)) +
+		"." + hex.EncodeToString(sessionToken)
+}
+
+// DecodeSessionCredential splits a session credential into the username and
+// the hex-encoded session token
+func DecodeSessionCredential(cred string) (username, hexSessionToken string, err error) {
+	parts := strings.Split(cred, ".")
+	if len(parts) != 2 {
+		return "", "", errors.New("malformed session credential")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", "", errors.Wrap(err, "while decoding username")
+	}
+	if len(b) == 0 {
+		return "", "", errors.New("empty username")
+	}
+	_, err = hex.DecodeString(parts[1])
+	if err != nil {
+		return "", "", errors.Wrap(err, "while decoding session token")
+	}
+	return string(b), parts[1], nil
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// message is what every type with an UnmarshalJSON in this package is
+type message interface {
+	json.Marshaler
+	json.Unmarshaler
+}
+
+// fuzzMessage checks that decoding anything into the message returned by
+// 'newMessage' doesn't panic, and that what decodes re-encodes to something
+// that decodes the same. Seeds are in testdata/fuzz.
+func fuzzMessage(f *testing.F, newMessage func() message) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		msg := newMessage()
+		if json.Unmarshal(data, msg) != nil {
+			return
+		}
+		b, err := json.Marshal(msg)
+		if err != nil {
+			t.Fatalf("decoded message doesn't encode: %v", err)
+		}
+		again := newMessage()
+		err = json.Unmarshal(b, again)
+		if err != nil {
+			t.Fatalf("encoded message doesn't decode: %v: %s", err, b)
+		}
+		b2, err := json.Marshal(again)
+		if err != nil {
+			t.Fatalf("decoded message doesn't encode: %v", err)
+		}
+		if !bytes.Equal(b, b2) {
+			t.Fatalf("message changed after a round-trip:\n%s\n%s", b, b2)
+		}
+	})
+}
+
+func FuzzOprfRequestResults(f *testing.F) {
+	fuzzMessage(f, func() message { return &OprfRequestResults{} })
+}
+
+func FuzzOprfServerEvaluation(f *testing.F) {
+	fuzzMessage(f, func() message { return &OprfServerEvaluation{} })
+}
+
+func FuzzPasswordRegistrationData(f *testing.F) {
+	fuzzMessage(f, func() message { return &PasswordRegistrationData{} })
+}
+
+func FuzzStartPasswordAuthServerResp(f *testing.F) {
+	fuzzMessage(f, func() message { return &StartPasswordAuthServerResp{} })
+}
@@ -0,0 +1,186 @@
+package common
+
+import (
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/group"
+	"github.com/cloudflare/circl/oprf"
+	"github.com/pkg/errors"
+)
+
+// Sizes of the protocol's messages. Decoding a message of another size fails
+// with a *ValidationError.
+const (
+	// OprfBatchSize is how many elements the OPRF evaluates per request: the
+	// password's
+	OprfBatchSize = 1
+	// EnvUNonceSize is the size of envU's AES-GCM nonce
+	EnvUNonceSize = 12
+	// EnvUSize is the size of envU: privU and pubS, and AES-GCM's tag
+	EnvUSize = 2*x25519.Size + 16
+	// AuthNonceSize is the size of the nonce the server sends on login
+	AuthNonceSize = 12
+	// RwdUSaltSize is the size of the Argon2id salt of registrations made
+	// before KDF versioning. Newer salts have a version byte in front.
+	RwdUSaltSize = 32
+	// RequestIDSize is the size of the ID the server gives each registration
+	RequestIDSize = 16
+)
+
+// scalarSize is the size of a P256 scalar
+const scalarSize = 32
+
+// ErrInvalidMessage is matched by every *ValidationError
+var ErrInvalidMessage = errors.New("invalid message")
+
+// ValidationError is returned when a field of a protocol message is
+// malformed: a bad length, an invalid group element, a weak key...
+type ValidationError struct {
+	Field  string
+	Reason string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Field, e.Reason)
+}
+
+func (e *ValidationError) Is(target error) bool {
+	return target == ErrInvalidMessage
+}
+
+func invalid(field, format string, args ...interface{}) error {
+	return errors.WithStack(&ValidationError{
+		Field:  field,
+		Reason: fmt.Sprintf(format, args...),
+	})
+}
+
+// CheckSize fails if 'b' isn't 'size' bytes long
+func CheckSize(field string, b []byte, size int) error {
+	if len(b) != size {
+		return invalid(field, "%d bytes, expected %d", len(b), size)
+	}
+	return nil
+}
+
+// CheckRwdUSalt fails if 'salt' can't be an Argon2id salt: see RwdUSaltSize
+func CheckRwdUSalt(field string, salt []byte) error {
+	if len(salt) != RwdUSaltSize && len(salt) != 1+RwdUSaltSize {
+		return invalid(field, "%d bytes, expected %d or %d",
+			len(salt), RwdUSaltSize, 1+RwdUSaltSize)
+	}
+	return nil
+}
+
+// ParseX25519Key decodes an x25519 public key. Low-order points are
+// rejected: every shared secret derived from them is zero.
+func ParseX25519Key(field string, b []byte) (x25519.Key, error) {
+	var key x25519.Key
+	err := CheckSize(field, b, x25519.Size)
+	if err != nil {
+		return key, err
+	}
+	copy(key[:], b)
+	// Any private key does: x25519 clamps it to a multiple of the cofactor,
+	// so x25519.Shared only fails for low-order points
+	var priv, shared x25519.Key
+	priv[0] = 1
+	if !x25519.Shared(&shared, &priv, &key) {
+		return key, invalid(field, "low-order point")
+	}
+	return key, nil
+}
+
+// decodeHex decodes the hex-encoded field 'field'
+func decodeHex(field, s string) ([]byte, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, invalid(field, "bad hex: %v", err)
+	}
+	return b, nil
+}
+
+// decodeElements decodes hex-encoded group elements. There must be
+// OprfBatchSize of them, none the identity.
+func decodeElements(field string, hexElements []string) ([]group.Element, error) {
+	if len(hexElements) != OprfBatchSize {
+		return nil, invalid(field, "%d elements, expected %d",
+			len(hexElements), OprfBatchSize)
+	}
+	elements := []group.Element{}
+	for _, hexElement := range hexElements {
+		b, err := decodeHex(field, hexElement)
+		if err != nil {
+			return nil, err
+		}
+		el := G.NewElement()
+		err = el.UnmarshalBinary(b)
+		if err != nil {
+			return nil, invalid(field, "not a P256 point")
+		}
+		if el.IsIdentity() {
+			return nil, invalid(field, "identity element")
+		}
+		elements = append(elements, el)
+	}
+	return elements, nil
+}
+
+// decodeScalar decodes a hex-encoded, non-zero scalar
+func decodeScalar(field, s string) (group.Scalar, error) {
+	b, err := decodeHex(field, s)
+	if err != nil {
+		return nil, err
+	}
+	// circl panics on longer scalars, and doesn't reduce them
+	err = CheckSize(field, b, scalarSize)
+	if err != nil {
+		return nil, err
+	}
+	if new(big.Int).SetBytes(b).Cmp(elliptic.P256().Params().N) >= 0 {
+		return nil, invalid(field, "scalar isn't reduced")
+	}
+	sc := G.NewScalar()
+	err = sc.UnmarshalBinary(b)
+	if err != nil {
+		return nil, invalid(field, "not a P256 scalar")
+	}
+	if sc.IsZero() {
+		return nil, invalid(field, "zero scalar")
+	}
+	return sc, nil
+}
+
+// CheckEvaluationRequest fails unless 'req' has OprfBatchSize elements, none
+// the identity. Servers call it before evaluating requests decoded elsewhere.
+func CheckEvaluationRequest(req *oprf.EvaluationRequest) error {
+	if req == nil {
+		return invalid("evaluation request", "missing")
+	}
+	return checkElements("evaluation request", req.Elements)
+}
+
+// CheckEvaluation is CheckEvaluationRequest for the server's evaluation
+func CheckEvaluation(eval *oprf.Evaluation) error {
+	if eval == nil {
+		return invalid("evaluation", "missing")
+	}
+	return checkElements("evaluation", eval.Elements)
+}
+
+func checkElements(field string, elements []group.Element) error {
+	if len(elements) != OprfBatchSize {
+		return invalid(field, "%d elements, expected %d",
+			len(elements), OprfBatchSize)
+	}
+	for _, el := range elements {
+		if el == nil || el.IsIdentity() {
+			return invalid(field, "identity element")
+		}
+	}
+	return nil
+}
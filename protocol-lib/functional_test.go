@@ -3,137 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"testing"
 
 	plisskenclient "github.com/afjoseph/plissken-protocol/client"
+	plisskencommon "github.com/afjoseph/plissken-protocol/common"
 	plisskenserver "github.com/afjoseph/plissken-protocol/server"
-	"github.com/alicebob/miniredis/v2"
-	"github.com/pkg/errors"
-	"github.com/sirupsen/logrus"
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/oprf"
 	"github.com/stretchr/testify/require"
 )
 
 const testAppToken = "testAppToken"
 
-type testStorageImpl struct {
-	r *miniredis.Miniredis
-}
-
-func redisKey_UserEnvelope(apptoken, username string) string {
-	return fmt.Sprintf("auth:%s:%s:envelope", apptoken, username)
-}
-
-func redisKey_UserRequest(apptoken, username string) string {
-	return fmt.Sprintf("auth:%s:%s:request", apptoken, username)
-}
-
-// Unused but useful to keep here just for reference
-// func redisKey_SessionToken(apptoken, username string) string {
-// 	return fmt.Sprintf("auth:%s:%s:token", apptoken, username)
-// }
-
-func redisKey_AuthNonces(apptoken, username string) string {
-	return fmt.Sprintf("auth:%s:%s:requests", apptoken, username)
-}
-
-func (s testStorageImpl) StoreUserRequest(ctx context.Context, apptoken, username string, req *plisskenserver.UserRequest) error {
-	b, err := json.Marshal(req)
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	err = s.r.Set(redisKey_UserRequest(apptoken, username), string(b))
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	return nil
-}
-
-func (s testStorageImpl) LoadUserRequest(ctx context.Context, apptoken, username string) (*plisskenserver.UserRequest, error) {
-	var req plisskenserver.UserRequest
-	str, err := s.r.Get(redisKey_UserRequest(apptoken, username))
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	if str == "" {
-		return nil, errors.New("saved data is nil")
-	}
-	err = json.Unmarshal([]byte(str), &req)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	return &req, nil
-}
-
-func (s testStorageImpl) HasUserRequest(ctx context.Context, apptoken, username string) (bool, error) {
-	return s.r.Exists(redisKey_UserRequest(apptoken, username)), nil
-}
-
-func (s testStorageImpl) StoreUserEnvelope(ctx context.Context, apptoken, username string, req *plisskenserver.UserEnvelope) error {
-	b, err := json.Marshal(req)
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	s.r.Set(redisKey_UserEnvelope(apptoken, username), string(b))
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	return nil
-}
-
-func (s testStorageImpl) LoadUserEnvelope(ctx context.Context, apptoken, username string) (*plisskenserver.UserEnvelope, error) {
-	var req plisskenserver.UserEnvelope
-	str, err := s.r.Get(redisKey_UserEnvelope(apptoken, username))
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	err = json.Unmarshal([]byte(str), &req)
-	if err != nil {
-		return nil, errors.Wrap(err, "")
-	}
-	return &req, nil
-}
-
-func (s testStorageImpl) StoreAuthNonce(
-	ctx context.Context,
-	apptoken, username string,
-	nonce []byte) error {
-	_, err := s.r.Lpush(
-		redisKey_AuthNonces(apptoken, username),
-		hex.EncodeToString(nonce))
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	fmt.Println(s.r.Dump())
-
-	return nil
-}
-
-func (s testStorageImpl) HasAuthNonce(
-	ctx context.Context,
-	apptoken, username string,
-	inputAuthNonce []byte) (bool, error) {
-	t, err := s.r.List(redisKey_AuthNonces(apptoken, username))
-	if err != nil {
-		return false, errors.Wrap(err, "")
-	}
-
-	for _, v := range t {
-		b, err := hex.DecodeString(v)
-		if err != nil {
-			// TODO <22-04-2022, afjoseph> Deal with corruption
-			logrus.Errorf("Failed to decode auth nonce: %s", v)
-		}
-		if bytes.Equal(b, inputAuthNonce) {
-			return true, nil
-		}
-	}
-
-	return false, nil
-}
-
 func doPasswordRegistration(ctx context.Context, s *plisskenserver.Server, username, password string) error {
 	// 1. Client starts the OPRF process
 	_, finData, evalReq, err := plisskenclient.MakeOprfRequest(password)
@@ -155,7 +37,7 @@ func doPasswordRegistration(ctx context.Context, s *plisskenserver.Server, usern
 	//		  not our concern, but we can expire the request after X seconds
 	//		  to avoid overloading
 	//	  And evaluate the OPRF
-	sEval, err := s.HandleNewUserRequest(ctx, testAppToken, username, evalReq)
+	sEval, requestID, err := s.HandleNewUserRequest(ctx, testAppToken, username, evalReq)
 	if err != nil {
 		return err
 	}
@@ -174,12 +56,12 @@ func doPasswordRegistration(ctx context.Context, s *plisskenserver.Server, usern
 	}
 	fmt.Printf("envU = %+v\n", envU)
 
-	// 8. Client sends envU, envUNonce, pubU, and salt to server and
-	//    deletes everything else
+	// 8. Client sends envU, envUNonce, pubU, and salt to server, with the
+	//    request ID it got in step 4, and deletes everything else
 
 	// 9. Server stores (envU, pubS, pubU, privS, and kU)
-	err = s.StoreUserData(ctx, testAppToken, username, pubU, envU,
-		envUNonce, salt)
+	err = s.StoreUserData(ctx, testAppToken, username, requestID, pubU, envU,
+		envUNonce, salt, s.PubS[:])
 	if err != nil {
 		return err
 	}
@@ -222,6 +104,25 @@ func doPasswordAuthentication(
 	if err != nil {
 		return nil, err
 	}
+
+	// 8. If the server rotated its static key, client re-seals envU for the
+	//    new key and hands it over along with the session token
+	newPubS, err := s.PendingKeyRotation(ctx, testAppToken, username)
+	if err != nil {
+		return nil, err
+	}
+	if newPubS != nil {
+		newEnvU, newEnvUNonce, err := plisskenclient.RewrapEnvU(
+			finData, sAuthEval, envU, envUNonce, rwdUSalt, *newPubS)
+		if err != nil {
+			return nil, err
+		}
+		err = s.MigrateUserEnvelope(ctx, testAppToken, username,
+			sessionToken, newEnvU, newEnvUNonce)
+		if err != nil {
+			return nil, err
+		}
+	}
 	fmt.Printf("sessionToken = %+v\n", sessionToken)
 	return sessionToken, nil
 }
@@ -230,7 +131,7 @@ func TestProtocol(t *testing.T) {
 	t.Run("Happy path: register -> login -> access private resource", func(t *testing.T) {
 		username := "truebeef"
 		password := "bunnyfoofoo"
-		s, err := plisskenserver.NewServer(testStorageImpl{miniredis.RunT(t)}, nil)
+		s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
 		require.NoError(t, err)
 		fmt.Printf("s = %+v\n", s)
 		err = doPasswordRegistration(context.Background(), s, username, password)
@@ -248,7 +149,7 @@ func TestProtocol(t *testing.T) {
 	t.Run("register -> login with same username but different password should fail", func(t *testing.T) {
 		username := "truebeef"
 		password := "bunnyfoofoo"
-		s, err := plisskenserver.NewServer(testStorageImpl{miniredis.RunT(t)}, nil)
+		s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
 		require.NoError(t, err)
 		fmt.Printf("s = %+v\n", s)
 		err = doPasswordRegistration(context.Background(), s, username, password)
@@ -260,31 +161,26 @@ func TestProtocol(t *testing.T) {
 		require.Contains(t, err.Error(), "message authentication failed")
 	})
 
-	t.Run("multiple registrations with the same credentials should yield different session tokens", func(t *testing.T) {
+	t.Run("registering a registered username should fail and keep the user's password", func(t *testing.T) {
 		username := "truebeef"
 		password := "bunnyfoofoo"
-		s, err := plisskenserver.NewServer(testStorageImpl{miniredis.RunT(t)}, nil)
+		s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
 		require.NoError(t, err)
 
 		err = doPasswordRegistration(context.Background(), s, username, password)
 		require.NoError(t, err)
-		sessionToken1, err := doPasswordAuthentication(context.Background(), s, username, password)
-		require.NoError(t, err)
-		require.NotNil(t, sessionToken1)
 
-		err = doPasswordRegistration(context.Background(), s, username, password)
-		require.NoError(t, err)
-		sessionToken2, err := doPasswordAuthentication(context.Background(), s, username, password)
+		err = doPasswordRegistration(context.Background(), s, username, "notbunnyfoofoo")
+		require.ErrorIs(t, err, plisskenserver.ErrUserExists)
+		sessionToken, err := doPasswordAuthentication(context.Background(), s, username, password)
 		require.NoError(t, err)
-		require.NotNil(t, sessionToken2)
-
-		require.NotEqual(t, sessionToken1[:], sessionToken2[:])
+		require.NotNil(t, sessionToken)
 	})
 
 	t.Run("multiple logins with the same credentials should yield different session tokens", func(t *testing.T) {
 		username := "truebeef"
 		password := "bunnyfoofoo"
-		s, err := plisskenserver.NewServer(testStorageImpl{miniredis.RunT(t)}, nil)
+		s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
 		require.NoError(t, err)
 
 		err = doPasswordRegistration(context.Background(), s, username, password)
@@ -300,4 +196,174 @@ func TestProtocol(t *testing.T) {
 
 		require.NotEqual(t, sessionToken1[:], sessionToken2[:])
 	})
+
+	t.Run("rotating the server key migrates users on their next login", func(t *testing.T) {
+		username := "truebeef"
+		password := "bunnyfoofoo"
+		storage := plisskenserver.NewMemoryStorage()
+
+		oldKeyring := plisskenserver.NewKeyring()
+		oldKey, err := oldKeyring.Add("old", nil)
+		require.NoError(t, err)
+		s, err := plisskenserver.NewServerWithKeyring(storage, oldKeyring)
+		require.NoError(t, err)
+		err = doPasswordRegistration(context.Background(), s, username, password)
+		require.NoError(t, err)
+
+		// Rotate: the old key is still in the keyring, but it's not the
+		// current one anymore
+		rotatedKeyring := plisskenserver.NewKeyring()
+		_, err = rotatedKeyring.Add(oldKey.ID, oldKeyring.Current().PrivateKey())
+		require.NoError(t, err)
+		_, err = rotatedKeyring.Add("new", nil)
+		require.NoError(t, err)
+		s, err = plisskenserver.NewServerWithKeyring(storage, rotatedKeyring)
+		require.NoError(t, err)
+		require.Equal(t, "new", s.KeyID)
+
+		newPubS, err := s.PendingKeyRotation(context.Background(), testAppToken, username)
+		require.NoError(t, err)
+		require.NotNil(t, newPubS)
+		// This login is verified with the old key, then migrates the user
+		_, err = doPasswordAuthentication(context.Background(), s, username, password)
+		require.NoError(t, err)
+
+		// User is now bound to the new key
+		newPubS, err = s.PendingKeyRotation(context.Background(), testAppToken, username)
+		require.NoError(t, err)
+		require.Nil(t, newPubS)
+		env, err := storage.LoadUserEnvelope(context.Background(), testAppToken, username)
+		require.NoError(t, err)
+		require.Equal(t, "new", env.KeyID)
+
+		// ...so the old key can be retired
+		newKeyring := plisskenserver.NewKeyring()
+		_, err = newKeyring.Add("new", rotatedKeyring.Current().PrivateKey())
+		require.NoError(t, err)
+		s, err = plisskenserver.NewServerWithKeyring(storage, newKeyring)
+		require.NoError(t, err)
+		sessionToken, err := doPasswordAuthentication(context.Background(), s, username, password)
+		require.NoError(t, err)
+		ok, err := s.IsAuthenticated(context.Background(),
+			testAppToken, username, sessionToken)
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+}
+
+func TestSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+	s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
+	require.NoError(t, err)
+
+	_, _, _, _, _, err = s.HandleNewUserAuthentication(ctx, testAppToken, "nobody", nil)
+	require.ErrorIs(t, err, plisskenserver.ErrUserNotFound)
+
+	require.NoError(t, doPasswordRegistration(ctx, s, "truebeef", "bunnyfoofoo"))
+	sessionToken, err := doPasswordAuthentication(ctx, s, "truebeef", "bunnyfoofoo")
+	require.NoError(t, err)
+
+	_, err = s.IsAuthenticated(ctx, testAppToken, "truebeef", sessionToken[1:])
+	require.ErrorIs(t, err, plisskenserver.ErrInvalidToken)
+
+	tampered := append([]byte(nil), sessionToken...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = s.IsAuthenticated(ctx, testAppToken, "truebeef", tampered)
+	require.ErrorIs(t, err, plisskenserver.ErrInvalidToken)
+
+	tampered = append([]byte(nil), sessionToken...)
+	tampered[0] ^= 1
+	_, err = s.IsAuthenticated(ctx, testAppToken, "truebeef", tampered)
+	require.ErrorIs(t, err, plisskenserver.ErrNonceNotFound)
+}
+
+func TestInvalidMessages(t *testing.T) {
+	ctx := context.Background()
+	s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
+	require.NoError(t, err)
+
+	_, _, err = s.HandleNewUserRequest(ctx, testAppToken, "truebeef", nil)
+	require.ErrorIs(t, err, plisskencommon.ErrInvalidMessage)
+	_, _, evalReq, err := plisskenclient.MakeOprfRequest("bunnyfoofoo")
+	require.NoError(t, err)
+	_, _, err = s.HandleNewUserRequest(ctx, testAppToken, "truebeef",
+		&oprf.EvaluationRequest{Elements: append(evalReq.Elements, evalReq.Elements...)})
+	require.ErrorIs(t, err, plisskencommon.ErrInvalidMessage)
+
+	// A low-order pubU would make every session token predictable
+	_, requestID, err := s.HandleNewUserRequest(ctx, testAppToken, "truebeef", evalReq)
+	require.NoError(t, err)
+	err = s.StoreUserData(ctx, testAppToken, "truebeef", requestID,
+		make([]byte, x25519.Size),
+		make([]byte, plisskencommon.EnvUSize),
+		make([]byte, plisskencommon.EnvUNonceSize),
+		make([]byte, plisskencommon.RwdUSaltSize), nil)
+	require.ErrorIs(t, err, plisskencommon.ErrInvalidMessage)
+	ok, err := s.IsRegistered(ctx, testAppToken, "truebeef")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// An envelope sealed for a key the server doesn't register users with
+	// could never be opened
+	_, finData, evalReq, err := plisskenclient.MakeOprfRequest("bunnyfoofoo")
+	require.NoError(t, err)
+	eval, requestID, err := s.HandleNewUserRequest(ctx, testAppToken, "truebeef", evalReq)
+	require.NoError(t, err)
+	other, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
+	require.NoError(t, err)
+	envU, envUNonce, pubU, salt, err := plisskenclient.MakeEnvU(finData, eval, other.PubS)
+	require.NoError(t, err)
+	err = s.StoreUserData(ctx, testAppToken, "truebeef", requestID,
+		pubU, envU, envUNonce, salt, other.PubS[:])
+	require.ErrorIs(t, err, plisskencommon.ErrInvalidMessage)
+	ok, err = s.IsRegistered(ctx, testAppToken, "truebeef")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, doPasswordRegistration(ctx, s, "truebeef", "bunnyfoofoo"))
+	sessionToken, err := doPasswordAuthentication(ctx, s, "truebeef", "bunnyfoofoo")
+	require.NoError(t, err)
+	err = s.MigrateUserEnvelope(ctx, testAppToken, "truebeef", sessionToken,
+		make([]byte, plisskencommon.EnvUSize-1),
+		make([]byte, plisskencommon.EnvUNonceSize))
+	require.ErrorIs(t, err, plisskencommon.ErrInvalidMessage)
+}
+
+func TestIsRegistered(t *testing.T) {
+	ctx := context.Background()
+	s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
+	require.NoError(t, err)
+
+	ok, err := s.IsRegistered(ctx, testAppToken, "truebeef")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	// A pending registration doesn't count
+	_, _, evalReq, err := plisskenclient.MakeOprfRequest("bunnyfoofoo")
+	require.NoError(t, err)
+	_, _, err = s.HandleNewUserRequest(ctx, testAppToken, "truebeef", evalReq)
+	require.NoError(t, err)
+	ok, err = s.IsRegistered(ctx, testAppToken, "truebeef")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	require.NoError(t, doPasswordRegistration(ctx, s, "truebeef", "bunnyfoofoo"))
+	ok, err = s.IsRegistered(ctx, testAppToken, "truebeef")
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	// Finalizing consumed the pending request
+	err = s.StoreUserData(ctx, testAppToken, "truebeef", nil, nil, nil, nil, nil, nil)
+	require.ErrorIs(t, err, plisskenserver.ErrUserNotFound)
+}
+
+func TestNewServerRand(t *testing.T) {
+	newServer := func() *plisskenserver.Server {
+		s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil,
+			plisskenserver.WithRand(bytes.NewReader(bytes.Repeat([]byte{7}, 1024))))
+		require.NoError(t, err)
+		return s
+	}
+	// The static key is generated with WithRand's reader too
+	require.Equal(t, newServer().PubS, newServer().PubS)
 }
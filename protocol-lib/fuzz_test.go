@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	plisskenserver "github.com/afjoseph/plissken-protocol/server"
+	"github.com/pkg/errors"
+)
+
+// FuzzIsAuthenticated feeds arbitrary session tokens to a server with a
+// logged-in user. Only the token the user derived may be accepted.
+func FuzzIsAuthenticated(f *testing.F) {
+	ctx := context.Background()
+	s, err := plisskenserver.NewServer(plisskenserver.NewMemoryStorage(), nil)
+	if err != nil {
+		f.Fatal(err)
+	}
+	err = doPasswordRegistration(ctx, s, "truebeef", "bunnyfoofoo")
+	if err != nil {
+		f.Fatal(err)
+	}
+	sessionToken, err := doPasswordAuthentication(ctx, s, "truebeef", "bunnyfoofoo")
+	if err != nil {
+		f.Fatal(err)
+	}
+	// The auth nonce is random: the checked-in seeds can't have it
+	f.Add(sessionToken)
+	tampered := append([]byte(nil), sessionToken...)
+	tampered[len(tampered)-1] ^= 1
+	f.Add(tampered)
+
+	f.Fuzz(func(t *testing.T, token []byte) {
+		ok, err := s.IsAuthenticated(ctx, testAppToken, "truebeef", token)
+		if ok != (err == nil) {
+			t.Fatalf("ok is %v but err is %v", ok, err)
+		}
+		if ok && !bytes.Equal(token, sessionToken) {
+			t.Fatalf("forged session token accepted: %x", token)
+		}
+		if !ok && !errors.Is(err, plisskenserver.ErrInvalidToken) &&
+			!errors.Is(err, plisskenserver.ErrNonceNotFound) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
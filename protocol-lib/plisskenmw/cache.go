@@ -0,0 +1,59 @@
+package plisskenmw
+
+import (
+	"sync"
+	"time"
+)
+
+// cache holds the identities of checked session credentials, keyed by their
+// hash, until they expire
+type cache struct {
+	size int
+
+	mu      sync.Mutex
+	entries map[[32]byte]cacheEntry
+}
+
+type cacheEntry struct {
+	id        *Identity
+	expiresAt time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: map[[32]byte]cacheEntry{}}
+}
+
+func (c *cache) get(key [32]byte, now time.Time) (*Identity, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if !now.Before(entry.expiresAt) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return entry.id, true
+}
+
+func (c *cache) add(key [32]byte, id *Identity, expiresAt, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.size {
+		// Drop the expired entries, or else any entry: a miss only costs a
+		// call to the auth-server
+		for k, entry := range c.entries {
+			if !now.Before(entry.expiresAt) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.size {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{id: id, expiresAt: expiresAt}
+}
@@ -0,0 +1,24 @@
+package plisskenmw
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// GinIdentityKey is the key of the Identity in gin's context, for handlers
+// that prefer c.MustGet() over FromContext(c.Request.Context())
+const GinIdentityKey = "plissken.identity"
+
+// Gin is Middleware for gin: unauthenticated requests are aborted
+func (a *Authenticator) Gin() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := a.Authenticate(c.Request)
+		if err != nil {
+			c.Abort()
+			a.cfg.OnError(c.Writer, c.Request, err)
+			return
+		}
+		c.Request = c.Request.WithContext(NewContext(c.Request.Context(), id))
+		c.Set(GinIdentityKey, id)
+		c.Next()
+	}
+}
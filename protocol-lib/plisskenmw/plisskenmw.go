@@ -0,0 +1,328 @@
+// Package plisskenmw authenticates the requests of resource servers. Its
+// net/http and gin middlewares read the user's credential from an
+// 'Authorization: Bearer' header or a cookie, check it, and put the user's
+// Identity in the request's context.
+//
+// Requests authenticated by cookie must also carry the CSRF header (see
+// common.CSRFHeaderName), matching the CSRF cookie, else they're rejected with
+// ErrCSRF. Bearer requests don't need it: other sites can't make browsers send
+// them.
+//
+// A credential is either:
+//   - a session credential (see common.EncodeSessionCredential), checked with
+//     the auth-server's /check-credentials. Successful checks are cached.
+//   - an access token (see package accesstoken), checked locally with the
+//     auth-server's public key.
+package plisskenmw
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/afjoseph/plissken-protocol/accesstoken"
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/pkg/errors"
+)
+
+const (
+	DefaultCookieName     = common.SessionCookieName
+	DefaultCSRFCookieName = common.CSRFCookieName
+	DefaultCacheSize      = 10000
+	DefaultCacheTTL       = 30 * time.Second
+)
+
+var (
+	// ErrNoCredential is returned when a request has neither a bearer token
+	// nor the session cookie
+	ErrNoCredential = errors.New("no credential")
+	// ErrUnauthenticated is returned when a credential is invalid or expired
+	ErrUnauthenticated = errors.New("invalid credential")
+	// ErrAuthServer is returned when the auth-server couldn't check a
+	// credential
+	ErrAuthServer = errors.New("auth-server failed to check the credential")
+	// ErrCSRF is returned when a cookie-authenticated request doesn't carry
+	// the CSRF header, or it doesn't match the CSRF cookie
+	ErrCSRF = errors.New("missing or bad CSRF token")
+)
+
+// Identity is an authenticated user
+type Identity struct {
+	AppToken string
+	Username string
+	// ExpiresAt is when the credential stops being valid, as far as we know
+	ExpiresAt time.Time
+}
+
+type Config struct {
+	// REQUIRED: Only users of this app are authenticated
+	AppToken string
+
+	// REQUIRED to accept session credentials: The auth-server's base URL and
+	// the app's secret
+	AuthEndpoint string
+	AppSecret    string
+	// OPTIONAL: Defaults to http.DefaultClient
+	HTTPClient *http.Client
+
+	// REQUIRED to accept access tokens: The auth-server's access token public
+	// key
+	AccessTokenPublicKey ed25519.PublicKey
+
+	// OPTIONAL: Defaults to DefaultCookieName and DefaultCSRFCookieName
+	CookieName     string
+	CSRFCookieName string
+
+	// OPTIONAL: How many checked session credentials are cached, and for how
+	// long. A session that ended is still accepted until its entry expires.
+	// Defaults to DefaultCacheSize and DefaultCacheTTL; a negative TTL
+	// disables the cache.
+	CacheSize int
+	CacheTTL  time.Duration
+
+	// OPTIONAL: Answers requests that failed to authenticate. Defaults to
+	// WriteError.
+	OnError func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Authenticator checks the credentials of requests
+type Authenticator struct {
+	cfg   Config
+	cache *cache
+	now   func() time.Time
+}
+
+func New(cfg Config) (*Authenticator, error) {
+	if cfg.AppToken == "" {
+		return nil, errors.New("app token is required")
+	}
+	remote := cfg.AuthEndpoint != "" || cfg.AppSecret != ""
+	if remote && (cfg.AuthEndpoint == "" || cfg.AppSecret == "") {
+		return nil, errors.New("auth endpoint and app secret must be set together")
+	}
+	if !remote && cfg.AccessTokenPublicKey == nil {
+		return nil, errors.New("either an auth endpoint or an access token public key is required")
+	}
+	if cfg.AccessTokenPublicKey != nil && len(cfg.AccessTokenPublicKey) != ed25519.PublicKeySize {
+		return nil, errors.Errorf("bad access token public key length %d",
+			len(cfg.AccessTokenPublicKey))
+	}
+	cfg.AuthEndpoint = strings.TrimSuffix(cfg.AuthEndpoint, "/")
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = http.DefaultClient
+	}
+	if cfg.CookieName == "" {
+		cfg.CookieName = DefaultCookieName
+	}
+	if cfg.CSRFCookieName == "" {
+		cfg.CSRFCookieName = DefaultCSRFCookieName
+	}
+	if cfg.CacheSize <= 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.CacheTTL == 0 {
+		cfg.CacheTTL = DefaultCacheTTL
+	}
+	if cfg.OnError == nil {
+		cfg.OnError = WriteError
+	}
+	a := &Authenticator{cfg: cfg, now: time.Now}
+	if cfg.CacheTTL > 0 {
+		a.cache = newCache(cfg.CacheSize)
+	}
+	return a, nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of 'ctx' carrying 'id'
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the Identity put in 'ctx' by the middlewares
+func FromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(contextKey{}).(*Identity)
+	return id, ok
+}
+
+// Middleware only calls 'next' with authenticated requests, whose context
+// holds the user's Identity
+func (a *Authenticator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := a.Authenticate(r)
+		if err != nil {
+			a.cfg.OnError(w, r, err)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(NewContext(r.Context(), id)))
+	})
+}
+
+// WriteError answers 401 if the request's credential is missing or invalid,
+// 403 if it failed the CSRF check, and 503 if it couldn't be checked
+func WriteError(w http.ResponseWriter, r *http.Request, err error) {
+	status := StatusCode(err)
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="plissken"`)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
+
+// StatusCode returns the HTTP status matching an error of Authenticate
+func StatusCode(err error) int {
+	switch {
+	case errors.Is(err, ErrNoCredential), errors.Is(err, ErrUnauthenticated):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrCSRF):
+		return http.StatusForbidden
+	case errors.Is(err, ErrAuthServer):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// Authenticate checks the credential of 'r' and returns the user's Identity.
+// It fails with ErrNoCredential, ErrUnauthenticated, ErrCSRF or
+// ErrAuthServer.
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	cred, fromCookie := Credential(r, a.cfg.CookieName)
+	if cred == "" {
+		return nil, errors.WithStack(ErrNoCredential)
+	}
+	if fromCookie {
+		err := CheckCSRF(r, a.cfg.CSRFCookieName)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if accesstoken.LooksLikeToken(cred) {
+		return a.checkAccessToken(cred)
+	}
+	return a.checkSessionCredential(r.Context(), cred)
+}
+
+// Credential returns the bearer token of 'r', or else its 'cookieName'
+// cookie
+func Credential(r *http.Request, cookieName string) (cred string, fromCookie bool) {
+	authz := r.Header.Get("Authorization")
+	if len(authz) > len("Bearer ") && strings.EqualFold(authz[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(authz[len("Bearer "):]), false
+	}
+	cookie, err := r.Cookie(cookieName)
+	if err != nil {
+		return "", false
+	}
+	return cookie.Value, true
+}
+
+// CheckCSRF checks that the CSRF header of 'r' matches its CSRF cookie,
+// failing with ErrCSRF. Other sites can make browsers send our cookies, but
+// can't read them.
+func CheckCSRF(r *http.Request, csrfCookieName string) error {
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil || cookie.Value == "" {
+		return errors.Wrap(ErrCSRF, "no CSRF cookie")
+	}
+	header := r.Header.Get(common.CSRFHeaderName)
+	if subtle.ConstantTimeCompare([]byte(header), []byte(cookie.Value)) != 1 {
+		return errors.Wrap(ErrCSRF, "CSRF header doesn't match the cookie")
+	}
+	return nil
+}
+
+func (a *Authenticator) checkAccessToken(token string) (*Identity, error) {
+	if a.cfg.AccessTokenPublicKey == nil {
+		return nil, errors.Wrap(ErrUnauthenticated, "access tokens aren't accepted")
+	}
+	claims, err := accesstoken.Verify(a.cfg.AccessTokenPublicKey, token, a.now())
+	if err != nil {
+		return nil, errors.Wrap(ErrUnauthenticated, err.Error())
+	}
+	if claims.Audience != a.cfg.AppToken {
+		return nil, errors.Wrapf(ErrUnauthenticated,
+			"access token is for app %q", claims.Audience)
+	}
+	return &Identity{
+		AppToken:  claims.Audience,
+		Username:  claims.Subject,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+	}, nil
+}
+
+// checkCredentialsResp is the response of /check-credentials
+type checkCredentialsResp struct {
+	Username  string `json:"username"`
+	ExpiresAt int64  `json:"expires_at"`
+	// Only set in error responses
+	Code string `json:"code"`
+}
+
+func (a *Authenticator) checkSessionCredential(ctx context.Context, cred string) (*Identity, error) {
+	if a.cfg.AuthEndpoint == "" {
+		return nil, errors.Wrap(ErrUnauthenticated, "session credentials aren't accepted")
+	}
+	username, _, err := common.DecodeSessionCredential(cred)
+	if err != nil {
+		return nil, errors.Wrap(ErrUnauthenticated, err.Error())
+	}
+	// Don't keep credentials in memory
+	cacheKey := sha256.Sum256([]byte(cred))
+	now := a.now()
+	if a.cache != nil {
+		if id, ok := a.cache.get(cacheKey, now); ok {
+			return id, nil
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet,
+		a.cfg.AuthEndpoint+"/check-credentials", nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	q := req.URL.Query()
+	q.Add("apptoken", a.cfg.AppToken)
+	q.Add("appsecret", a.cfg.AppSecret)
+	req.URL.RawQuery = q.Encode()
+	// Not in the query: it would end up in access logs
+	req.Header.Set("Authorization", "Bearer "+cred)
+	resp, err := a.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(ErrAuthServer, err.Error())
+	}
+	defer resp.Body.Close()
+	var typedResp checkCredentialsResp
+	// Error bodies are best-effort
+	decodeErr := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&typedResp)
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized && typedResp.Code == "invalid_app_secret":
+		return nil, errors.New("the auth-server rejected our app secret")
+	case resp.StatusCode == http.StatusUnauthorized:
+		return nil, errors.WithStack(ErrUnauthenticated)
+	case resp.StatusCode != http.StatusOK:
+		return nil, errors.Wrapf(ErrAuthServer, "status code %d", resp.StatusCode)
+	case decodeErr != nil:
+		return nil, errors.Wrap(ErrAuthServer, decodeErr.Error())
+	}
+
+	id := &Identity{
+		AppToken:  a.cfg.AppToken,
+		Username:  username,
+		ExpiresAt: time.Unix(typedResp.ExpiresAt, 0),
+	}
+	if a.cache != nil {
+		expiresAt := now.Add(a.cfg.CacheTTL)
+		if typedResp.ExpiresAt != 0 && id.ExpiresAt.Before(expiresAt) {
+			expiresAt = id.ExpiresAt
+		}
+		a.cache.add(cacheKey, id, expiresAt, now)
+	}
+	return id, nil
+}
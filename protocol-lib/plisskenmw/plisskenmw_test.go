@@ -0,0 +1,220 @@
+package plisskenmw
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/afjoseph/plissken-protocol/accesstoken"
+	"github.com/afjoseph/plissken-protocol/common"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAppToken  = "my-app"
+	testAppSecret = "my-secret"
+)
+
+// fakeAuthServer accepts the session token 'beef' of every user and counts
+// the calls to /check-credentials
+func fakeAuthServer(t *testing.T, calls *int32) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(calls, 1)
+		q := r.URL.Query()
+		username, sessionToken, _ := common.DecodeSessionCredential(
+			strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		switch {
+		case r.URL.Path != "/check-credentials":
+			w.WriteHeader(http.StatusNotFound)
+		case q.Get("apptoken") != testAppToken || q.Get("appsecret") != testAppSecret:
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"invalid_app_secret"}`))
+		case q.Has("session_token") || sessionToken != "beef":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"invalid_token"}`))
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"username":   username,
+				"expires_at": time.Now().Add(time.Hour).Unix(),
+			})
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// whoami answers with the username of the request's identity
+var whoami = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	id, ok := FromContext(r.Context())
+	if !ok {
+		w.WriteHeader(http.StatusTeapot)
+		return
+	}
+	w.Write([]byte(id.Username))
+})
+
+func serve(h http.Handler, setup func(r *http.Request)) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/resource", nil)
+	if setup != nil {
+		setup(r)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func bearer(cred string) func(r *http.Request) {
+	return func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+cred) }
+}
+
+func TestSessionCredentials(t *testing.T) {
+	var calls int32
+	srv := fakeAuthServer(t, &calls)
+	auth, err := New(Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: srv.URL + "/",
+		AppSecret:    testAppSecret,
+	})
+	require.NoError(t, err)
+	h := auth.Middleware(whoami)
+
+	w := serve(h, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	require.NotEmpty(t, w.Header().Get("WWW-Authenticate"))
+
+	goodCred := common.EncodeSessionCredential("bob", []byte{0xbe, 0xef})
+	for i := 0; i < 3; i++ {
+		w = serve(h, bearer(goodCred))
+		require.Equal(t, http.StatusOK, w.Code)
+		require.Equal(t, "bob", w.Body.String())
+	}
+	// Cached
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	// Cookies need the CSRF header
+	withCookies := func(csrfCookie, csrfHeader string) func(r *http.Request) {
+		return func(r *http.Request) {
+			r.AddCookie(&http.Cookie{Name: DefaultCookieName, Value: goodCred})
+			if csrfCookie != "" {
+				r.AddCookie(&http.Cookie{Name: DefaultCSRFCookieName, Value: csrfCookie})
+			}
+			if csrfHeader != "" {
+				r.Header.Set(common.CSRFHeaderName, csrfHeader)
+			}
+		}
+	}
+	w = serve(h, withCookies("csrf", "csrf"))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "bob", w.Body.String())
+	for _, tc := range [][2]string{{"", ""}, {"csrf", ""}, {"", "csrf"}, {"csrf", "other"}} {
+		w = serve(h, withCookies(tc[0], tc[1]))
+		require.Equal(t, http.StatusForbidden, w.Code, tc)
+	}
+
+	badCred := common.EncodeSessionCredential("bob", []byte{0xde, 0xad})
+	w = serve(h, bearer(badCred))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serve(h, bearer("not a credential"))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	// Failures aren't cached
+	atomic.StoreInt32(&calls, 0)
+	serve(h, bearer(badCred))
+	require.EqualValues(t, 1, atomic.LoadInt32(&calls))
+
+	// Misconfigured
+	auth, err = New(Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: srv.URL,
+		AppSecret:    "wrong",
+	})
+	require.NoError(t, err)
+	w = serve(auth.Middleware(whoami), bearer(goodCred))
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+
+	// Auth-server down
+	srv.Close()
+	auth, err = New(Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: srv.URL,
+		AppSecret:    testAppSecret,
+	})
+	require.NoError(t, err)
+	w = serve(auth.Middleware(whoami), bearer(goodCred))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestAccessTokens(t *testing.T) {
+	pubKey, privKey, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	auth, err := New(Config{AppToken: testAppToken, AccessTokenPublicKey: pubKey})
+	require.NoError(t, err)
+	h := auth.Middleware(whoami)
+
+	sign := func(audience string, ttl time.Duration) string {
+		token, err := accesstoken.Sign(privKey, &accesstoken.Claims{
+			Subject:   "bob",
+			Audience:  audience,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(ttl).Unix(),
+		})
+		require.NoError(t, err)
+		return token
+	}
+
+	w := serve(h, bearer(sign(testAppToken, time.Minute)))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "bob", w.Body.String())
+	w = serve(h, bearer(sign(testAppToken, -time.Minute)))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serve(h, bearer(sign("other-app", time.Minute)))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	// No auth endpoint: session credentials can't be checked
+	w = serve(h, bearer(common.EncodeSessionCredential("bob", []byte{0xbe, 0xef})))
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestGin(t *testing.T) {
+	var calls int32
+	srv := fakeAuthServer(t, &calls)
+	auth, err := New(Config{
+		AppToken:     testAppToken,
+		AuthEndpoint: srv.URL,
+		AppSecret:    testAppSecret,
+	})
+	require.NoError(t, err)
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(auth.Gin())
+	router.GET("/resource", func(c *gin.Context) {
+		id := c.MustGet(GinIdentityKey).(*Identity)
+		fromCtx, ok := FromContext(c.Request.Context())
+		require.True(t, ok)
+		require.Equal(t, id, fromCtx)
+		c.String(http.StatusOK, id.Username)
+	})
+
+	w := serve(router, nil)
+	require.Equal(t, http.StatusUnauthorized, w.Code)
+	w = serve(router, bearer(common.EncodeSessionCredential("bob", []byte{0xbe, 0xef})))
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "bob", w.Body.String())
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{},
+		{AppToken: testAppToken},
+		{AppToken: testAppToken, AuthEndpoint: "http://auth"},
+		{AppToken: testAppToken, AccessTokenPublicKey: []byte{1, 2, 3}},
+	} {
+		_, err := New(cfg)
+		require.Error(t, err)
+	}
+}
@@ -0,0 +1,48 @@
+package server
+
+import "github.com/pkg/errors"
+
+// Errors returned by Server and Storage implementations. They're usually
+// wrapped, so check for them with errors.Is.
+var (
+	// ErrUserNotFound is returned when a user has no envelope, or no pending
+	// registration when one is expected
+	ErrUserNotFound = errors.New("user not found")
+	// ErrUserExists is returned when registering a username that's taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrNonceNotFound is returned when a session token's auth nonce wasn't
+	// issued, or was forgotten (see MaxAuthNonces)
+	ErrNonceNotFound = errors.New("auth nonce not found")
+	// ErrInvalidToken is returned when a session token is malformed or
+	// doesn't match the user's key
+	ErrInvalidToken = errors.New("invalid session token")
+	// ErrStorageUnavailable is matched by errors from the storage's backend
+	// (connection failures, timeouts...). See StorageUnavailable.
+	ErrStorageUnavailable = errors.New("storage unavailable")
+)
+
+// StorageUnavailable wraps an error from a storage's backend so that it
+// matches ErrStorageUnavailable, while still matching 'err' itself (e.g.,
+// context.DeadlineExceeded). It returns nil if 'err' is nil.
+func StorageUnavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &storageUnavailableError{err: err}
+}
+
+type storageUnavailableError struct {
+	err error
+}
+
+func (e *storageUnavailableError) Error() string {
+	return ErrStorageUnavailable.Error() + ": " + e.err.Error()
+}
+
+func (e *storageUnavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *storageUnavailableError) Is(target error) bool {
+	return target == ErrStorageUnavailable
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	cryptoRand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/pkg/errors"
+)
+
+// StaticKey is one of the server's static x25519 keys (privS, pubS).
+//
+// Every UserEnvelope records the ID of the StaticKey its envU was sealed for,
+// so the server can keep authenticating users while the key is rotated.
+type StaticKey struct {
+	ID   string
+	Pub  x25519.Key
+	priv x25519.Key
+}
+
+// Keyring holds the server's static keys, oldest first. The last key added is
+// the "current" one: new registrations are bound to it, and users bound to
+// older keys are migrated to it on their next successful login.
+//
+// A Keyring must not be modified once it has been handed to a Server.
+type Keyring struct {
+	keys []*StaticKey
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{}
+}
+
+// KeyFingerprint returns a short, hex-encoded fingerprint of a public key.
+// It is used as the default key ID.
+func KeyFingerprint(pub x25519.Key) string {
+	h := sha256.Sum256(pub[:])
+	return hex.EncodeToString(h[:8])
+}
+
+// Add appends a new key to the keyring and makes it the current key.
+//
+// If 'id' is empty, KeyFingerprint of the public key is used. If 'privKey' is
+// nil, a random key is generated.
+func (k *Keyring) Add(id string, privKey []byte) (*StaticKey, error) {
+	key := &StaticKey{}
+	if privKey == nil {
+		_, err := io.ReadFull(cryptoRand.Reader, key.priv[:])
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+	} else {
+		if len(privKey) != x25519.Size {
+			return nil, errors.Errorf(
+				"bad private key length: %d (expected %d)",
+				len(privKey), x25519.Size)
+		}
+		copy(key.priv[:], privKey)
+	}
+	x25519.KeyGen(&key.Pub, &key.priv)
+
+	key.ID = id
+	if key.ID == "" {
+		key.ID = KeyFingerprint(key.Pub)
+	}
+	if _, ok := k.get(key.ID); ok {
+		return nil, errors.Errorf("duplicate key ID: %s", key.ID)
+	}
+	k.keys = append(k.keys, key)
+	return key, nil
+}
+
+// Current returns the newest key, or nil if the keyring is empty
+func (k *Keyring) Current() *StaticKey {
+	if len(k.keys) == 0 {
+		return nil
+	}
+	return k.keys[len(k.keys)-1]
+}
+
+// Get returns the key with the given ID.
+//
+// Envelopes stored before key IDs existed have an empty key ID: those resolve
+// to the oldest key in the keyring.
+func (k *Keyring) Get(id string) (*StaticKey, bool) {
+	if id == "" {
+		if len(k.keys) == 0 {
+			return nil, false
+		}
+		return k.keys[0], true
+	}
+	return k.get(id)
+}
+
+func (k *Keyring) get(id string) (*StaticKey, bool) {
+	for _, key := range k.keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return nil, false
+}
+
+func (k *Keyring) Len() int {
+	return len(k.keys)
+}
+
+// PrivateKey returns a copy of the private part of the key, e.g. to persist it
+func (k *StaticKey) PrivateKey() []byte {
+	b := make([]byte, x25519.Size)
+	copy(b, k.priv[:])
+	return b
+}
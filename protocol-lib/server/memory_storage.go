@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxAuthNonces is how many auth nonces a Storage must remember per user.
+// Older ones can be forgotten.
+const MaxAuthNonces = 20
+
+// MemoryStorage is a concurrency-safe Storage that keeps everything in memory.
+// It's meant for tests, development and embedding the protocol in a single
+// process: everything is lost when it's garbage collected.
+//
+// Expired entries are dropped lazily, when they're next accessed.
+type MemoryStorage struct {
+	// UserRequestTTL is how long a pending registration is kept. Zero means
+	// forever.
+	UserRequestTTL time.Duration
+	// AuthNonceTTL is how long an auth nonce is accepted. Zero means forever.
+	AuthNonceTTL time.Duration
+
+	mu        sync.Mutex
+	now       func() time.Time
+	requests  map[memoryKey]memoryUserRequest
+	envelopes map[memoryKey]*UserEnvelope
+	nonces    map[memoryKey][]memoryAuthNonce
+}
+
+type memoryKey struct {
+	apptoken, username string
+}
+
+type memoryUserRequest struct {
+	req       *UserRequest
+	expiresAt time.Time
+}
+
+type memoryAuthNonce struct {
+	nonce     []byte
+	expiresAt time.Time
+}
+
+// NewMemoryStorage returns an empty MemoryStorage without TTLs. Set its TTL
+// fields before using it to expire entries.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		now:       time.Now,
+		requests:  map[memoryKey]memoryUserRequest{},
+		envelopes: map[memoryKey]*UserEnvelope{},
+		nonces:    map[memoryKey][]memoryAuthNonce{},
+	}
+}
+
+func (s *MemoryStorage) StoreUserRequest(
+	ctx context.Context,
+	apptoken, username string,
+	req *UserRequest) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[memoryKey{apptoken, username}] = memoryUserRequest{
+		req:       copyUserRequest(req),
+		expiresAt: s.expiresAt(s.UserRequestTTL),
+	}
+	return nil
+}
+
+func (s *MemoryStorage) LoadUserRequest(
+	ctx context.Context,
+	apptoken, username string) (*UserRequest, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	req, ok := s.loadUserRequest(memoryKey{apptoken, username})
+	if !ok {
+		return nil, errors.Wrap(ErrUserNotFound, "no pending registration")
+	}
+	return req, nil
+}
+
+func (s *MemoryStorage) HasUserRequest(
+	ctx context.Context,
+	apptoken, username string) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.loadUserRequest(memoryKey{apptoken, username})
+	return ok, nil
+}
+
+func (s *MemoryStorage) StoreUserEnvelope(
+	ctx context.Context,
+	apptoken, username string,
+	env *UserEnvelope) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.envelopes[memoryKey{apptoken, username}] = copyUserEnvelope(env)
+	return nil
+}
+
+func (s *MemoryStorage) LoadUserEnvelope(
+	ctx context.Context,
+	apptoken, username string) (*UserEnvelope, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env, ok := s.envelopes[memoryKey{apptoken, username}]
+	if !ok {
+		return nil, errors.Wrap(ErrUserNotFound, "")
+	}
+	return copyUserEnvelope(env), nil
+}
+
+func (s *MemoryStorage) CompleteRegistration(
+	ctx context.Context,
+	apptoken, username string,
+	requestID []byte,
+	build func(req *UserRequest) (*UserEnvelope, error),
+) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey{apptoken, username}
+	req, ok := s.loadUserRequest(key)
+	if !ok {
+		return errors.Wrap(ErrUserNotFound, "no pending registration")
+	}
+	if _, ok := s.envelopes[key]; ok {
+		return errors.Wrap(ErrUserExists, "")
+	}
+	err := CheckUserRequestID(req, requestID)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	env, err := build(req)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.envelopes[key] = copyUserEnvelope(env)
+	delete(s.requests, key)
+	return nil
+}
+
+func (s *MemoryStorage) StoreAuthNonce(
+	ctx context.Context,
+	apptoken, username string,
+	nonce []byte) error {
+	if err := ctx.Err(); err != nil {
+		return errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey{apptoken, username}
+	nonces := append(s.liveAuthNonces(key), memoryAuthNonce{
+		nonce:     append([]byte(nil), nonce...),
+		expiresAt: s.expiresAt(s.AuthNonceTTL),
+	})
+	// Keep only the last 'MaxAuthNonces' nonces
+	if len(nonces) > MaxAuthNonces {
+		nonces = append([]memoryAuthNonce(nil), nonces[len(nonces)-MaxAuthNonces:]...)
+	}
+	s.nonces[key] = nonces
+	return nil
+}
+
+func (s *MemoryStorage) HasAuthNonce(
+	ctx context.Context,
+	apptoken, username string,
+	inputAuthNonce []byte) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, n := range s.liveAuthNonces(memoryKey{apptoken, username}) {
+		if bytes.Equal(n.nonce, inputAuthNonce) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Usernames returns the sorted usernames of 'apptoken' that have an envelope
+func (s *MemoryStorage) Usernames(apptoken string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var usernames []string
+	for key := range s.envelopes {
+		if key.apptoken == apptoken {
+			usernames = append(usernames, key.username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
+
+// expiresAt returns the zero time if 'ttl' is zero, meaning never
+func (s *MemoryStorage) expiresAt(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return s.now().Add(ttl)
+}
+
+func (s *MemoryStorage) expired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !s.now().Before(expiresAt)
+}
+
+// loadUserRequest must be called with 's.mu' held
+func (s *MemoryStorage) loadUserRequest(key memoryKey) (*UserRequest, bool) {
+	entry, ok := s.requests[key]
+	if !ok {
+		return nil, false
+	}
+	if s.expired(entry.expiresAt) {
+		delete(s.requests, key)
+		return nil, false
+	}
+	return copyUserRequest(entry.req), true
+}
+
+// liveAuthNonces drops the expired nonces of 'key', oldest first, and
+// returns the others. It must be called with 's.mu' held.
+func (s *MemoryStorage) liveAuthNonces(key memoryKey) []memoryAuthNonce {
+	nonces := s.nonces[key]
+	i := 0
+	for i < len(nonces) && s.expired(nonces[i].expiresAt) {
+		i++
+	}
+	if i == len(nonces) {
+		delete(s.nonces, key)
+		return nil
+	}
+	nonces = nonces[i:]
+	s.nonces[key] = nonces
+	return nonces
+}
+
+func copyUserRequest(req *UserRequest) *UserRequest {
+	return &UserRequest{
+		SerializedClientOprvPrivateKey: append([]byte(nil),
+			req.SerializedClientOprvPrivateKey...),
+		ID: append([]byte(nil), req.ID...),
+	}
+}
+
+func copyUserEnvelope(env *UserEnvelope) *UserEnvelope {
+	return &UserEnvelope{
+		PubU:                     append([]byte(nil), env.PubU...),
+		EnvU:                     append([]byte(nil), env.EnvU...),
+		EnvUNonce:                append([]byte(nil), env.EnvUNonce...),
+		RwdUSalt:                 append([]byte(nil), env.RwdUSalt...),
+		SerializedOprvPrivateKey: append([]byte(nil), env.SerializedOprvPrivateKey...),
+		KeyID:                    env.KeyID,
+	}
+}
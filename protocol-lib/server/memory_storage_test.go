@@ -0,0 +1,64 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("entries expire after their TTL", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		s := NewMemoryStorage()
+		s.now = func() time.Time { return now }
+		s.UserRequestTTL = time.Minute
+		s.AuthNonceTTL = time.Minute
+
+		require.NoError(t, s.StoreUserRequest(ctx, "app", "user",
+			&UserRequest{SerializedClientOprvPrivateKey: []byte("kU")}))
+		require.NoError(t, s.StoreAuthNonce(ctx, "app", "user", []byte("nonce")))
+		ok, err := s.HasUserRequest(ctx, "app", "user")
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		now = now.Add(time.Minute)
+		ok, err = s.HasUserRequest(ctx, "app", "user")
+		require.NoError(t, err)
+		require.False(t, ok)
+		_, err = s.LoadUserRequest(ctx, "app", "user")
+		require.Error(t, err)
+		ok, err = s.HasAuthNonce(ctx, "app", "user", []byte("nonce"))
+		require.NoError(t, err)
+		require.False(t, ok)
+	})
+
+	t.Run("only the last MaxAuthNonces nonces are kept", func(t *testing.T) {
+		s := NewMemoryStorage()
+		for i := 0; i < MaxAuthNonces+1; i++ {
+			require.NoError(t, s.StoreAuthNonce(ctx, "app", "user",
+				[]byte(fmt.Sprintf("nonce-%d", i))))
+		}
+		ok, err := s.HasAuthNonce(ctx, "app", "user", []byte("nonce-0"))
+		require.NoError(t, err)
+		require.False(t, ok)
+		ok, err = s.HasAuthNonce(ctx, "app", "user", []byte("nonce-1"))
+		require.NoError(t, err)
+		require.True(t, ok)
+	})
+
+	t.Run("stored values are copies", func(t *testing.T) {
+		s := NewMemoryStorage()
+		env := &UserEnvelope{EnvU: []byte("envU")}
+		require.NoError(t, s.StoreUserEnvelope(ctx, "app", "user", env))
+		env.EnvU[0] = 'X'
+		loaded, err := s.LoadUserEnvelope(ctx, "app", "user")
+		require.NoError(t, err)
+		require.Equal(t, []byte("envU"), loaded.EnvU)
+		require.Equal(t, []string{"user"}, s.Usernames("app"))
+	})
+}
@@ -7,6 +7,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"time"
 
 	"github.com/afjoseph/plissken-protocol/common"
 	"github.com/cloudflare/circl/dh/x25519"
@@ -16,16 +17,26 @@ import (
 	"golang.org/x/crypto/hkdf"
 )
 
-const DefaultAuthNonceLength = 12
+const DefaultAuthNonceLength = common.AuthNonceSize
 const DefaultSessionTokenLength = x25519.Size + DefaultAuthNonceLength
 
 type Server struct {
 	storageInterface Storage
-	privS, PubS      x25519.Key
+	keyring          *Keyring
+	rand             io.Reader
+	now              func() time.Time
+
+	// PubS and KeyID describe the current static key: the one new
+	// registrations are bound to
+	PubS  x25519.Key
+	KeyID string
 }
 
 type UserRequest struct {
 	SerializedClientOprvPrivateKey []byte `json:"client_oprf_priv_key"`
+	// Random ID the client finalizes the registration with: see
+	// CheckUserRequestID. Empty for requests stored before it existed.
+	ID []byte `json:"id,omitempty"`
 }
 
 type UserEnvelope struct {
@@ -34,25 +45,81 @@ type UserEnvelope struct {
 	EnvUNonce                []byte `json:"envu_nonce"`
 	RwdUSalt                 []byte `json:"user_key_salt"`
 	SerializedOprvPrivateKey []byte `json:"oprf_priv_key"`
+	// ID of the server static key that EnvU was sealed for. Empty for
+	// envelopes stored before key rotation was supported.
+	KeyID string `json:"key_id,omitempty"`
+}
+
+// Option configures a Server
+type Option func(*Server)
+
+// WithRand makes the server read its randomness (OPRF keys and auth nonces)
+// from 'r' instead of crypto/rand. Only for tests: see
+// client/testdata/vectors.json.
+func WithRand(r io.Reader) Option {
+	return func(s *Server) {
+		s.rand = r
+	}
 }
 
-func NewServer(storageInterface Storage, inputPrivKey []byte) (*Server, error) {
-	var privKey, pubKey x25519.Key
+// WithClock makes Server.Now return 'now' instead of time.Now. Only for tests.
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) {
+		s.now = now
+	}
+}
+
+// NewServer makes a server with a single static key. If 'inputPrivKey' is nil,
+// a random key is generated, from WithRand's reader if it's given.
+func NewServer(storageInterface Storage, inputPrivKey []byte, opts ...Option) (*Server, error) {
 	if inputPrivKey == nil {
-		_, err := io.ReadFull(cryptoRand.Reader, privKey[:])
+		inputPrivKey = make([]byte, x25519.Size)
+		_, err := io.ReadFull(newServer(opts).rand, inputPrivKey)
 		if err != nil {
 			return nil, errors.Wrap(err, "")
 		}
-	} else {
-		copy(privKey[:], inputPrivKey)
 	}
-	x25519.KeyGen(&pubKey, &privKey)
-	logrus.Debugf("Using OPAQUE server pubKey: %s", hex.EncodeToString(pubKey[:]))
-	return &Server{
-		storageInterface: storageInterface,
-		PubS:             pubKey,
-		privS:            privKey,
-	}, nil
+	keyring := NewKeyring()
+	_, err := keyring.Add("", inputPrivKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	return NewServerWithKeyring(storageInterface, keyring, opts...)
+}
+
+// newServer returns a server with its defaults and 'opts' applied
+func newServer(opts []Option) *Server {
+	s := &Server{
+		rand: cryptoRand.Reader,
+		now:  time.Now,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// NewServerWithKeyring makes a server that can authenticate users bound to any
+// key in 'keyring', and binds new registrations to keyring.Current()
+func NewServerWithKeyring(storageInterface Storage, keyring *Keyring, opts ...Option) (*Server, error) {
+	current := keyring.Current()
+	if current == nil {
+		return nil, errors.New("keyring is empty")
+	}
+	logrus.Debugf("Using OPAQUE server pubKey: %s (key ID: %s)",
+		hex.EncodeToString(current.Pub[:]), current.ID)
+	s := newServer(opts)
+	s.storageInterface = storageInterface
+	s.keyring = keyring
+	s.PubS = current.Pub
+	s.KeyID = current.ID
+	return s, nil
+}
+
+// Now is the server's clock. Servers built on this one should use it to date
+// sessions and tokens.
+func (s *Server) Now() time.Time {
+	return s.now()
 }
 
 //	   Store request
@@ -66,23 +133,32 @@ func (s *Server) HandleNewUserRequest(
 	ctx context.Context,
 	apptoken, username string,
 	evalReq *oprf.EvaluationRequest,
-) (*oprf.Evaluation, error) {
-	kU, err := oprf.GenerateKey(common.OprfSuiteID, cryptoRand.Reader)
+) (eval *oprf.Evaluation, requestID []byte, err error) {
+	err = common.CheckEvaluationRequest(evalReq)
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, nil, errors.Wrap(err, "")
+	}
+	kU, err := oprf.GenerateKey(common.OprfSuiteID, s.rand)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
 	}
 	serializedKu, err := kU.MarshalBinary()
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, nil, errors.Wrap(err, "")
 	}
 
-	ret, err := oprf.NewServer(common.OprfSuiteID, kU).
+	eval, err = oprf.NewServer(common.OprfSuiteID, kU).
 		Evaluate(evalReq)
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, nil, errors.Wrap(err, "")
 	}
-	if ret == nil {
-		return nil, errors.New("Empty response")
+	if eval == nil {
+		return nil, nil, errors.New("Empty response")
+	}
+	requestID = make([]byte, common.RequestIDSize)
+	_, err = io.ReadFull(s.rand, requestID)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "")
 	}
 
 	// TODO <28-01-22, afjoseph> Can think about making this async, but I think
@@ -92,34 +168,57 @@ func (s *Server) HandleNewUserRequest(
 		apptoken, username,
 		&UserRequest{
 			SerializedClientOprvPrivateKey: serializedKu,
+			ID:                             requestID,
 		},
 	)
 	if err != nil {
-		return nil, errors.Wrap(err, "")
+		return nil, nil, errors.Wrap(err, "")
 	}
-	return ret, nil
+	return eval, requestID, nil
 }
 
+// StoreUserData completes the registration of 'username' that
+// HandleNewUserRequest started and returned 'requestID' for. 'pubS' is the
+// server key the client sealed envU for: it must be the current one (see
+// Server.PubS). A nil 'pubS', sent by clients that predate key rotation, is
+// assumed to be the current key.
 func (s *Server) StoreUserData(
 	ctx context.Context,
 	apptoken, username string,
-	pubU, envU, nonce, rwdUSalt []byte) error {
-	userReq, err := s.storageInterface.LoadUserRequest(ctx, apptoken, username)
-	if err != nil {
-		return errors.Wrap(err, "")
-	}
-	err = s.storageInterface.StoreUserEnvelope(
-		ctx,
-		apptoken,
-		username,
-		&UserEnvelope{
+	requestID, pubU, envU, nonce, rwdUSalt, pubS []byte) error {
+	// Validated once the pending request is found, so that unknown users
+	// still get ErrUserNotFound
+	build := func(userReq *UserRequest) (*UserEnvelope, error) {
+		err := (&common.PasswordRegistrationData{
+			EnvU:      envU,
+			EnvUNonce: nonce,
+			PubU:      pubU,
+			Salt:      rwdUSalt,
+			PubS:      pubS,
+			RequestID: requestID,
+		}).Validate()
+		if err != nil {
+			return nil, errors.Wrap(err, "")
+		}
+		// Envelopes sealed for another key could never be opened: the
+		// client pinned a key this server doesn't register users with
+		if pubS != nil && !bytes.Equal(pubS, s.PubS[:]) {
+			return nil, errors.WithStack(&common.ValidationError{
+				Field:  "pub_s",
+				Reason: "isn't the server's current key " + KeyFingerprint(s.PubS),
+			})
+		}
+		return &UserEnvelope{
 			PubU:                     pubU,
 			EnvU:                     envU,
 			EnvUNonce:                nonce,
 			RwdUSalt:                 rwdUSalt,
 			SerializedOprvPrivateKey: userReq.SerializedClientOprvPrivateKey,
-		},
-	)
+			KeyID:                    s.KeyID,
+		}, nil
+	}
+
+	err := s.storageInterface.CompleteRegistration(ctx, apptoken, username, requestID, build)
 	if err != nil {
 		return errors.Wrap(err, "")
 	}
@@ -138,6 +237,10 @@ func (s *Server) HandleNewUserAuthentication(
 	if err != nil {
 		return nil, nil, nil, nil, nil, errors.Wrap(err, "")
 	}
+	err = common.CheckEvaluationRequest(evalReq)
+	if err != nil {
+		return nil, nil, nil, nil, nil, errors.Wrap(err, "")
+	}
 	kU := &oprf.PrivateKey{}
 	err = kU.UnmarshalBinary(common.OprfSuiteID, savedUserEnv.SerializedOprvPrivateKey)
 	if err != nil {
@@ -153,7 +256,7 @@ func (s *Server) HandleNewUserAuthentication(
 
 	// AuthRequest creation
 	authNonce = make([]byte, DefaultAuthNonceLength)
-	_, err = cryptoRand.Read(authNonce)
+	_, err = io.ReadFull(s.rand, authNonce)
 	if err != nil {
 		return nil, nil, nil, nil, nil, errors.Wrap(err, "")
 	}
@@ -169,13 +272,24 @@ func (s *Server) HandleNewUserAuthentication(
 		authNonce, nil
 }
 
+// IsRegistered returns whether the user finalized a registration
 func (s *Server) IsRegistered(
 	ctx context.Context,
 	apptoken, username string,
 ) (bool, error) {
-	return s.storageInterface.HasUserRequest(ctx, apptoken, username)
+	_, err := s.storageInterface.LoadUserEnvelope(ctx, apptoken, username)
+	if errors.Is(err, ErrUserNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	return true, nil
 }
 
+// IsAuthenticated checks that 'inputSessionToken' was derived by the user
+// during a login. It fails with ErrInvalidToken if it wasn't, and with
+// ErrNonceNotFound if its auth nonce is unknown.
 func (s *Server) IsAuthenticated(
 	ctx context.Context,
 	apptoken, username string,
@@ -183,7 +297,7 @@ func (s *Server) IsAuthenticated(
 ) (bool, error) {
 	// Check length
 	if len(inputSessionToken) != DefaultSessionTokenLength {
-		return false, errors.New("bad session token length")
+		return false, errors.Wrap(ErrInvalidToken, "bad session token length")
 	}
 
 	// Check if auth request exists
@@ -193,7 +307,7 @@ func (s *Server) IsAuthenticated(
 		return false, errors.Wrap(err, "")
 	}
 	if !ok {
-		return false, errors.New("no auth request found")
+		return false, errors.Wrap(ErrNonceNotFound, "")
 	}
 	authNonce := inputSessionToken[:DefaultAuthNonceLength]
 
@@ -203,13 +317,22 @@ func (s *Server) IsAuthenticated(
 		return false, errors.Wrap(err, "")
 	}
 
+	// Pick the static key the user's envelope was sealed for
+	staticKey, ok := s.keyring.Get(savedUserEnv.KeyID)
+	if !ok {
+		return false, errors.Errorf("unknown server key ID: %s", savedUserEnv.KeyID)
+	}
+
 	// Convert the necessary []byte -> x25519.Key
-	var pubU, actualInputSessionToken, sharedKey x25519.Key
-	copy(pubU[:], savedUserEnv.PubU)
+	pubU, err := common.ParseX25519Key("stored pubU", savedUserEnv.PubU)
+	if err != nil {
+		return false, errors.Wrap(err, "")
+	}
+	var actualInputSessionToken, sharedKey x25519.Key
 	copy(actualInputSessionToken[:], inputSessionToken[DefaultAuthNonceLength:])
 
 	// Derive the session key from our side
-	ok = x25519.Shared(&sharedKey, &s.privS, &pubU)
+	ok = x25519.Shared(&sharedKey, &staticKey.priv, &pubU)
 	if !ok {
 		return false, errors.New("failed to derive session key")
 	}
@@ -224,7 +347,70 @@ func (s *Server) IsAuthenticated(
 
 	// Compare
 	if !bytes.Equal(actualInputSessionToken[:], derivedSessionToken) {
-		return false, errors.New("session keys are not equal")
+		return false, errors.Wrap(ErrInvalidToken, "session keys are not equal")
 	}
 	return true, nil
 }
+
+// PendingKeyRotation returns the current static public key if the user's
+// envelope is bound to an older key, or nil if it is up to date.
+//
+// The server can't re-seal envU by itself (it is encrypted with the user's
+// rwdU), so the client is expected to re-seal it for the returned key during
+// login and hand it over with MigrateUserEnvelope.
+func (s *Server) PendingKeyRotation(
+	ctx context.Context,
+	apptoken, username string,
+) (*x25519.Key, error) {
+	savedUserEnv, err := s.storageInterface.LoadUserEnvelope(ctx, apptoken, username)
+	if err != nil {
+		return nil, errors.Wrap(err, "")
+	}
+	staticKey, ok := s.keyring.Get(savedUserEnv.KeyID)
+	if ok && staticKey.ID == s.KeyID {
+		return nil, nil
+	}
+	pubS := s.PubS
+	return &pubS, nil
+}
+
+// MigrateUserEnvelope replaces the user's envU with one re-sealed for the
+// current static key. 'inputSessionToken' must be a valid session token
+// derived with the key the envelope is currently bound to. Once migrated, the
+// user's future session tokens are derived with the current key.
+func (s *Server) MigrateUserEnvelope(
+	ctx context.Context,
+	apptoken, username string,
+	inputSessionToken, envU, envUNonce []byte,
+) error {
+	err := common.CheckSize("envu", envU, common.EnvUSize)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	err = common.CheckSize("envu_nonce", envUNonce, common.EnvUNonceSize)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	ok, err := s.IsAuthenticated(ctx, apptoken, username, inputSessionToken)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	if !ok {
+		return errors.Wrap(ErrInvalidToken, "")
+	}
+
+	savedUserEnv, err := s.storageInterface.LoadUserEnvelope(ctx, apptoken, username)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	savedUserEnv.EnvU = envU
+	savedUserEnv.EnvUNonce = envUNonce
+	savedUserEnv.KeyID = s.KeyID
+	err = s.storageInterface.StoreUserEnvelope(ctx, apptoken, username, savedUserEnv)
+	if err != nil {
+		return errors.Wrap(err, "")
+	}
+	logrus.Debugf("Migrated user %s of app %s to server key %s",
+		username, apptoken, s.KeyID)
+	return nil
+}
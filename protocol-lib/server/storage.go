@@ -1,7 +1,17 @@
 package server
 
-import "context"
+import (
+	"bytes"
+	"context"
 
+	"github.com/pkg/errors"
+)
+
+// Storage persists the server's state.
+//
+// Load* methods must fail with ErrUserNotFound if there's nothing stored, and
+// failures of the backend must match ErrStorageUnavailable (see
+// StorageUnavailable). storagetest.Run checks implementations for this.
 type Storage interface {
 	// XXX <28-01-22, afjoseph> For this flow to work, you should expire the
 	// UserRequest after X seconds
@@ -12,6 +22,18 @@ type Storage interface {
 	StoreUserEnvelope(ctx context.Context, apptoken string, username string, env *UserEnvelope) error
 	LoadUserEnvelope(ctx context.Context, apptoken string, username string) (env *UserEnvelope, err error)
 
+	// CompleteRegistration finalizes a registration atomically: 'build' is
+	// called with the pending UserRequest, and the UserEnvelope it returns is
+	// stored while the request is deleted, so that concurrent finalize calls
+	// can't pair an envelope with another kU. It fails with ErrUserNotFound
+	// if there's no pending request, if its ID isn't 'requestID' (another
+	// start call replaced it: see CheckUserRequestID), or if it changed while
+	// building the envelope, and with ErrUserExists if the user already has
+	// an envelope: a registration never replaces an existing user's.
+	CompleteRegistration(ctx context.Context, apptoken, username string,
+		requestID []byte,
+		build func(req *UserRequest) (*UserEnvelope, error)) error
+
 	StoreAuthNonce(ctx context.Context, apptoken string, username string, nonce []byte) error
 	HasAuthNonce(ctx context.Context, apptoken string, username string, nonce []byte) (ok bool, err error)
 
@@ -22,3 +44,13 @@ type Storage interface {
 	// LoadUserSessionKey(username string) (env *UserSessionKey, err error)
 	// HasUserSessionKey(username string) (ok bool, err error)
 }
+
+// CheckUserRequestID fails with ErrUserNotFound if 'req' isn't the request
+// whose ID is 'requestID': another start call replaced the one the client
+// finalizes. CompleteRegistration implementations call it before 'build'.
+func CheckUserRequestID(req *UserRequest, requestID []byte) error {
+	if len(req.ID) == 0 || !bytes.Equal(req.ID, requestID) {
+		return errors.Wrap(ErrUserNotFound, "pending registration was replaced")
+	}
+	return nil
+}
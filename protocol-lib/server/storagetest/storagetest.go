@@ -0,0 +1,332 @@
+// Package storagetest is a conformance suite for server.Storage
+// implementations. Call Run from a test of the implementation's package:
+//
+//	func TestStorage(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T) server.Storage {
+//			return NewMyStorage(...)
+//		})
+//	}
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/afjoseph/plissken-protocol/server"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testAppToken = "storagetest-app"
+	testUsername = "storagetest-user"
+)
+
+// Factory returns a new, empty storage. It's called once per subtest.
+type Factory func(t *testing.T) server.Storage
+
+// Run runs every conformance test against storages made by 'newStorage'
+func Run(t *testing.T, newStorage Factory) {
+	t.Run("missing keys", func(t *testing.T) { testMissingKeys(t, newStorage(t)) })
+	t.Run("round trips", func(t *testing.T) { testRoundTrips(t, newStorage(t)) })
+	t.Run("overwrites", func(t *testing.T) { testOverwrites(t, newStorage(t)) })
+	t.Run("users are isolated", func(t *testing.T) { testIsolation(t, newStorage(t)) })
+	t.Run("auth nonce limit", func(t *testing.T) { testAuthNonceLimit(t, newStorage(t)) })
+	t.Run("complete registration", func(t *testing.T) { testCompleteRegistration(t, newStorage(t)) })
+	t.Run("concurrency", func(t *testing.T) { testConcurrency(t, newStorage(t)) })
+	t.Run("context cancellation", func(t *testing.T) { testContextCancellation(t, newStorage(t)) })
+}
+
+func testEnvelope(seed string) *server.UserEnvelope {
+	return &server.UserEnvelope{
+		PubU:                     []byte("pubU-" + seed),
+		EnvU:                     []byte("envU-" + seed),
+		EnvUNonce:                []byte("envUNonce-" + seed),
+		RwdUSalt:                 []byte("rwdUSalt-" + seed),
+		SerializedOprvPrivateKey: []byte("kU-" + seed),
+		KeyID:                    "key-" + seed,
+	}
+}
+
+func testRequest(seed string) *server.UserRequest {
+	return &server.UserRequest{
+		SerializedClientOprvPrivateKey: []byte("kU-" + seed),
+		ID:                             []byte("id-" + seed),
+	}
+}
+
+func testMissingKeys(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+
+	_, err := s.LoadUserRequest(ctx, testAppToken, testUsername)
+	require.ErrorIs(t, err, server.ErrUserNotFound)
+	ok, err := s.HasUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	_, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.ErrorIs(t, err, server.ErrUserNotFound)
+
+	ok, err = s.HasAuthNonce(ctx, testAppToken, testUsername, []byte("nonce"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func testRoundTrips(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("a")))
+	ok, err := s.HasUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.True(t, ok)
+	req, err := s.LoadUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testRequest("a"), req)
+
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, testEnvelope("a")))
+	env, err := s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("a"), env)
+
+	// Envelopes stored before key rotation have no key ID
+	legacy := testEnvelope("legacy")
+	legacy.KeyID = ""
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, legacy))
+	env, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, legacy, env)
+
+	require.NoError(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte("nonce")))
+	ok, err = s.HasAuthNonce(ctx, testAppToken, testUsername, []byte("nonce"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = s.HasAuthNonce(ctx, testAppToken, testUsername, []byte("other-nonce"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func testOverwrites(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("a")))
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("b")))
+	req, err := s.LoadUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testRequest("b"), req)
+
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, testEnvelope("a")))
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, testEnvelope("b")))
+	env, err := s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("b"), env)
+
+	// Storing the same nonce twice is harmless
+	require.NoError(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte("nonce")))
+	require.NoError(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte("nonce")))
+	ok, err := s.HasAuthNonce(ctx, testAppToken, testUsername, []byte("nonce"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func testIsolation(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, testEnvelope("a")))
+	require.NoError(t, s.StoreUserEnvelope(ctx, "other-app", testUsername, testEnvelope("b")))
+	require.NoError(t, s.StoreUserEnvelope(ctx, testAppToken, "other-user", testEnvelope("c")))
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("a")))
+	require.NoError(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte("nonce")))
+
+	env, err := s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("a"), env)
+	env, err = s.LoadUserEnvelope(ctx, "other-app", testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("b"), env)
+	env, err = s.LoadUserEnvelope(ctx, testAppToken, "other-user")
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("c"), env)
+
+	ok, err := s.HasUserRequest(ctx, "other-app", testUsername)
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasAuthNonce(ctx, testAppToken, "other-user", []byte("nonce"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = s.HasAuthNonce(ctx, "other-app", testUsername, []byte("nonce"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func testAuthNonceLimit(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	nonce := func(i int) []byte { return []byte(fmt.Sprintf("nonce-%d", i)) }
+
+	const extra = 5
+	for i := 0; i < server.MaxAuthNonces+extra; i++ {
+		require.NoError(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, nonce(i)))
+	}
+	for i := 0; i < server.MaxAuthNonces+extra; i++ {
+		ok, err := s.HasAuthNonce(ctx, testAppToken, testUsername, nonce(i))
+		require.NoError(t, err)
+		require.Equal(t, i >= extra, ok,
+			"nonce %d: only the last %d nonces must be accepted", i, server.MaxAuthNonces)
+	}
+}
+
+func testCompleteRegistration(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	build := func(req *server.UserRequest) (*server.UserEnvelope, error) {
+		env := testEnvelope("a")
+		env.SerializedOprvPrivateKey = req.SerializedClientOprvPrivateKey
+		return env, nil
+	}
+
+	err := s.CompleteRegistration(ctx, testAppToken, testUsername, testRequest("a").ID, build)
+	require.ErrorIs(t, err, server.ErrUserNotFound, "there's no pending request")
+	_, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.ErrorIs(t, err, server.ErrUserNotFound)
+
+	// Another start call between a client's start and finalize calls
+	// replaces its request: finalizing it fails
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("a")))
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("b")))
+	err = s.CompleteRegistration(ctx, testAppToken, testUsername, testRequest("a").ID, build)
+	require.ErrorIs(t, err, server.ErrUserNotFound, "the request was replaced")
+	_, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.ErrorIs(t, err, server.ErrUserNotFound)
+	ok, err := s.HasUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.True(t, ok, "the replacing request must be kept")
+
+	err = s.CompleteRegistration(ctx, testAppToken, testUsername, testRequest("b").ID,
+		func(req *server.UserRequest) (*server.UserEnvelope, error) {
+			return nil, fmt.Errorf("build failed")
+		})
+	require.Error(t, err)
+	_, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.ErrorIs(t, err, server.ErrUserNotFound, "a failed build must not store anything")
+
+	require.NoError(t, s.CompleteRegistration(ctx, testAppToken, testUsername,
+		testRequest("b").ID, build))
+	env, err := s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testRequest("b").SerializedClientOprvPrivateKey, env.SerializedOprvPrivateKey)
+
+	// The pending request is consumed: it can't be finalized twice
+	ok, err = s.HasUserRequest(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.False(t, ok, "the pending request must be deleted")
+	err = s.CompleteRegistration(ctx, testAppToken, testUsername, testRequest("b").ID, build)
+	require.ErrorIs(t, err, server.ErrUserNotFound)
+
+	// A new request for a registered user must not replace their envelope
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("c")))
+	err = s.CompleteRegistration(ctx, testAppToken, testUsername, testRequest("c").ID, build)
+	require.ErrorIs(t, err, server.ErrUserExists)
+	env, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testRequest("b").SerializedClientOprvPrivateKey, env.SerializedOprvPrivateKey)
+
+	// Concurrent finalize calls of the same request: exactly one wins
+	const workers = 8
+	const otherUsername = testUsername + "-2"
+	require.NoError(t, s.StoreUserRequest(ctx, testAppToken, otherUsername, testRequest("d")))
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- s.CompleteRegistration(ctx, testAppToken, otherUsername,
+				testRequest("d").ID, build)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	succeeded := 0
+	for err := range errs {
+		if err == nil {
+			succeeded++
+			continue
+		}
+		if !errors.Is(err, server.ErrUserExists) {
+			require.ErrorIs(t, err, server.ErrUserNotFound)
+		}
+	}
+	require.Equal(t, 1, succeeded)
+	env, err = s.LoadUserEnvelope(ctx, testAppToken, otherUsername)
+	require.NoError(t, err)
+	require.Equal(t, testRequest("d").SerializedClientOprvPrivateKey, env.SerializedOprvPrivateKey)
+}
+
+func testConcurrency(t *testing.T, s server.Storage) {
+	ctx := context.Background()
+	const workers = 16
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("user-%d", i)
+			err := s.StoreUserRequest(ctx, testAppToken, username, testRequest(username))
+			if err == nil {
+				err = s.StoreUserEnvelope(ctx, testAppToken, username, testEnvelope(username))
+			}
+			if err == nil {
+				// All workers also hammer the same user's nonces
+				err = s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte(username))
+			}
+			if err == nil {
+				_, err = s.LoadUserEnvelope(ctx, testAppToken, username)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	for i := 0; i < workers; i++ {
+		username := fmt.Sprintf("user-%d", i)
+		env, err := s.LoadUserEnvelope(ctx, testAppToken, username)
+		require.NoError(t, err)
+		require.Equal(t, testEnvelope(username), env)
+		ok, err := s.HasAuthNonce(ctx, testAppToken, testUsername, []byte(username))
+		require.NoError(t, err)
+		require.True(t, ok)
+	}
+}
+
+func testContextCancellation(t *testing.T, s server.Storage) {
+	// Make sure there's something to load, so errors can only come from the
+	// context
+	require.NoError(t, s.StoreUserRequest(context.Background(), testAppToken, testUsername, testRequest("a")))
+	require.NoError(t, s.StoreUserEnvelope(context.Background(), testAppToken, testUsername, testEnvelope("a")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.Error(t, s.StoreUserRequest(ctx, testAppToken, testUsername, testRequest("b")))
+	_, err := s.LoadUserRequest(ctx, testAppToken, testUsername)
+	require.Error(t, err)
+	_, err = s.HasUserRequest(ctx, testAppToken, testUsername)
+	require.Error(t, err)
+	require.Error(t, s.StoreUserEnvelope(ctx, testAppToken, testUsername, testEnvelope("b")))
+	_, err = s.LoadUserEnvelope(ctx, testAppToken, testUsername)
+	require.Error(t, err)
+	require.Error(t, s.StoreAuthNonce(ctx, testAppToken, testUsername, []byte("nonce")))
+	_, err = s.HasAuthNonce(ctx, testAppToken, testUsername, []byte("nonce"))
+	require.Error(t, err)
+
+	// Nothing was overwritten
+	env, err := s.LoadUserEnvelope(context.Background(), testAppToken, testUsername)
+	require.NoError(t, err)
+	require.Equal(t, testEnvelope("a"), env)
+}
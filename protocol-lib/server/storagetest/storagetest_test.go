@@ -0,0 +1,14 @@
+package storagetest_test
+
+import (
+	"testing"
+
+	"github.com/afjoseph/plissken-protocol/server"
+	"github.com/afjoseph/plissken-protocol/server/storagetest"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) server.Storage {
+		return server.NewMemoryStorage()
+	})
+}